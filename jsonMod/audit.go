@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// Who is on the other end of the connection. Only available for unix
+// sockets.
+type peerCred struct {
+	UID    int    `json:"uid"`
+	GID    int    `json:"gid"`
+	PID    int    `json:"pid"`
+	User   string `json:"user,omitempty"`
+	Groups []int  `json:"groups,omitempty"`
+}
+
+var errNoPeerCred = errors.New("Peer credentials not available")
+
+// With "-audit" we write one of these, as a line of JSON, for each request
+// that passes thru us (or is rejected by us)
+type auditRecord struct {
+	Time     time.Time   `json:"time"`
+	Conn     int         `json:"conn"`
+	Peer     *peerCred   `json:"peer,omitempty"`
+	Remote   string      `json:"remote,omitempty"`
+	Cert     string      `json:"cert,omitempty"`
+	Verb     string      `json:"verb"`
+	URL      string      `json:"url"`
+	Mapping  string      `json:"mapping,omitempty"`
+	Upstream string      `json:"upstream,omitempty"`
+	Modified bool        `json:"modified"`
+	Diff     []diffEntry `json:"diff,omitempty"`
+	Status   int         `json:"status"`
+	Error    string      `json:"error,omitempty"`
+
+	// For shadow mappings, "diff" is what would have changed
+	Shadow      bool   `json:"shadow,omitempty"`
+	WouldReject string `json:"wouldReject,omitempty"`
+}
+
+var auditFile = ""
+var auditLog *json.Encoder
+var auditMu sync.Mutex
+
+func openAudit(file string) error {
+	if file == "-" {
+		auditLog = json.NewEncoder(os.Stdout)
+		logOut = os.Stderr
+		return nil
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	auditLog = json.NewEncoder(f)
+	return nil
+}
+
+// Write the audit record for the request in 'c'. 'status' is what was
+// sent back to the client, or zero if nothing was.
+func audit(c *call, m *mapping, status int, err error) {
+	if auditLog == nil {
+		return
+	}
+
+	rec := auditRecord{
+		Time:     time.Now().UTC(),
+		Conn:     c.id,
+		Peer:     c.peer,
+		Remote:   c.remote,
+		Verb:     c.req.Method,
+		URL:      c.req.RequestURI,
+		Modified: len(c.diff) > 0,
+		Diff:     c.diff,
+		Status:   status,
+	}
+	if m != nil {
+		rec.Mapping = m.name()
+		if m.isShadow() {
+			rec.Shadow = true
+			rec.Modified = false
+		}
+	}
+	if c.upstream != nil {
+		rec.Upstream = c.upstream.name
+	}
+	if c.shadowErr != nil {
+		rec.WouldReject = c.shadowErr.Error()
+	}
+	if c.tls != nil && len(c.tls.PeerCertificates) > 0 {
+		rec.Cert = c.tls.PeerCertificates[0].Subject.String()
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if err := auditLog.Encode(rec); err != nil {
+		log(0, "%d: Error writing audit record: %s\n", c.id, err)
+	}
+}
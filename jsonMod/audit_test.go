@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records are written after the response is sent, so wait for 'n' lines
+// to show up in 'buf' (which is written while holding 'mu')
+func waitForLines(t *testing.T, mu *sync.Mutex, buf *bytes.Buffer, n int) []string {
+	t.Helper()
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); {
+		mu.Lock()
+		raw := strings.TrimSpace(buf.String())
+		mu.Unlock()
+
+		if lines := strings.Split(raw, "\n"); raw != "" && len(lines) >= n {
+			return lines
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d lines", n)
+	return nil
+}
+
+func TestDiffValues(t *testing.T) {
+	tests := []struct {
+		old, new string
+		diffs    []string
+	}{
+		{`{"a":1}`, `{"a":1}`, []string{}},
+		{`{"a":1,"b":{"c":2}}`, `{"a":1,"b":{"c":3,"d":4}}`,
+			[]string{`b.c: 2 -> 3`, `b.d: (none) -> 4`}},
+		{`{"a":[1,2],"b":"x"}`, `{"a":[1,2,3]}`,
+			[]string{`a: [1,2] -> [1,2,3]`, `b: "x" -> (none)`}},
+		{`{"a.b":1}`, `{"a.b":2}`, []string{`["a.b"]: 1 -> 2`}},
+		{`[1]`, `{}`, []string{`body: [1] -> {}`}},
+	}
+	for _, test := range tests {
+		var old, new interface{}
+		decodeJSON([]byte(test.old), &old)
+		decodeJSON([]byte(test.new), &new)
+		diffs := []string{}
+		for _, d := range diffValues(old, new) {
+			diffs = append(diffs, d.String())
+		}
+		if !reflect.DeepEqual(diffs, test.diffs) {
+			t.Errorf("%s -> %s: expected %q, got %q", test.old, test.new, test.diffs, diffs)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	deny := ruleSpec{Verb: "POST", URL: "/containers/{id}/exec"}
+	sock := startProxy(t, testRules(t, deny, labelRule), "")
+
+	buf := &bytes.Buffer{}
+	auditMu.Lock()
+	auditLog = json.NewEncoder(buf)
+	auditMu.Unlock()
+	t.Cleanup(func() {
+		auditMu.Lock()
+		auditLog = nil
+		auditMu.Unlock()
+	})
+
+	tc := dialProxy(t, sock)
+	tc.send(post("/containers/create?name=x", `{"Labels":{"a":"b"}}`) +
+		post("/containers/x/exec", `{}`) +
+		"GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n")
+	tc.readEcho()
+	tc.readError(http.StatusForbidden)
+	tc.readEcho()
+
+	recs := []auditRecord{}
+	for _, line := range waitForLines(t, &auditMu, buf, 3) {
+		rec := auditRecord{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("Bad record %q: %s", line, err)
+		}
+		recs = append(recs, rec)
+	}
+
+	create := recs[0]
+	if create.Verb != "POST" || create.URL != "/containers/create?name=x" ||
+		create.Mapping != "POST /containers/create" || create.Upstream != "default" ||
+		!create.Modified || create.Status != 200 || len(create.Diff) != 1 ||
+		create.Diff[0].Path != "Labels.proxied" || create.Diff[0].New != "yes" {
+		t.Errorf("Bad record for the create: %+v", create)
+	}
+	if runtime.GOOS == "linux" && (create.Peer == nil || create.Peer.UID != os.Getuid()) {
+		t.Errorf("Expected our uid as the peer, got %+v", create.Peer)
+	}
+
+	if exec := recs[1]; exec.Status != http.StatusForbidden || exec.Error == "" || exec.Modified {
+		t.Errorf("Bad record for the exec: %+v", exec)
+	}
+	if ping := recs[2]; ping.Mapping != "" || ping.Modified || ping.Status != 200 {
+		t.Errorf("Bad record for the ping: %+v", ping)
+	}
+}
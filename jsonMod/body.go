@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// By the time a twiddler sees a body any chunked encoding has already been
+// removed (net/http does that for us). When we put the new body back we
+// need to make sure the framing matches it - a stale Content-Length, or
+// both a Content-Length and a "Transfer-Encoding: chunked", will corrupt
+// the stream for everything that comes after it on the connection.
+
+func isChunked(te []string) bool {
+	for _, encoding := range te {
+		if strings.EqualFold(strings.TrimSpace(encoding), "chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+// A request body that sends the client a "100 Continue" the first time it's
+// read. That way a request we reject before looking at its body never asks
+// the client to send it.
+type continueReader struct {
+	body io.ReadCloser
+	w    io.Writer
+	sent bool
+}
+
+func (cr *continueReader) Read(p []byte) (int, error) {
+	if !cr.sent {
+		cr.sent = true
+		if _, err := io.WriteString(cr.w, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			return 0, err
+		}
+	}
+	return cr.body.Read(p)
+}
+
+func (cr *continueReader) Close() error {
+	return cr.body.Close()
+}
+
+// Replace the request's body. We keep the same framing the client used, so
+// a chunked request stays chunked (along with any trailers) and anything
+// else gets a Content-Length.
+func setRequestBody(req *http.Request, buf []byte) {
+	req.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+
+	if isChunked(req.TransferEncoding) {
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		return
+	}
+
+	req.ContentLength = int64(len(buf))
+	req.TransferEncoding = nil
+}
+
+// Replace the response's body. Responses always get a Content-Length since
+// we've already read all of it.
+func setResponseBody(resp *http.Response, buf []byte) {
+	resp.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Transfer-Encoding")
+	resp.ContentLength = int64(len(buf))
+	resp.TransferEncoding = nil
+	resp.Trailer = nil
+}
+
+// A copy of what's been read from a body so it can be put back and sent
+// along. The first "-max-body" bytes are kept in memory, anything after
+// that (e.g. a big build context) goes to a temp file.
+type spool struct {
+	mem  bytes.Buffer
+	file *os.File
+	err  error
+}
+
+func (s *spool) Write(data []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if room := int(maxBodySize) - s.mem.Len(); room > 0 {
+		if room > len(data) {
+			room = len(data)
+		}
+		s.mem.Write(data[:room])
+		if room == len(data) {
+			return len(data), nil
+		}
+		n, err := s.Write(data[room:])
+		return room + n, err
+	}
+
+	if s.file == nil {
+		if s.file, s.err = ioutil.TempFile("", "jsonMod-body-"); s.err != nil {
+			return 0, s.err
+		}
+		// We only need it while it's open
+		os.Remove(s.file.Name())
+	}
+	n, err := s.file.Write(data)
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// What we've kept followed by the rest of 'body'
+func (s *spool) putBack(body io.ReadCloser) io.ReadCloser {
+	if s.file == nil {
+		return putBack(&s.mem, body)
+	}
+	rest := io.Reader(s.file)
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		// Better to fail the request than send a body with a hole in it
+		rest = errReader{err}
+	}
+	return &spoolBody{io.MultiReader(&s.mem, rest, body), s.file, body}
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+type spoolBody struct {
+	io.Reader
+	file *os.File
+	body io.Closer
+}
+
+func (b *spoolBody) Close() error {
+	b.file.Close()
+	return b.body.Close()
+}
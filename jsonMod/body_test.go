@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIsChunked(t *testing.T) {
+	tests := []struct {
+		te      []string
+		chunked bool
+	}{
+		{nil, false},
+		{[]string{"chunked"}, true},
+		{[]string{"gzip", " Chunked "}, true},
+		{[]string{"identity"}, false},
+	}
+	for _, test := range tests {
+		if chunked := isChunked(test.te); chunked != test.chunked {
+			t.Errorf("isChunked(%q): expected %v, got %v", test.te, test.chunked, chunked)
+		}
+	}
+}
+
+func TestSetRequestBody(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string // the start of what's sent upstream, after the headers
+	}{
+		{"POST /x HTTP/1.1\r\nHost: d\r\nContent-Length: 2\r\n\r\n{}",
+			"Content-Length: 7\r\n\r\n{\"a\":1}"},
+		{"POST /x HTTP/1.1\r\nHost: d\r\nTransfer-Encoding: chunked\r\n\r\n2\r\n{}\r\n0\r\n\r\n",
+			"Transfer-Encoding: chunked\r\n\r\n7\r\n{\"a\":1}\r\n0\r\n\r\n"},
+	}
+	for _, test := range tests {
+		req, err := http.ReadRequest(bufioReader(test.raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(req.Body)
+		setRequestBody(req, []byte(`{"a":1}`))
+
+		buf := &bytes.Buffer{}
+		req.Write(buf)
+		out := buf.String()
+		if !strings.HasSuffix(out, test.want) {
+			t.Errorf("Expected it to end with %q, got %q", test.want, out)
+		}
+		if strings.Contains(out, "Content-Length") && strings.Contains(out, "Transfer-Encoding") {
+			t.Errorf("Expected only one kind of framing, got %q", out)
+		}
+	}
+}
+
+func TestSetResponseBody(t *testing.T) {
+	raw := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\n{}\r\n0\r\nX-T: 1\r\n\r\n"
+	resp, err := http.ReadResponse(bufioReader(raw), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	setResponseBody(resp, []byte(`{"a":1}`))
+
+	buf := &bytes.Buffer{}
+	resp.Write(buf)
+	out := buf.String()
+	if !strings.HasSuffix(out, "Content-Length: 7\r\n\r\n{\"a\":1}") ||
+		strings.Contains(out, "chunked") || strings.Contains(out, "X-T") {
+		t.Errorf("Expected just a Content-Length, got %q", out)
+	}
+}
+
+func TestContinueReader(t *testing.T) {
+	w := &bytes.Buffer{}
+	cr := &continueReader{body: ioutil.NopCloser(strings.NewReader("body")), w: w}
+	if w.Len() != 0 || cr.sent {
+		t.Fatalf("Nothing should be sent before the body is read")
+	}
+
+	buf, _ := ioutil.ReadAll(cr)
+	if string(buf) != "body" || w.String() != "HTTP/1.1 100 Continue\r\n\r\n" {
+		t.Errorf("Expected the body and one 100, got %q %q", buf, w.String())
+	}
+	cr.Read(make([]byte, 1))
+	if w.String() != "HTTP/1.1 100 Continue\r\n\r\n" {
+		t.Errorf("Only one 100 should be sent, got %q", w.String())
+	}
+}
+
+func bufioReader(str string) *bufio.Reader {
+	return bufio.NewReader(strings.NewReader(str))
+}
+
+func TestSpool(t *testing.T) {
+	defer func(size int64) { maxBodySize = size }(maxBodySize)
+	maxBodySize = 4
+
+	for _, str := range []string{"", "abc", "abcd", "abcdefghij"} {
+		s := &spool{}
+		if _, err := io.Copy(s, strings.NewReader(str)); err != nil {
+			t.Fatal(err)
+		}
+		if s.mem.Len() > 4 || (s.file != nil) != (len(str) > 4) {
+			t.Errorf("%q: expected at most 4 bytes in memory, got %d (file: %v)", str,
+				s.mem.Len(), s.file != nil)
+		}
+
+		body := s.putBack(ioutil.NopCloser(strings.NewReader("-rest")))
+		buf, err := ioutil.ReadAll(body)
+		if err != nil || string(buf) != str+"-rest" {
+			t.Errorf("Expected %q, got %q %v", str+"-rest", buf, err)
+		}
+		body.Close()
+	}
+}
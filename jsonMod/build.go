@@ -0,0 +1,514 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+/*
+
+Build contexts:
+
+The body of a "POST /build" is a tar stream (maybe gzip'd or bzip2'd) of
+the build context rather than JSON. A rule can check the Dockerfile in it
+and add labels to the image that's built:
+
+  { "verb": "POST", "url": "/build",
+    "build": {
+      "denyImages": [ "*:latest", "docker.io/evil/*" ],
+      "allowImages": [ "docker.io/library/*", "registry.example.com/*" ],
+      "labels": { "com.example.built-by": "jsonMod" }
+    } }
+
+Each FROM (and "COPY --from=<image>") in the Dockerfile is checked, using
+any ARG defaults and "buildargs" for things like "FROM $BASE". So are the
+images BuildKit would pull for a "# syntax=<image>" directive (or the
+BUILDKIT_SYNTAX build arg) and a "RUN --mount=...,from=<image>". If one of
+them matches "denyImages", or "allowImages" is set and it doesn't match any
+of them, the build is rejected with a 403. See image.go for the patterns.
+
+The daemon uses whatever it extracts last, so the whole tar stream is read
+(up to -max-context bytes, anything over -max-body is kept in a temp file
+until it's sent along) and the build is rejected if there's more than one
+Dockerfile in it (including both "Dockerfile" and "dockerfile"), or if
+anything in it is under a symlink, since we can't tell where that ends up.
+What we read is then sent along followed by anything after the end of the
+tar stream, so the body isn't changed. The labels are added to the
+"labels" query param. If we can't find the Dockerfile (e.g. a "remote"
+build, or an xz'd context) then the build is rejected, and so are BuildKit
+builds ("version=2") since their context isn't in the body.
+
+A context that's over -max-context is rejected with a 413, or with
+-allow-large-context it's sent along without being checked (or having its
+images rewritten, see mirror.go), though its labels are still added.
+
+*/
+
+type buildSpec struct {
+	DenyImages  []string          `json:"denyImages"`
+	AllowImages []string          `json:"allowImages"`
+	Labels      map[string]string `json:"labels"`
+}
+
+// Largest Dockerfile we'll look at
+var maxDockerfileSize int64 = 1 << 20
+
+// Largest build context we'll look thru, and whether to send along bigger
+// ones without checking them
+var maxContextSize int64 = 1 << 30
+var allowLargeContext = false
+
+var errLargeContext = &httpError{http.StatusRequestEntityTooLarge,
+	"Build context is too large to check"}
+
+// Is 'err' a context that's too big, and we were told to let it thru?
+func skipLargeContext(c *call, err error) bool {
+	if err != errLargeContext || !allowLargeContext {
+		return false
+	}
+	log(1, "%d: Build context is over %d bytes, sending it along unchecked\n",
+		c.id, maxContextSize)
+	return true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func checkBuild(c *call, spec *buildSpec) error {
+	req := c.req
+	query := req.URL.Query()
+
+	if len(spec.Labels) > 0 {
+		if err := addBuildLabels(c, query, spec.Labels); err != nil {
+			return err
+		}
+	}
+
+	if len(spec.DenyImages) == 0 && len(spec.AllowImages) == 0 {
+		return nil
+	}
+
+	if query.Get("remote") != "" {
+		return denyf("Can't check the Dockerfile of a remote build context")
+	}
+	if query.Get("version") == "2" {
+		return denyf("Can't check the images of a BuildKit build")
+	}
+
+	name := query.Get("dockerfile")
+	if name == "" {
+		name = "Dockerfile"
+	}
+
+	dockerfile, err := findDockerfile(c, name)
+	if skipLargeContext(c, err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	args, err := buildArgs(query)
+	if err != nil {
+		return err
+	}
+
+	for _, image := range baseImages(dockerfile, args) {
+		if image == "scratch" {
+			continue
+		}
+		if image == "" {
+			// e.g. "FROM $BASE" without a BASE, so the daemon will fail it too
+			return denyf("The Dockerfile uses an image we can't work out")
+		}
+		if matchImage(spec.DenyImages, image) {
+			return denyf("Building from image %q is not allowed", image)
+		}
+		if len(spec.AllowImages) > 0 && !matchImage(spec.AllowImages, image) {
+			return denyf("Building from image %q is not allowed", image)
+		}
+		log(3, "%d: Build uses image %q\n", c.id, image)
+	}
+	return nil
+}
+
+// The "buildargs" query param is a JSON map of ARG values
+func buildArgs(query url.Values) (map[string]string, error) {
+	args := map[string]string{}
+	if str := query.Get("buildargs"); str != "" {
+		if err := json.Unmarshal([]byte(str), &args); err != nil {
+			return nil, &httpError{http.StatusBadRequest,
+				fmt.Sprintf("Error parsing buildargs: %s", err)}
+		}
+	}
+	return args, nil
+}
+
+// The "labels" query param is a JSON map of labels for the new image
+func addBuildLabels(c *call, query url.Values, labels map[string]string) error {
+	newLabels := map[string]string{}
+	if vals := query["labels"]; len(vals) > 0 && vals[0] != "" {
+		if err := json.Unmarshal([]byte(vals[0]), &newLabels); err != nil {
+			return &httpError{http.StatusBadRequest,
+				fmt.Sprintf("Error parsing labels: %s", err)}
+		}
+	}
+
+	for key, val := range labels {
+		newLabels[key] = val
+	}
+
+	buf, _ := json.Marshal(newLabels)
+	query["labels"] = []string{string(buf)}
+	c.req.URL.RawQuery = query.Encode()
+	log(3, "%d: Build labels are now: %s\n", c.id, buf)
+	return nil
+}
+
+// Read the whole build context looking for the Dockerfile, and then put
+// back what we read so the stream is still sent along
+func findDockerfile(c *call, name string) (string, error) {
+	req := c.req
+	read := &spool{}
+	limited := &io.LimitedReader{R: req.Body, N: maxContextSize + 1}
+	in := bufio.NewReader(io.TeeReader(limited, read))
+
+	defer func() {
+		req.Body = read.putBack(req.Body)
+	}()
+
+	context, err := openContext(in)
+	if err != nil {
+		return "", err
+	}
+
+	dockerfile, found := "", ""
+	links := map[string]bool{}
+	tr := tar.NewReader(context)
+	for {
+		hdr, err := tr.Next()
+		if limited.N <= 0 {
+			return "", errLargeContext
+		}
+		if err == io.EOF {
+			break
+		}
+		if read.err != nil {
+			return "", fmt.Errorf("Error saving the build context: %s", read.err)
+		}
+		if err != nil {
+			return "", &httpError{http.StatusBadRequest,
+				fmt.Sprintf("Error reading build context: %s", err)}
+		}
+
+		entry := contextPath(hdr.Name)
+		for dir := path.Dir(entry); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if links[dir] {
+				return "", denyf("Can't check the build context, %q is under the symlink %q",
+					hdr.Name, dir)
+			}
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			links[entry] = true
+		}
+
+		if !isDockerfile(hdr, name) {
+			continue
+		}
+		if found != "" {
+			return "", denyf("The build context has more than one Dockerfile (%q and %q)",
+				found, hdr.Name)
+		}
+		found = hdr.Name
+		if !hdr.FileInfo().Mode().IsRegular() {
+			return "", denyf("%q in the build context isn't a regular file", name)
+		}
+		if hdr.Size > maxDockerfileSize {
+			return "", &httpError{http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("%q is too large to check (over %d bytes)", name, maxDockerfileSize)}
+		}
+
+		buf, err := ioutil.ReadAll(io.LimitReader(tr, maxDockerfileSize))
+		if limited.N <= 0 {
+			return "", errLargeContext
+		}
+		if err != nil {
+			return "", &httpError{http.StatusBadRequest,
+				fmt.Sprintf("Error reading %q: %s", name, err)}
+		}
+		dockerfile = string(buf)
+	}
+
+	if found == "" {
+		return "", denyf("Couldn't find %q in the build context", name)
+	}
+	log(3, "%d: Found %q in the build context\n", c.id, found)
+	return dockerfile, nil
+}
+
+// Undo any compression of the build context
+func openContext(in *bufio.Reader) (io.Reader, error) {
+	magic, _ := in.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return nil, &httpError{http.StatusBadRequest,
+				fmt.Sprintf("Error reading build context: %s", err)}
+		}
+		return gz, nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(in), nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		return nil, denyf("Can't check the Dockerfile of an xz compressed build context")
+	}
+	return in, nil
+}
+
+// Is this tar entry the Dockerfile? The daemon falls back to "dockerfile"
+// too.
+func isDockerfile(hdr *tar.Header, name string) bool {
+	name = contextPath(name)
+	entry := contextPath(hdr.Name)
+	return entry == name || (name == "Dockerfile" && entry == "dockerfile")
+}
+
+// Where a name in the build context ends up, relative to its top
+func contextPath(name string) string {
+	return path.Clean(strings.TrimPrefix(name, "/"))
+}
+
+// Find the images that the Dockerfile pulls in, skipping references to
+// earlier stages
+func baseImages(dockerfile string, buildArgs map[string]string) []string {
+	images := []string{}
+	stages := map[string]bool{}
+	args := map[string]string{}      // ARGs before the first FROM
+	stageArgs := map[string]string{} // ARGs in the current stage
+	seenFrom := false
+
+	lines, directives := dockerfileLines(dockerfile)
+
+	syntax := directives["syntax"]
+	if val, ok := buildArgs["BUILDKIT_SYNTAX"]; ok {
+		syntax = append(syntax, val)
+	}
+	for _, val := range syntax {
+		if fields := strings.Fields(val); len(fields) > 0 {
+			images = append(images, fields[0])
+		}
+	}
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "ARG":
+			for _, arg := range fields[1:] {
+				parts := strings.SplitN(arg, "=", 2)
+				val, ok := buildArgs[parts[0]]
+				if !ok && len(parts) == 2 {
+					val, ok = strings.Trim(parts[1], `"'`), true
+				}
+				if !seenFrom {
+					// Only these can be used in a FROM
+					if ok {
+						args[parts[0]] = val
+					}
+					continue
+				}
+				if !ok {
+					// A stage can pick up the value of an earlier ARG
+					val, ok = args[parts[0]]
+				}
+				if ok {
+					stageArgs[parts[0]] = val
+				}
+			}
+
+		case "FROM":
+			seenFrom = true
+			stageArgs = map[string]string{}
+			words := []string{}
+			for _, field := range fields[1:] {
+				if !strings.HasPrefix(field, "--") {
+					words = append(words, field)
+				}
+			}
+			if len(words) == 0 {
+				continue
+			}
+			image := expandArgs(words[0], args)
+			if !stages[strings.ToLower(image)] {
+				images = append(images, image)
+			}
+			if len(words) == 3 && strings.EqualFold(words[1], "AS") {
+				stages[strings.ToLower(words[2])] = true
+			}
+
+		case "COPY":
+			for _, field := range fields[1:] {
+				if !strings.HasPrefix(field, "--from=") {
+					continue
+				}
+				from := strings.TrimPrefix(field, "--from=")
+				if !stages[strings.ToLower(from)] && strings.Trim(from, "0123456789") != "" {
+					images = append(images, from)
+				}
+			}
+
+		case "RUN":
+			// The flags come before the command
+			for _, field := range fields[1:] {
+				if !strings.HasPrefix(field, "--") {
+					break
+				}
+				if !strings.HasPrefix(field, "--mount=") {
+					continue
+				}
+				from := expandArgs(mountFrom(strings.TrimPrefix(field, "--mount=")), stageArgs)
+				if from != "" && !stages[strings.ToLower(from)] {
+					images = append(images, from)
+				}
+			}
+		}
+	}
+	return images
+}
+
+// The "from" of a "RUN --mount=type=cache,from=<image>,target=/x"
+func mountFrom(mount string) string {
+	opts, err := csv.NewReader(strings.NewReader(mount)).Read()
+	if err != nil {
+		// Not something BuildKit would accept either
+		opts = strings.Split(mount, ",")
+	}
+	for _, opt := range opts {
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[0]), "from") {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
+// Join continuation lines and drop comments, and return the parser
+// directives at the top (e.g. "# escape=`" or "# syntax=docker/dockerfile:1")
+// by their lower case names
+func dockerfileLines(dockerfile string) ([]string, map[string][]string) {
+	escape := "\\"
+	lines := []string{}
+	directives := map[string][]string{}
+	cur := ""
+	inDirectives := true
+
+	for _, line := range strings.Split(dockerfile, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+
+		if inDirectives {
+			if strings.HasPrefix(trimmed, "#") {
+				if key, val, ok := parseDirective(trimmed); ok {
+					directives[key] = append(directives[key], val)
+					if key == "escape" {
+						escape = val
+					}
+				}
+				continue
+			}
+			inDirectives = false
+		}
+
+		if strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if escape != "" && strings.HasSuffix(trimmed, escape) {
+			cur += strings.TrimSuffix(trimmed, escape) + " "
+			continue
+		}
+		lines = append(lines, cur+trimmed)
+		cur = ""
+	}
+	if cur != "" {
+		lines = append(lines, cur)
+	}
+	return lines, directives
+}
+
+// "# key = value" -> "key", "value"
+func parseDirective(line string) (string, string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(line, "#"), "=", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	key := strings.ToLower(strings.TrimSpace(parts[0]))
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", false
+	}
+	return key, strings.TrimSpace(parts[1]), true
+}
+
+// Replace $NAME and ${NAME} with the ARG's value. "${NAME:-word}" and
+// "${NAME:+word}" (and the same without the ":") work too, anything fancier
+// is left as it is so it won't look like an allowed image.
+func expandArgs(str string, args map[string]string) string {
+	return os.Expand(str, func(name string) string {
+		end := strings.IndexFunc(name, func(r rune) bool {
+			return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+				r >= '0' && r <= '9')
+		})
+		if end < 0 {
+			return args[name]
+		}
+
+		val, ok := args[name[:end]]
+		op, word := name[end:], ""
+		for _, mod := range []string{":-", ":+", "-", "+"} {
+			if strings.HasPrefix(op, mod) {
+				op, word = mod, op[len(mod):]
+				break
+			}
+		}
+		switch op {
+		case ":-":
+			if val == "" {
+				return word
+			}
+			return val
+		case "-":
+			if !ok {
+				return word
+			}
+			return val
+		case ":+":
+			if val != "" {
+				return word
+			}
+			return ""
+		case "+":
+			if ok {
+				return word
+			}
+			return ""
+		}
+		return "${" + name + "}"
+	})
+}
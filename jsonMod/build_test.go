@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	name string
+	link string // makes it a symlink
+	body string
+}
+
+func makeContext(t *testing.T, entries []tarEntry) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body))}
+		if e.link != "" {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.link, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.link == "" {
+			tw.Write([]byte(e.body))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func buildCall(body []byte, query string) *call {
+	req, _ := http.NewRequest("POST", "/build?"+query, bytes.NewReader(body))
+	return &call{req: req}
+}
+
+func TestFindDockerfile(t *testing.T) {
+	tests := []struct {
+		name       string
+		entries    []tarEntry
+		dockerfile string
+		code       int
+	}{
+		{"Dockerfile", []tarEntry{{name: "a"}, {name: "Dockerfile", body: "FROM a"}}, "FROM a", 0},
+		{"Dockerfile", []tarEntry{{name: "./Dockerfile", body: "FROM a"}}, "FROM a", 0},
+		{"Dockerfile", []tarEntry{{name: "dockerfile", body: "FROM a"}}, "FROM a", 0},
+		{"sub/Dockerfile.prod", []tarEntry{{name: "sub/Dockerfile.prod", body: "FROM a"}},
+			"FROM a", 0},
+		{"/sub/../Dockerfile", []tarEntry{{name: "Dockerfile", body: "FROM a"}}, "FROM a", 0},
+		{"Dockerfile", []tarEntry{{name: "lnk", link: "x"}, {name: "Dockerfile", body: "FROM a"}},
+			"FROM a", 0},
+
+		{"Dockerfile", []tarEntry{{name: "a"}}, "", http.StatusForbidden},
+		{"Dockerfile.prod", []tarEntry{{name: "Dockerfile"}}, "", http.StatusForbidden},
+		{"Dockerfile", []tarEntry{{name: "Dockerfile", body: "FROM a"},
+			{name: "Dockerfile", body: "FROM b"}}, "", http.StatusForbidden},
+		{"Dockerfile", []tarEntry{{name: "Dockerfile", body: "FROM a"},
+			{name: "./x/../Dockerfile", body: "FROM b"}}, "", http.StatusForbidden},
+		{"Dockerfile", []tarEntry{{name: "dockerfile", body: "FROM b"},
+			{name: "Dockerfile", body: "FROM a"}}, "", http.StatusForbidden},
+		{"Dockerfile", []tarEntry{{name: "Dockerfile", link: "/etc/x"}}, "", http.StatusForbidden},
+		{"Dockerfile", []tarEntry{{name: "Dockerfile", body: "FROM a"}, {name: "d", link: "."},
+			{name: "d/Dockerfile", body: "FROM b"}}, "", http.StatusForbidden},
+		{"Dockerfile", []tarEntry{{name: "Dockerfile", body: "FROM a"}, {name: "d/e", link: "/"},
+			{name: "d/e/f/g", body: "x"}}, "", http.StatusForbidden},
+	}
+	for i, test := range tests {
+		body := makeContext(t, test.entries)
+		c := buildCall(body, "")
+		dockerfile, err := findDockerfile(c, test.name)
+
+		code := 0
+		if err != nil {
+			he, ok := err.(*httpError)
+			if !ok {
+				t.Fatalf("%d: expected an httpError, got %T: %s", i, err, err)
+			}
+			code = he.code
+		}
+		if code != test.code || dockerfile != test.dockerfile {
+			t.Errorf("%d: expected %q %d, got %q %d (%v)", i, test.dockerfile, test.code,
+				dockerfile, code, err)
+		}
+
+		// The body has to be sent along as it was
+		sent, _ := ioutil.ReadAll(c.req.Body)
+		if !bytes.Equal(sent, body) {
+			t.Errorf("%d: the body changed", i)
+		}
+	}
+}
+
+func TestFindDockerfileLimits(t *testing.T) {
+	defer func(body, context, dockerfile int64) {
+		maxBodySize, maxContextSize, maxDockerfileSize = body, context, dockerfile
+	}(maxBodySize, maxContextSize, maxDockerfileSize)
+	maxBodySize, maxContextSize, maxDockerfileSize = 4096, 16384, 10
+
+	body := makeContext(t, []tarEntry{{name: "Dockerfile", body: "FROM a\nFROM b"}})
+	if _, err := findDockerfile(buildCall(body, ""), "Dockerfile"); err == nil ||
+		err.(*httpError).code != http.StatusRequestEntityTooLarge {
+		t.Errorf("A Dockerfile over the limit should be a 413, got %v", err)
+	}
+
+	// Over -max-body is fine, and all of it is still sent along
+	body = makeContext(t, []tarEntry{{name: "big", body: strings.Repeat("x", 8192)},
+		{name: "Dockerfile", body: "FROM a"}})
+	c := buildCall(body, "")
+	if dockerfile, err := findDockerfile(c, "Dockerfile"); err != nil || dockerfile != "FROM a" {
+		t.Errorf("Expected %q, got %q %v", "FROM a", dockerfile, err)
+	}
+	if sent, _ := ioutil.ReadAll(c.req.Body); !bytes.Equal(sent, body) {
+		t.Errorf("The body changed")
+	}
+	c.req.Body.Close()
+
+	body = makeContext(t, []tarEntry{{name: "Dockerfile", body: "FROM a"},
+		{name: "big", body: strings.Repeat("x", 32768)}})
+	if _, err := findDockerfile(buildCall(body, ""), "Dockerfile"); err != errLargeContext {
+		t.Errorf("A context over the limit should be a 413, got %v", err)
+	}
+
+	// Unless it's allowed thru, unchecked
+	defer func(allow bool) { allowLargeContext = allow }(allowLargeContext)
+	allowLargeContext = true
+	spec := &buildSpec{DenyImages: []string{"a"}, Labels: map[string]string{"x": "y"}}
+	c = buildCall(body, "")
+	if err := checkBuild(c, spec); err != nil {
+		t.Errorf("Expected it to be let thru, got %s", err)
+	}
+	if sent, _ := ioutil.ReadAll(c.req.Body); !bytes.Equal(sent, body) {
+		t.Errorf("The body changed")
+	}
+	if labels := c.req.URL.Query().Get("labels"); labels != `{"x":"y"}` {
+		t.Errorf("Expected the labels to be added, got %q", labels)
+	}
+}
+
+func TestFindDockerfileGzip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write(makeContext(t, []tarEntry{{name: "Dockerfile", body: "FROM a"}}))
+	gz.Close()
+
+	c := buildCall(buf.Bytes(), "")
+	if dockerfile, err := findDockerfile(c, "Dockerfile"); err != nil || dockerfile != "FROM a" {
+		t.Errorf("expected %q, got %q %v", "FROM a", dockerfile, err)
+	}
+	if sent, _ := ioutil.ReadAll(c.req.Body); !bytes.Equal(sent, buf.Bytes()) {
+		t.Errorf("the body changed")
+	}
+}
+
+func TestBaseImages(t *testing.T) {
+	tests := []struct {
+		dockerfile string
+		args       map[string]string
+		images     []string
+	}{
+		{"FROM alpine\nRUN echo hi", nil, []string{"alpine"}},
+		{"from alpine AS build\nFROM build\nCOPY --from=build /a /b\nCOPY --from=0 /a /b",
+			nil, []string{"alpine"}},
+		{"FROM --platform=linux/amd64 alpine\nCOPY --from=busybox /bin/sh /sh", nil,
+			[]string{"alpine", "busybox"}},
+		{"ARG BASE=alpine\nFROM $BASE\nARG LATER=x\nFROM ${LATER}", nil, []string{"alpine", ""}},
+		{"ARG BASE=alpine\nFROM ${BASE}:3", map[string]string{"BASE": "evil"},
+			[]string{"evil:3"}},
+		{"FROM \\\n  alpine", nil, []string{"alpine"}},
+		{"# escape=`\nFROM `\n  alpine", nil, []string{"alpine"}},
+		{"FROM alpine\n# FROM evil\n", nil, []string{"alpine"}},
+
+		// What BuildKit would pull
+		{"# syntax=docker/dockerfile:1\nFROM alpine", nil,
+			[]string{"docker/dockerfile:1", "alpine"}},
+		{"#Syntax = evil/frontend extra\n# escape=\\\nFROM alpine", nil,
+			[]string{"evil/frontend", "alpine"}},
+		{"FROM alpine\n# syntax=evil/frontend", nil, []string{"alpine"}},
+		{"FROM alpine", map[string]string{"BUILDKIT_SYNTAX": "evil/frontend"},
+			[]string{"evil/frontend", "alpine"}},
+		{"FROM alpine AS a\nFROM alpine\nRUN --mount=type=cache,target=/c --mount=from=a,target=/a " +
+			"--mount=type=bind,FROM=evil,target=/e echo --mount=from=not-a-flag", nil,
+			[]string{"alpine", "alpine", "evil"}},
+		{"FROM alpine\nRUN --mount=\"from=evil\",target=/e true", nil, []string{"alpine", "evil"}},
+		{"ARG IMG=evil\nFROM alpine\nARG IMG\nARG OTHER=bad\nRUN --mount=from=$IMG \\\n" +
+			"  --mount=from=${OTHER} true", nil, []string{"alpine", "evil", "bad"}},
+		{"ARG IMG=evil\nFROM alpine\nRUN --mount=from=${IMG}x true", nil, []string{"alpine", "x"}},
+	}
+	for _, test := range tests {
+		images := baseImages(test.dockerfile, test.args)
+		if !reflect.DeepEqual(images, test.images) {
+			t.Errorf("%q: expected %q, got %q", test.dockerfile, test.images, images)
+		}
+	}
+}
+
+func TestCheckBuild(t *testing.T) {
+	spec := &buildSpec{
+		DenyImages:  []string{"docker.io/evil/*"},
+		AllowImages: []string{"docker.io/library/*"},
+	}
+	tests := []struct {
+		query      string
+		dockerfile string
+		code       int
+	}{
+		{"", "FROM alpine", 0},
+		{"", "FROM scratch", 0},
+		{"", "FROM index.docker.io/library/alpine", 0},
+		{"", "FROM docker.io/alpine", 0},
+		{"", "FROM evil/app", http.StatusForbidden},
+		{"", "FROM index.docker.io/evil/app", http.StatusForbidden},
+		{"", "FROM example.com/app", http.StatusForbidden},
+		{"", "ARG BASE\nFROM ${BASE:-evil/app}", http.StatusForbidden},
+		{"", "FROM ${BASE}", http.StatusForbidden},
+		{"", "FROM ${BASE/x/y}", http.StatusForbidden},
+		{"", "# syntax=evil/frontend\nFROM alpine", http.StatusForbidden},
+		{"", "FROM alpine\nRUN --mount=from=evil/app,target=/x true", http.StatusForbidden},
+		{"buildargs=" + url.QueryEscape(`{"BUILDKIT_SYNTAX":"example.com/fe"}`), "FROM alpine",
+			http.StatusForbidden},
+		{"version=2", "FROM alpine", http.StatusForbidden},
+		{"remote=https://example.com/x.git", "FROM alpine", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		body := makeContext(t, []tarEntry{{name: "Dockerfile", body: test.dockerfile}})
+		err := checkBuild(buildCall(body, test.query), spec)
+
+		code := 0
+		if err != nil {
+			code = err.(*httpError).code
+		}
+		if code != test.code {
+			t.Errorf("%s %q: expected %d, got %d (%v)", test.query, test.dockerfile, test.code,
+				code, err)
+		}
+	}
+
+	err := checkBuild(buildCall(nil, "version=2"), spec)
+	if err == nil || err.Error() != "Can't check the images of a BuildKit build" {
+		t.Errorf("version=2: expected the BuildKit error, got %v", err)
+	}
+}
+
+func TestExpandArgs(t *testing.T) {
+	args := map[string]string{"A": "alpine", "EMPTY": ""}
+	tests := []struct {
+		str, expanded string
+	}{
+		{"$A", "alpine"},
+		{"${A}:3", "alpine:3"},
+		{"x$A", "xalpine"},
+		{"$NONE", ""},
+		{"${NONE:-evil/app}", "evil/app"},
+		{"${A:-evil/app}", "alpine"},
+		{"${EMPTY:-evil/app}", "evil/app"},
+		{"${EMPTY-evil/app}", ""},
+		{"${NONE-evil/app}", "evil/app"},
+		{"${A:+evil/app}", "evil/app"},
+		{"${EMPTY:+evil/app}", ""},
+		{"${EMPTY+evil/app}", "evil/app"},
+		{"${NONE+evil/app}", ""},
+		{"${A#alp}", "${A#alp}"},
+		{"${A/alpine/evil}", "${A/alpine/evil}"},
+	}
+	for _, test := range tests {
+		if expanded := expandArgs(test.str, args); expanded != test.expanded {
+			t.Errorf("expandArgs(%q): expected %q, got %q", test.str, test.expanded, expanded)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// Fill in the parts of the peer's credentials that the kernel doesn't give
+// us directly
+func (p *peerCred) lookup() {
+	if u, err := user.LookupId(strconv.Itoa(p.UID)); err == nil {
+		p.User = u.Username
+	}
+	p.Groups = getGroups(p.PID)
+}
+
+func (p *peerCred) inGroup(gid int) bool {
+	if p.GID == gid {
+		return true
+	}
+	for _, group := range p.Groups {
+		if group == gid {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, val int) bool {
+	for _, item := range list {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the mapping's uid/gid conditions against the caller. If we don't
+// know who the caller is (not a unix socket) then they can't be let off by
+// "exceptUids"/"exceptGids", and they only match "uids"/"gids" on a deny
+// rule. Either way not knowing who it is never gets a request past a rule.
+func (m *mapping) matchCaller(peer *peerCred) bool {
+	if peer == nil {
+		return (len(m.uids) == 0 && len(m.gids) == 0) || m.isDeny()
+	}
+
+	if len(m.uids) > 0 && !containsInt(m.uids, peer.UID) {
+		return false
+	}
+	if containsInt(m.exceptUIDs, peer.UID) {
+		return false
+	}
+
+	if len(m.gids) > 0 {
+		found := false
+		for _, gid := range m.gids {
+			if peer.inGroup(gid) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, gid := range m.exceptGIDs {
+		if peer.inGroup(gid) {
+			return false
+		}
+	}
+	return true
+}
+
+// The values a rule's op can use in its "from"
+func isCallerValue(name string) bool {
+	switch name {
+	case "caller.uid", "caller.gid", "caller.pid", "caller.user":
+		return true
+	}
+	return false
+}
+
+func callerValue(c *call, name string) (interface{}, error) {
+	if !isCallerValue(name) {
+		return nil, fmt.Errorf("Unknown value %q", name)
+	}
+	if c.peer == nil {
+		return nil, fmt.Errorf("Caller's credentials aren't available")
+	}
+
+	switch name {
+	case "caller.uid":
+		return strconv.Itoa(c.peer.UID), nil
+	case "caller.gid":
+		return strconv.Itoa(c.peer.GID), nil
+	case "caller.user":
+		if c.peer.User == "" {
+			return strconv.Itoa(c.peer.UID), nil
+		}
+		return c.peer.User, nil
+	}
+
+	// Must be "caller.pid"
+	return strconv.Itoa(c.peer.PID), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestMatchCaller(t *testing.T) {
+	root := &peerCred{UID: 0, GID: 0}
+	user := &peerCred{UID: 1000, GID: 1000, Groups: []int{999}}
+
+	tests := []struct {
+		name  string
+		m     mapping
+		peer  *peerCred
+		match bool
+	}{
+		{"no conditions", mapping{}, nil, true},
+		{"no conditions", mapping{}, user, true},
+
+		{"uids", mapping{uids: []int{1000}, fn: noopTwiddler}, user, true},
+		{"uids", mapping{uids: []int{1000}, fn: noopTwiddler}, root, false},
+		{"uids unknown caller", mapping{uids: []int{1000}, fn: noopTwiddler}, nil, false},
+		{"uids deny unknown caller", mapping{uids: []int{1000}, deny: "no"}, nil, true},
+
+		{"gids", mapping{gids: []int{999}, fn: noopTwiddler}, user, true},
+		{"gids", mapping{gids: []int{999}, fn: noopTwiddler}, root, false},
+		{"gids unknown caller", mapping{gids: []int{999}, fn: noopTwiddler}, nil, false},
+		{"gids deny unknown caller", mapping{gids: []int{999}}, nil, true},
+
+		{"exceptUids", mapping{exceptUIDs: []int{0}, deny: "no"}, root, false},
+		{"exceptUids", mapping{exceptUIDs: []int{0}, deny: "no"}, user, true},
+		{"exceptUids unknown caller", mapping{exceptUIDs: []int{0}, deny: "no"}, nil, true},
+		{"exceptUids unknown caller", mapping{exceptUIDs: []int{0}, fn: noopTwiddler}, nil, true},
+
+		{"exceptGids", mapping{exceptGIDs: []int{999}, deny: "no"}, user, false},
+		{"exceptGids", mapping{exceptGIDs: []int{999}, deny: "no"}, root, true},
+		{"exceptGids unknown caller", mapping{exceptGIDs: []int{999}, deny: "no"}, nil, true},
+	}
+
+	for _, test := range tests {
+		if got := test.m.matchCaller(test.peer); got != test.match {
+			t.Errorf("%s: peer %v: expected %v, got %v", test.name, test.peer, test.match, got)
+		}
+	}
+}
+
+func noopTwiddler(c *call, body map[string]interface{}) (map[string]interface{}, error) {
+	return body, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"../jsonext"
+)
+
+/*
+
+Typed twiddlers:
+
+Instead of digging thru a map[string]interface{} (and hoping that "Labels"
+really is an object), a twiddler for "POST /containers/create" can take a
+ContainerCreateRequest:
+
+  func addOwner(c *call, req *ContainerCreateRequest) error {
+      if req.Labels == nil {
+          req.Labels = map[string]string{}
+      }
+      req.Labels["owner"] = "me"
+      return nil
+  }
+
+  { verb: "POST", url: "/containers/create", fn: createTwiddler(addOwner) }
+
+The body is parsed with jsonext so anything these structs don't know about
+is kept in their "Exts" map and sent along as is. A body that doesn't fit
+(e.g. "Labels" is a list) is rejected with a 400 before the twiddler is
+called. So is one with keys that only differ by case (e.g. "Labels" and
+"labels"), since jsonext (like the daemon) matches field names without
+regard to case and we can't tell which one would win.
+
+*/
+
+type ContainerCreateRequest struct {
+	Hostname     string                 `json:",omitempty"`
+	User         string                 `json:",omitempty"`
+	Env          []string               `json:",omitempty"`
+	Cmd          StrSlice               `json:",omitempty"`
+	Entrypoint   StrSlice               `json:",omitempty"`
+	Image        string                 `json:",omitempty"`
+	WorkingDir   string                 `json:",omitempty"`
+	Labels       map[string]string      `json:",omitempty"`
+	ExposedPorts map[string]interface{} `json:",omitempty"`
+	Volumes      map[string]interface{} `json:",omitempty"`
+	Tty          bool                   `json:",omitempty"`
+
+	HostConfig       *HostConfig       `json:",omitempty"`
+	NetworkingConfig *NetworkingConfig `json:",omitempty"`
+
+	Exts map[string]interface{} `json:",exts"`
+}
+
+type HostConfig struct {
+	Binds          []string                 `json:",omitempty"`
+	Mounts         []Mount                  `json:",omitempty"`
+	NetworkMode    string                   `json:",omitempty"`
+	PortBindings   map[string][]PortBinding `json:",omitempty"`
+	RestartPolicy  *RestartPolicy           `json:",omitempty"`
+	Privileged     bool                     `json:",omitempty"`
+	ReadonlyRootfs bool                     `json:",omitempty"`
+	CapAdd         []string                 `json:",omitempty"`
+	CapDrop        []string                 `json:",omitempty"`
+	SecurityOpt    []string                 `json:",omitempty"`
+	Annotations    map[string]string        `json:",omitempty"`
+	Memory         int64                    `json:",omitempty"`
+	NanoCpus       int64                    `json:",omitempty"`
+	PidsLimit      *int64                   `json:",omitempty"`
+
+	Exts map[string]interface{} `json:",exts"`
+}
+
+type Mount struct {
+	Type     string `json:",omitempty"`
+	Source   string `json:",omitempty"`
+	Target   string `json:",omitempty"`
+	ReadOnly bool   `json:",omitempty"`
+
+	Exts map[string]interface{} `json:",exts"`
+}
+
+type PortBinding struct {
+	HostIp   string `json:",omitempty"`
+	HostPort string `json:",omitempty"`
+
+	Exts map[string]interface{} `json:",exts"`
+}
+
+type RestartPolicy struct {
+	Name              string `json:",omitempty"`
+	MaximumRetryCount int    `json:",omitempty"`
+
+	Exts map[string]interface{} `json:",exts"`
+}
+
+type NetworkingConfig struct {
+	EndpointsConfig map[string]*EndpointSettings `json:",omitempty"`
+
+	Exts map[string]interface{} `json:",exts"`
+}
+
+type EndpointSettings struct {
+	NetworkID string   `json:",omitempty"`
+	Aliases   []string `json:",omitempty"`
+
+	Exts map[string]interface{} `json:",exts"`
+}
+
+// Cmd and Entrypoint can be a string or a list of strings, just like the
+// daemon's strslice
+type StrSlice []string
+
+func (s *StrSlice) UnmarshalJSON(buf []byte) error {
+	var list []string
+	if err := json.Unmarshal(buf, &list); err == nil {
+		*s = list
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(buf, &str); err != nil {
+		return fmt.Errorf("Expected a string or a list of strings: %s", buf)
+	}
+	*s = StrSlice{str}
+	return nil
+}
+
+type createFunc func(*call, *ContainerCreateRequest) error
+
+// Turn a typed twiddler into a regular one
+func createTwiddler(fn createFunc) tFunc {
+	return func(c *call, body map[string]interface{}) (map[string]interface{}, error) {
+		buf, err := marshalValue(body)
+		if err != nil {
+			return nil, err
+		}
+
+		req := &ContainerCreateRequest{}
+		if err := checkFoldKeys(body, reflect.TypeOf(req)); err != nil {
+			return nil, err
+		}
+		if err := jsonext.UnmarshalUseNumber(buf, req); err != nil {
+			return nil, &httpError{http.StatusBadRequest,
+				fmt.Sprintf("Error parsing body as a ContainerCreateRequest: %s", err)}
+		}
+
+		if err := fn(c, req); err != nil {
+			return nil, err
+		}
+
+		if buf, err = jsonext.Marshal(req); err != nil {
+			return nil, err
+		}
+		newBody := map[string]interface{}{}
+		if err := decodeJSON(buf, &newBody); err != nil {
+			return nil, err
+		}
+		keepEmpty(body, newBody)
+		return newBody, nil
+	}
+}
+
+// Make sure no two keys in 'val' go to the same field of 't'
+func checkFoldKeys(val interface{}, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch v := val.(type) {
+	case map[string]interface{}:
+		if t.Kind() == reflect.Map {
+			for _, item := range v {
+				if err := checkFoldKeys(item, t.Elem()); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" || field.Name == "Exts" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			item, ok, err := lookupFold(v, name)
+			if err != nil {
+				return err
+			}
+			if ok {
+				if err := checkFoldKeys(item, field.Type); err != nil {
+					return err
+				}
+			}
+		}
+
+	case []interface{}:
+		if t.Kind() == reflect.Slice {
+			for _, item := range v {
+				if err := checkFoldKeys(item, t.Elem()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// "omitempty" drops any empty fields (e.g. "Env": [] or "Tty": false) that
+// the client sent, so put them back. This way the body only changes where
+// the twiddler changed it.
+func keepEmpty(orig, val interface{}) {
+	switch o := orig.(type) {
+	case map[string]interface{}:
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, origVal := range o {
+			if newVal, ok := obj[key]; ok {
+				keepEmpty(origVal, newVal)
+			} else if isEmpty(origVal) {
+				obj[key] = origVal
+			}
+		}
+	case []interface{}:
+		list, ok := val.([]interface{})
+		if !ok || len(list) != len(o) {
+			return
+		}
+		for i := range o {
+			keepEmpty(o[i], list[i])
+		}
+	}
+}
+
+func isEmpty(val interface{}) bool {
+	switch v := val.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case json.Number:
+		n, _ := v.Float64()
+		return n == 0
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCreateTwiddler(t *testing.T) {
+	addOwner := createTwiddler(func(c *call, req *ContainerCreateRequest) error {
+		if req.Labels == nil {
+			req.Labels = map[string]string{}
+		}
+		req.Labels["owner"] = "me"
+		return nil
+	})
+
+	tests := []struct {
+		body string
+		want string
+		code int
+	}{
+		{`{"Image":"alpine","Env":[],"Tty":false,"Foo":{"x":1}}`,
+			`{"Image":"alpine","Env":[],"Tty":false,"Foo":{"x":1},"Labels":{"owner":"me"}}`, 0},
+		{`{"Image":"alpine","Labels":{"a":"1","A":"2"}}`,
+			`{"Image":"alpine","Labels":{"a":"1","A":"2","owner":"me"}}`, 0},
+		{`{"Image":"alpine","Foo":1,"foo":2}`,
+			`{"Image":"alpine","Foo":1,"foo":2,"Labels":{"owner":"me"}}`, 0},
+		{`{"HostConfig":{"Memory":12345678901234567890}}`, "", http.StatusBadRequest},
+		{`{"Labels":["a"]}`, "", http.StatusBadRequest},
+
+		{`{"Labels":{"a":"1"},"labels":{"b":"2"}}`, "", http.StatusBadRequest},
+		{`{"image":"alpine","IMAGE":"evil"}`, "", http.StatusBadRequest},
+		{`{"HostConfig":{"Privileged":false,"privileged":true}}`, "", http.StatusBadRequest},
+		{`{"HostConfig":{"Mounts":[{"Type":"volume","type":"bind"}]}}`, "", http.StatusBadRequest},
+		{`{"NetworkingConfig":{"EndpointsConfig":{"n":{"Aliases":[],"aliases":["x"]}}}}`, "",
+			http.StatusBadRequest},
+		{`{"HostConfig":{"PortBindings":{"80/tcp":[{"HostPort":"1","hostport":"2"}]}}}`, "",
+			http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		body := map[string]interface{}{}
+		if err := decodeJSON([]byte(test.body), &body); err != nil {
+			t.Fatal(err)
+		}
+		newBody, err := addOwner(&call{}, body)
+		if test.code != 0 {
+			if he, ok := err.(*httpError); !ok || he.code != test.code {
+				t.Errorf("%s: expected a %d, got %v", test.body, test.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.body, err)
+			continue
+		}
+		if buf, _ := encodeLike([]byte(test.body), newBody); string(buf) != test.want {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", test.body, test.want, buf)
+		}
+	}
+}
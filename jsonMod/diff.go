@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// One change between two versions of a body. A missing Old means it was
+// added, a missing New means it was deleted.
+type diffEntry struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// e.g. `Labels.team: "blue" -> "red"`
+func (d diffEntry) String() string {
+	oldBuf, _ := marshalValue(d.Old)
+	newBuf, _ := marshalValue(d.New)
+	if d.Old == nil {
+		oldBuf = []byte("(none)")
+	}
+	if d.New == nil {
+		newBuf = []byte("(none)")
+	}
+	path := d.Path
+	if path == "" {
+		path = "body"
+	}
+	return fmt.Sprintf("%s: %s -> %s", path, oldBuf, newBuf)
+}
+
+// Compare two decoded JSON values and list what changed. Objects are
+// compared key by key, anything else (including arrays) is compared as a
+// whole.
+func diffValues(old, new interface{}) []diffEntry {
+	return diffAt(nil, old, new, []diffEntry{})
+}
+
+func diffAt(path []pathElem, old, new interface{}, diffs []diffEntry) []diffEntry {
+	oldObj, oldOK := old.(map[string]interface{})
+	newObj, newOK := new.(map[string]interface{})
+
+	if !oldOK || !newOK {
+		if !equalValues(old, new) {
+			diffs = append(diffs, diffEntry{Path: joinPath(path), Old: old, New: new})
+		}
+		return diffs
+	}
+
+	keys := []string{}
+	for k := range oldObj {
+		keys = append(keys, k)
+	}
+	for k := range newObj {
+		if _, ok := oldObj[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		subPath := append(path[:len(path):len(path)], pathElem{key: k})
+		oldVal, inOld := oldObj[k]
+		newVal, inNew := newObj[k]
+
+		switch {
+		case !inOld:
+			diffs = append(diffs, diffEntry{Path: joinPath(subPath), New: newVal})
+		case !inNew:
+			diffs = append(diffs, diffEntry{Path: joinPath(subPath), Old: oldVal})
+		default:
+			diffs = diffAt(subPath, oldVal, newVal, diffs)
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+)
+
+// Bodies are decoded with json.Number for numbers, so big ints (e.g. a
+// Memory limit > 2^53) come thru untouched, and when we write a body back
+// out we use the original bytes for anything that didn't change. Only the
+// parts of the body that a rule touched get re-encoded, the keys keep
+// their original order, and new keys are added at the end of their object.
+
+// Like json.Unmarshal but numbers end up as json.Number
+func decodeJSON(buf []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("Unexpected data after the JSON value")
+	}
+	return nil
+}
+
+// Like json.Marshal but without turning <, > and & into \u003c etc.
+func marshalValue(val interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(val); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// Numbers can be a json.Number (from a body) or a float64/int (from Go
+// code), so compare them by value
+func toNumber(val interface{}) (json.Number, bool) {
+	switch v := val.(type) {
+	case json.Number:
+		return v, true
+	case float64:
+		return json.Number(fmt.Sprint(v)), true
+	case int:
+		return json.Number(fmt.Sprint(v)), true
+	case int64:
+		return json.Number(fmt.Sprint(v)), true
+	}
+	return "", false
+}
+
+func equalNumbers(a, b json.Number) bool {
+	if a == b {
+		return true
+	}
+	// Ints of any size are compared exactly, float64 would round big ones
+	ai, ok1 := new(big.Int).SetString(string(a), 10)
+	bi, ok2 := new(big.Int).SetString(string(b), 10)
+	if ok1 && ok2 {
+		return ai.Cmp(bi) == 0
+	}
+	af, err1 := a.Float64()
+	bf, err2 := b.Float64()
+	return err1 == nil && err2 == nil && af == bf
+}
+
+func equalValues(a, b interface{}) bool {
+	if an, ok := toNumber(a); ok {
+		bn, ok := toNumber(b)
+		return ok && equalNumbers(an, bn)
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, item := range av {
+			other, ok := bv[k]
+			if !ok || !equalValues(item, other) {
+				return false
+			}
+		}
+		return true
+
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equalValues(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+
+	case string:
+		bv, ok := b.(string)
+		return ok && av == bv
+	case bool:
+		bv, ok := b.(bool)
+		return ok && av == bv
+	case nil:
+		return b == nil
+	}
+
+	// Something from Go code (e.g. a map[string]string), let json decide
+	abuf, err1 := json.Marshal(a)
+	bbuf, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && bytes.Equal(abuf, bbuf)
+}
+
+type rawField struct {
+	key   string
+	value json.RawMessage
+}
+
+// Split a JSON object into its keys and (raw) values, in order
+func splitObject(buf []byte) ([]rawField, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("Not a JSON object")
+	}
+
+	fields := []rawField{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		field := rawField{key: tok.(string)}
+		if err := dec.Decode(&field.value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+func splitArray(buf []byte) ([]json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, fmt.Errorf("Not a JSON array")
+	}
+
+	items := []json.RawMessage{}
+	for dec.More() {
+		var item json.RawMessage
+		if err := dec.Decode(&item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Encode 'val' reusing as much of 'orig' (the bytes it was decoded from,
+// before being modified) as we can
+func encodeLike(orig []byte, val interface{}) ([]byte, error) {
+	orig = bytes.TrimSpace(orig)
+	if len(orig) == 0 {
+		return marshalValue(val)
+	}
+
+	switch v := val.(type) {
+	case map[string]interface{}:
+		if orig[0] != '{' || v == nil {
+			break
+		}
+		fields, err := splitObject(orig)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := &bytes.Buffer{}
+		buf.WriteByte('{')
+		seen := map[string]bool{}
+		changed := len(fields) != len(v)
+
+		writeField := func(key string, value []byte) {
+			if buf.Len() > 1 {
+				buf.WriteByte(',')
+			}
+			keyBuf, _ := marshalValue(key)
+			buf.Write(keyBuf)
+			buf.WriteByte(':')
+			buf.Write(value)
+		}
+
+		for _, field := range fields {
+			item, ok := v[field.key]
+			if !ok || seen[field.key] {
+				changed = true
+				continue
+			}
+			seen[field.key] = true
+			itemBuf, err := encodeLike(field.value, item)
+			if err != nil {
+				return nil, err
+			}
+			changed = changed || !bytes.Equal(itemBuf, field.value)
+			writeField(field.key, itemBuf)
+		}
+
+		// New keys go at the end, sorted so the output is predictable
+		newKeys := []string{}
+		for key := range v {
+			if !seen[key] {
+				newKeys = append(newKeys, key)
+			}
+		}
+		sort.Strings(newKeys)
+		for _, key := range newKeys {
+			itemBuf, err := marshalValue(v[key])
+			if err != nil {
+				return nil, err
+			}
+			writeField(key, itemBuf)
+		}
+
+		if !changed {
+			return orig, nil
+		}
+		buf.WriteByte('}')
+		return buf.Bytes(), nil
+
+	case []interface{}:
+		if orig[0] != '[' {
+			break
+		}
+		items, err := splitArray(orig)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := &bytes.Buffer{}
+		buf.WriteByte('[')
+		changed := len(items) != len(v)
+		for i, item := range v {
+			var itemBuf []byte
+			if i < len(items) {
+				itemBuf, err = encodeLike(items[i], item)
+				changed = changed || !bytes.Equal(itemBuf, items[i])
+			} else {
+				itemBuf, err = marshalValue(item)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(itemBuf)
+		}
+
+		if !changed {
+			return orig, nil
+		}
+		buf.WriteByte(']')
+		return buf.Bytes(), nil
+
+	default:
+		if orig[0] == '{' || orig[0] == '[' {
+			break
+		}
+		var old interface{}
+		if err := decodeJSON(orig, &old); err == nil && equalValues(old, val) {
+			return orig, nil
+		}
+	}
+
+	return marshalValue(val)
+}
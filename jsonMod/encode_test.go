@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEncodeLike(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		change func(body map[string]interface{})
+		want   string
+	}{
+		{"unchanged", `{ "b" : 1, "a" : [ 1 , 2 ], "c" : { } }`,
+			func(body map[string]interface{}) {},
+			`{ "b" : 1, "a" : [ 1 , 2 ], "c" : { } }`},
+		{"key order", `{"b":1,"a":2,"c":3}`,
+			func(body map[string]interface{}) { body["a"] = 20 },
+			`{"b":1,"a":20,"c":3}`},
+		{"big ints", `{"Memory":12345678901234567890,"CpuShares":1}`,
+			func(body map[string]interface{}) { body["CpuShares"] = 2 },
+			`{"Memory":12345678901234567890,"CpuShares":2}`},
+		{"same number", `{"a":1.0,"b":1e2,"c":1}`,
+			func(body map[string]interface{}) { body["a"], body["b"] = 1, 100.0 },
+			`{"a":1.0,"b":1e2,"c":1}`},
+		{"deleted key", `{"a":1,"b":2,"c":3}`,
+			func(body map[string]interface{}) { delete(body, "b") },
+			`{"a":1,"c":3}`},
+		{"deleted last key", `{"a":1}`,
+			func(body map[string]interface{}) { delete(body, "a") },
+			`{}`},
+		{"added keys", `{"b":1}`,
+			func(body map[string]interface{}) { body["z"], body["a"] = "z", "a" },
+			`{"b":1,"a":"a","z":"z"}`},
+		{"nested", `{"x": {"keep": [1, 2]}, "HostConfig": {"b": 1, "a": 2}}`,
+			func(body map[string]interface{}) {
+				body["HostConfig"].(map[string]interface{})["b"] = true
+			},
+			`{"x":{"keep": [1, 2]},"HostConfig":{"b":true,"a":2}}`},
+		{"array item", `{"a":[1, {"x":1, "y":2}, 3]}`,
+			func(body map[string]interface{}) {
+				body["a"].([]interface{})[1].(map[string]interface{})["y"] = 20
+			},
+			`{"a":[1,{"x":1,"y":20},3]}`},
+		{"array append", `{"a":[1, 2]}`,
+			func(body map[string]interface{}) { body["a"] = append(body["a"].([]interface{}), 3) },
+			`{"a":[1,2,3]}`},
+		{"array shorter", `{"a":[1, 2, 3]}`,
+			func(body map[string]interface{}) { body["a"] = body["a"].([]interface{})[:1] },
+			`{"a":[1]}`},
+		{"new type", `{"a":{"b":1},"c":[1]}`,
+			func(body map[string]interface{}) { body["a"], body["c"] = "str", map[string]interface{}{} },
+			`{"a":"str","c":{}}`},
+		{"from null", `{"a":null}`,
+			func(body map[string]interface{}) { body["a"] = map[string]string{"x": "y"} },
+			`{"a":{"x":"y"}}`},
+		{"no html escaping", `{"a":"x"}`,
+			func(body map[string]interface{}) { body["a"] = "<&>" },
+			`{"a":"<&>"}`},
+		{"escaped keys", `{"a\u0062":1,"<\u003e":1}`,
+			func(body map[string]interface{}) { body["ab"] = 2 },
+			`{"ab":2,"<>":1}`},
+		{"escaped keys unchanged", `{"a\u0062":1,"<\u003e":1}`,
+			func(body map[string]interface{}) {},
+			`{"a\u0062":1,"<\u003e":1}`},
+	}
+	for _, test := range tests {
+		body := map[string]interface{}{}
+		if err := decodeJSON([]byte(test.in), &body); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		test.change(body)
+		buf, err := encodeLike([]byte(test.in), body)
+		if err != nil || string(buf) != test.want {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s %v", test.name, test.want, buf, err)
+		}
+	}
+
+	if buf, err := encodeLike(nil, map[string]interface{}{"a": 1}); err != nil ||
+		string(buf) != `{"a":1}` {
+		t.Errorf("empty orig: expected %s, got %s %v", `{"a":1}`, buf, err)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	body := map[string]interface{}{}
+	if err := decodeJSON([]byte(`{"a":12345678901234567890}`), &body); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := body["a"].(json.Number); !ok || n != "12345678901234567890" {
+		t.Errorf("expected a json.Number, got %T %v", body["a"], body["a"])
+	}
+
+	for _, in := range []string{`{"a":1} {"b":2}`, `{"a":1}x`, `{"a":1`, ``} {
+		if err := decodeJSON([]byte(in), &body); err == nil {
+			t.Errorf("%q: expected an error", in)
+		}
+	}
+	if err := decodeJSON([]byte(" {\"a\":1}\n "), &body); err != nil {
+		t.Errorf("trailing whitespace should be ok: %s", err)
+	}
+}
+
+func TestEqualValues(t *testing.T) {
+	tests := []struct {
+		a, b  interface{}
+		equal bool
+	}{
+		{json.Number("1"), 1, true},
+		{json.Number("1.0"), 1.0, true},
+		{json.Number("1e2"), json.Number("100"), true},
+		{json.Number("-0"), json.Number("0"), true},
+		{json.Number("12345678901234567890"), json.Number("12345678901234567891"), false},
+		{json.Number("1"), "1", false},
+		{"a", "a", true},
+		{nil, nil, true},
+		{nil, false, false},
+		{[]interface{}{json.Number("1")}, []interface{}{1}, true},
+		{[]interface{}{1}, []interface{}{1, 2}, false},
+		{map[string]interface{}{"a": json.Number("1")}, map[string]interface{}{"a": 1}, true},
+		{map[string]interface{}{"a": 1}, map[string]interface{}{"b": 1}, false},
+		{map[string]string{"a": "b"}, map[string]string{"a": "b"}, true},
+	}
+	for _, test := range tests {
+		if equal := equalValues(test.a, test.b); equal != test.equal {
+			t.Errorf("equalValues(%v, %v): expected %v, got %v", test.a, test.b, test.equal, equal)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+
+Expressions:
+
+A rule's "exprs" is a list of statements that are run against the body,
+in order, as a shorter way to write "ops":
+
+  set <path> = <value> [if <condition>]
+  default <path> = <value>              (same as "set ... if absent")
+  append <path> = <value> [if <condition>]
+  delete <path> [if <condition>]
+
+A <value> is one or more of these joined with "+" (which turns them all
+into one string):
+
+  "a string", 42, true, false, null
+  $.HostConfig.Memory     a value from the body
+  env.TEAM                an environment variable of jsonMod
+  header.X-Team           a header from the request
+  caller.uid              see "from" in rules.go
+
+A <condition> is "absent" or "present" (checking <path>), or two values
+compared with "==" or "!=". For example:
+
+  "exprs": [
+    "set Labels.team = env.TEAM if absent",
+    "set Labels[\"com.example.job\"] = \"ci-\" + header.X-Job-Id",
+    "append HostConfig.Binds = \"/cache:/cache:ro\"",
+    "delete HostConfig.CapAdd",
+    "set HostConfig.Privileged = false if $.Labels.trusted != \"yes\""
+  ]
+
+If a value refers to something that doesn't exist (e.g. the env var isn't
+set) then the statement is skipped.
+
+*/
+
+type exprTerm struct {
+	kind  string // "lit", "body", "env", "header" or "caller"
+	value interface{}
+	path  []pathElem
+	name  string
+}
+
+// A list of terms joined by "+"
+type exprValue []exprTerm
+
+type exprStmt struct {
+	text  string
+	op    string
+	path  []pathElem
+	value exprValue
+
+	cond        string // "", "absent", "present", "==" or "!="
+	left, right exprValue
+}
+
+// Split a statement into words, strings and operators. Paths with
+// brackets can have quoted strings (and so spaces) in them.
+func tokenize(text string) ([]string, error) {
+	tokens := []string{}
+	i := 0
+
+	for i < len(text) {
+		ch := text[i]
+		switch {
+		case ch == ' ' || ch == '\t':
+			i++
+
+		case ch == '"':
+			end := i + 1
+			for ; end < len(text) && text[end] != '"'; end++ {
+				if text[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(text) {
+				return nil, fmt.Errorf("Unterminated string")
+			}
+			tokens = append(tokens, text[i:end+1])
+			i = end + 1
+
+		case strings.HasPrefix(text[i:], "=="), strings.HasPrefix(text[i:], "!="):
+			tokens = append(tokens, text[i:i+2])
+			i += 2
+
+		case ch == '=' || ch == '+':
+			tokens = append(tokens, text[i:i+1])
+			i++
+
+		default:
+			start := i
+			var quote byte
+			depth := 0
+			for ; i < len(text); i++ {
+				ch = text[i]
+				if quote != 0 {
+					if ch == '\\' {
+						i++
+					} else if ch == quote {
+						quote = 0
+					}
+					continue
+				}
+				if depth > 0 && (ch == '"' || ch == '\'') {
+					quote = ch
+					continue
+				}
+				if ch == '[' {
+					depth++
+				} else if ch == ']' {
+					depth--
+				} else if depth == 0 && strings.IndexByte(" \t=!+", ch) >= 0 {
+					break
+				}
+			}
+			if quote != 0 || depth != 0 {
+				return nil, fmt.Errorf("Unterminated '['")
+			}
+			if i == start {
+				// e.g. a "!" that isn't part of "!="
+				return nil, fmt.Errorf("Unexpected '%c'", text[i])
+			}
+			tokens = append(tokens, text[start:i])
+		}
+	}
+	return tokens, nil
+}
+
+func parseTarget(tok string) ([]pathElem, error) {
+	path, err := parsePath(tok)
+	if err != nil {
+		return nil, err
+	}
+	if path[0].key == "$" && !path[0].isIndex {
+		path = path[1:]
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("Can't change the whole body")
+	}
+	return path, nil
+}
+
+func parseTerm(tok string) (exprTerm, error) {
+	switch tok {
+	case "true":
+		return exprTerm{kind: "lit", value: true}, nil
+	case "false":
+		return exprTerm{kind: "lit", value: false}, nil
+	case "null":
+		return exprTerm{kind: "lit", value: nil}, nil
+	}
+
+	if tok[0] == '"' {
+		str, err := strconv.Unquote(tok)
+		if err != nil {
+			return exprTerm{}, fmt.Errorf("Bad string %s", tok)
+		}
+		return exprTerm{kind: "lit", value: str}, nil
+	}
+
+	// Keep numbers as json.Number, like the body's, so big ints survive
+	if (tok[0] == '-' || (tok[0] >= '0' && tok[0] <= '9')) && json.Valid([]byte(tok)) {
+		return exprTerm{kind: "lit", value: json.Number(tok)}, nil
+	}
+
+	if isCallerValue(tok) {
+		return exprTerm{kind: "caller", name: tok}, nil
+	}
+
+	path, err := parsePath(tok)
+	if err != nil {
+		return exprTerm{}, err
+	}
+
+	switch {
+	case path[0].key == "$" && !path[0].isIndex && len(path) > 1:
+		return exprTerm{kind: "body", path: path[1:]}, nil
+	case len(path) == 2 && (path[0].key == "env" || path[0].key == "header"):
+		return exprTerm{kind: path[0].key, name: path[1].key}, nil
+	}
+	return exprTerm{}, fmt.Errorf("Unknown value %q", tok)
+}
+
+// Parse the terms in 'toks' up to (but not including) any of 'stops'
+func parseValue(toks []string, stops ...string) (exprValue, []string, error) {
+	value := exprValue{}
+	for {
+		if len(toks) == 0 {
+			return nil, nil, fmt.Errorf("Missing value")
+		}
+		term, err := parseTerm(toks[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		value = append(value, term)
+		toks = toks[1:]
+
+		if len(toks) == 0 || toks[0] != "+" {
+			break
+		}
+		toks = toks[1:]
+	}
+
+	if len(toks) > 0 {
+		found := false
+		for _, stop := range stops {
+			found = found || toks[0] == stop
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("Unexpected %q", toks[0])
+		}
+	}
+	return value, toks, nil
+}
+
+func compileExpr(text string) (exprStmt, error) {
+	stmt, err := parseExpr(text)
+	if err != nil {
+		return exprStmt{}, fmt.Errorf("Error in %q: %s", text, err)
+	}
+	return stmt, nil
+}
+
+func parseExpr(text string) (exprStmt, error) {
+	stmt := exprStmt{text: text}
+
+	toks, err := tokenize(text)
+	if err != nil {
+		return stmt, err
+	}
+	if len(toks) < 2 {
+		return stmt, fmt.Errorf("Incomplete statement")
+	}
+
+	if stmt.path, err = parseTarget(toks[1]); err != nil {
+		return stmt, err
+	}
+
+	stmt.op, toks = toks[0], toks[2:]
+	switch stmt.op {
+	case "set", "append", "default":
+		if len(toks) == 0 || toks[0] != "=" {
+			return stmt, fmt.Errorf("Missing \"=\"")
+		}
+		if stmt.value, toks, err = parseValue(toks[1:], "if"); err != nil {
+			return stmt, err
+		}
+		if stmt.op == "default" {
+			if len(toks) > 0 {
+				return stmt, fmt.Errorf("\"default\" can't have an \"if\"")
+			}
+			stmt.op, stmt.cond = "set", "absent"
+		}
+	case "delete":
+	default:
+		return stmt, fmt.Errorf("Unknown statement %q", stmt.op)
+	}
+
+	if len(toks) == 0 {
+		return stmt, nil
+	}
+	if toks[0] != "if" || len(toks) < 2 {
+		return stmt, fmt.Errorf("Expected an \"if\" condition")
+	}
+	toks = toks[1:]
+
+	if len(toks) == 1 && (toks[0] == "absent" || toks[0] == "present") {
+		stmt.cond = toks[0]
+		return stmt, nil
+	}
+
+	if stmt.left, toks, err = parseValue(toks, "==", "!="); err != nil {
+		return stmt, err
+	}
+	if len(toks) == 0 {
+		return stmt, fmt.Errorf("Expected \"==\" or \"!=\"")
+	}
+	stmt.cond = toks[0]
+	if stmt.right, _, err = parseValue(toks[1:]); err != nil {
+		return stmt, err
+	}
+	return stmt, nil
+}
+
+// The bool is false if the value doesn't exist
+func (t exprTerm) eval(c *call, body map[string]interface{}) (interface{}, bool) {
+	switch t.kind {
+	case "body":
+		return getPath(body, t.path)
+	case "env":
+		return os.LookupEnv(t.name)
+	case "header":
+		vals, ok := c.req.Header[http.CanonicalHeaderKey(t.name)]
+		if !ok || len(vals) == 0 {
+			return nil, false
+		}
+		return vals[0], true
+	case "caller":
+		val, err := callerValue(c, t.name)
+		return val, err == nil
+	}
+	return t.value, true
+}
+
+func (v exprValue) eval(c *call, body map[string]interface{}) (interface{}, bool) {
+	if len(v) == 1 {
+		return v[0].eval(c, body)
+	}
+
+	str := ""
+	for _, term := range v {
+		val, ok := term.eval(c, body)
+		if !ok {
+			return nil, false
+		}
+		if s, ok := val.(string); ok {
+			str += s
+		} else {
+			buf, _ := json.Marshal(val)
+			str += string(buf)
+		}
+	}
+	return str, true
+}
+
+func (stmt exprStmt) run(c *call, body map[string]interface{}) error {
+	switch stmt.cond {
+	case "absent", "present":
+		val, ok := getPath(body, stmt.path)
+		if (ok && val != nil) == (stmt.cond == "absent") {
+			return nil
+		}
+	case "==", "!=":
+		left, ok1 := stmt.left.eval(c, body)
+		right, ok2 := stmt.right.eval(c, body)
+		if (ok1 && ok2 && equalValues(left, right)) != (stmt.cond == "==") {
+			return nil
+		}
+	}
+
+	op := bodyOp{op: stmt.op, path: stmt.path}
+	if stmt.value != nil {
+		val, ok := stmt.value.eval(c, body)
+		if !ok {
+			log(3, "%d: Skipping %q, its value doesn't exist\n", c.id, stmt.text)
+			return nil
+		}
+		op.value = val
+	}
+
+	if err := applyOp(c, body, op); err != nil {
+		return err
+	}
+	log(3, "%d: Ran %q\n", c.id, stmt.text)
+	return nil
+}
+
+func exprTwiddler(stmts []exprStmt) tFunc {
+	return func(c *call, body map[string]interface{}) (map[string]interface{}, error) {
+		for _, stmt := range stmts {
+			if err := stmt.run(c, body); err != nil {
+				log(0, "%d: Error running %q: %s\n", c.id, stmt.text, err)
+			}
+		}
+		return body, nil
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text   string
+		tokens []string
+		err    string
+	}{
+		{`set a = 1`, []string{"set", "a", "=", "1"}, ""},
+		{`set a=1`, []string{"set", "a", "=", "1"}, ""},
+		{"set\ta = \"x y\" + b", []string{"set", "a", "=", `"x y"`, "+", "b"}, ""},
+		{`set Labels["a b=c"] = "\"q\""`,
+			[]string{"set", `Labels["a b=c"]`, "=", `"\"q\""`}, ""},
+		{`set a = 1 if $.b == 2`, []string{"set", "a", "=", "1", "if", "$.b", "==", "2"}, ""},
+		{`set a = 1 if $.b!=2`, []string{"set", "a", "=", "1", "if", "$.b", "!=", "2"}, ""},
+		{``, []string{}, ""},
+
+		{`set a = !b`, nil, "Unexpected '!'"},
+		{`set a = 1 if !`, nil, "Unexpected '!'"},
+		{`!`, nil, "Unexpected '!'"},
+		{`set a = "abc`, nil, "Unterminated string"},
+		{`set a = "abc\"`, nil, "Unterminated string"},
+		{`set a[ = 1`, nil, "Unterminated '['"},
+		{`set a["x] = 1`, nil, "Unterminated '['"},
+	}
+	for _, test := range tests {
+		tokens, err := tokenize(test.text)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("tokenize(%s): expected error %q, got %v %q", test.text, test.err,
+					err, tokens)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("tokenize(%s): expected %q, got %q %v", test.text, test.tokens,
+				tokens, err)
+		}
+	}
+}
+
+func TestParseExpr(t *testing.T) {
+	tests := []struct {
+		text string
+		err  string // "" means it should parse
+	}{
+		{`set a = 1`, ""},
+		{`set $.a.b = "x" + env.HOME + caller.uid`, ""},
+		{`default Labels.team = header.X-Team`, ""},
+		{`append HostConfig.Binds = "/a:/b"`, ""},
+		{`delete HostConfig.CapAdd`, ""},
+		{`delete HostConfig.CapAdd if present`, ""},
+		{`set a = 1 if absent`, ""},
+		{`set a = 1 if $.b == null`, ""},
+		{`set a = 1 if $.b + "x" != "yx"`, ""},
+		{`set a = -1.5e3`, ""},
+
+		{`set a = !b`, "Unexpected '!'"},
+		{`set`, "Incomplete statement"},
+		{`frob a = 1`, `Unknown statement "frob"`},
+		{`set $ = 1`, "Can't change the whole body"},
+		{`set a 1`, `Missing "="`},
+		{`set a =`, "Missing value"},
+		{`set a = 1 +`, "Missing value"},
+		{`set a = 1 2`, `Unexpected "2"`},
+		{`set a = b`, `Unknown value "b"`},
+		{`set a = env.A.B`, `Unknown value "env.A.B"`},
+		{`set a = "\q"`, `Bad string "\q"`},
+		{`set a = 1 when absent`, `Unexpected "when"`},
+		{`set a = 1 if`, `Expected an "if" condition`},
+		{`delete a = 1`, `Expected an "if" condition`},
+		{`default a = 1 if absent`, `"default" can't have an "if"`},
+		{`set a = 1 if $.b`, `Expected "==" or "!="`},
+		{`set a = 1 if $.b == `, "Missing value"},
+		{`set a = 1 if $.b == 1 2`, `Unexpected "2"`},
+		{`set a.. = 1`, "misplaced '.'"},
+	}
+	for _, test := range tests {
+		_, err := compileExpr(test.text)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.text, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error with %q, got %v", test.text, test.err, err)
+		}
+	}
+}
+
+func TestRunExprs(t *testing.T) {
+	exprs := []string{
+		`default Labels.team = header.X-Team`,
+		`set Labels.job = "ci-" + header.X-Job-Id`,
+		`set Labels.skipped = header.X-Missing`,
+		`set HostConfig.Privileged = false if $.Labels.trusted != "yes"`,
+		`append Env = "A=" + $.HostConfig.Memory`,
+		`delete HostConfig.CapAdd if present`,
+	}
+	stmts := []exprStmt{}
+	for _, text := range exprs {
+		stmt, err := compileExpr(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmts = append(stmts, stmt)
+	}
+
+	body := map[string]interface{}{}
+	in := `{"Labels":{"team":"red"},"Env":["X=1"],
+		"HostConfig":{"Privileged":true,"Memory":12345678901234567890,"CapAdd":["ALL"]}}`
+	if err := decodeJSON([]byte(in), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &call{req: &http.Request{Header: http.Header{
+		"X-Team":   {"blue"},
+		"X-Job-Id": {"42"},
+	}}}
+	body, err := exprTwiddler(stmts)(c, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := encodeLike([]byte(in), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"Labels":{"team":"red","job":"ci-42"},"Env":["X=1","A=12345678901234567890"],` +
+		`"HostConfig":{"Privileged":false,"Memory":12345678901234567890}}`
+	if string(buf) != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, buf)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/*
+
+External twiddlers:
+
+A rule's "external" hands the request off to another program, or to an
+HTTP webhook, so the rewrite logic can be written in any language:
+
+  "external": {
+    "exec": [ "/usr/local/bin/mutate", "--some-flag" ],
+    "timeout": "2s",
+    "failOpen": true
+  }
+
+  "external": {
+    "webhook": "http://localhost/mutate",
+    "socket": "/run/mutate.sock",     (optional, to talk to it via a unix socket)
+    "timeout": "2s"
+  }
+
+The program gets an externalRequest as JSON on stdin (or as the body of a
+POST) and must reply with an externalReply. If the reply has a "body" it
+replaces the request's body, and any "headers" in it replace those headers
+in the request (an empty list removes it). If "allowed" is false the request
+is rejected with "message".
+
+If the program fails (times out, exits non-zero, or sends back something we
+can't parse) then with "failOpen" the request is sent along as-is, otherwise
+it's rejected.
+
+*/
+
+type externalSpec struct {
+	Exec     []string `json:"exec"`
+	Webhook  string   `json:"webhook"`
+	Socket   string   `json:"socket"`
+	Timeout  string   `json:"timeout"`
+	FailOpen bool     `json:"failOpen"`
+}
+
+type externalRequest struct {
+	Method  string                 `json:"method"`
+	URL     string                 `json:"url"`
+	Path    string                 `json:"path"`
+	Version string                 `json:"version,omitempty"`
+	Params  map[string]string      `json:"params,omitempty"`
+	Headers http.Header            `json:"headers"`
+	Caller  *peerCred              `json:"caller,omitempty"`
+	Body    map[string]interface{} `json:"body"`
+}
+
+type externalReply struct {
+	Allowed *bool                  `json:"allowed"`
+	Message string                 `json:"message"`
+	Headers http.Header            `json:"headers"`
+	Body    map[string]interface{} `json:"body"`
+}
+
+var defaultExternalTimeout = 5 * time.Second
+
+// Sends the request's JSON to the program and returns its reply
+type sendFunc func(context.Context, []byte) ([]byte, error)
+
+func compileExternal(spec *externalSpec) (tFunc, error) {
+	if (len(spec.Exec) == 0) == (spec.Webhook == "") {
+		return nil, fmt.Errorf("\"external\" needs one of \"exec\" or \"webhook\"")
+	}
+
+	timeout := defaultExternalTimeout
+	if spec.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(spec.Timeout); err != nil {
+			return nil, fmt.Errorf("Bad \"timeout\": %s", err)
+		}
+	}
+
+	var send sendFunc
+	if len(spec.Exec) > 0 {
+		send = execSender(spec.Exec)
+	} else {
+		send = webhookSender(spec.Webhook, spec.Socket)
+	}
+
+	return func(c *call, body map[string]interface{}) (map[string]interface{}, error) {
+		newBody, err := callExternal(c, body, timeout, send)
+		if err == nil {
+			return newBody, nil
+		}
+		if _, ok := err.(*httpError); ok {
+			// It said no
+			return nil, err
+		}
+
+		log(0, "%d: Error calling external twiddler: %s\n", c.id, err)
+		if spec.FailOpen {
+			return body, nil
+		}
+		return nil, fmt.Errorf("External twiddler failed: %s", err)
+	}, nil
+}
+
+func callExternal(c *call, body map[string]interface{}, timeout time.Duration,
+	send sendFunc) (map[string]interface{}, error) {
+
+	buf, err := json.Marshal(externalRequest{
+		Method:  c.req.Method,
+		URL:     c.req.RequestURI,
+		Path:    c.path,
+		Version: c.version,
+		Params:  c.params,
+		Headers: c.req.Header,
+		Caller:  c.peer,
+		Body:    body,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	buf, err = send(ctx, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := externalReply{}
+	if err := decodeJSON(buf, &reply); err != nil {
+		return nil, fmt.Errorf("Error parsing reply: %s", err)
+	}
+
+	if reply.Allowed != nil && !*reply.Allowed {
+		if reply.Message == "" {
+			reply.Message = "Request denied by external twiddler"
+		}
+		return nil, denyf("%s", reply.Message)
+	}
+
+	for key, vals := range reply.Headers {
+		if len(vals) == 0 {
+			c.req.Header.Del(key)
+			continue
+		}
+		c.req.Header[http.CanonicalHeaderKey(key)] = vals
+	}
+
+	if reply.Body != nil {
+		return reply.Body, nil
+	}
+	return body, nil
+}
+
+func execSender(cmdLine []string) sendFunc {
+	return func(ctx context.Context, in []byte) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, cmdLine[0], cmdLine[1:]...)
+		cmd.Stdin = bytes.NewReader(in)
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		// Anything it started could keep stdout open after it's killed
+		cmd.WaitDelay = 100 * time.Millisecond
+
+		out, err := cmd.Output()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%q timed out", cmdLine[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%q failed: %s: %s", cmdLine[0], err,
+				strings.TrimSpace(stderr.String()))
+		}
+		return out, nil
+	}
+}
+
+func webhookSender(url string, socket string) sendFunc {
+	client := &http.Client{}
+	if socket != "" {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}
+	}
+
+	return func(ctx context.Context, in []byte) ([]byte, error) {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(in))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		out, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode/100 != 2 {
+			return nil, fmt.Errorf("%q returned %s", url, resp.Status)
+		}
+		return out, nil
+	}
+}
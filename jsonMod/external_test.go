@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runExternal(t *testing.T, spec externalSpec, body string) (*call, string, error) {
+	t.Helper()
+	fn, err := compileExternal(&spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "/v1.41/containers/create?name=x", nil)
+	req.RequestURI = "/v1.41/containers/create?name=x"
+	req.Header.Set("X-Keep", "1")
+	req.Header.Set("X-Drop", "1")
+	c := &call{req: req}
+	c.version, c.path = splitVersion(req.URL.Path)
+
+	obj := map[string]interface{}{}
+	decodeJSON([]byte(body), &obj)
+	newBody, err := fn(c, obj)
+	buf, _ := json.Marshal(newBody)
+	return c, string(buf), err
+}
+
+func TestCompileExternal(t *testing.T) {
+	for _, spec := range []externalSpec{
+		{},
+		{Exec: []string{"true"}, Webhook: "http://x"},
+		{Exec: []string{"true"}, Timeout: "soon"},
+	} {
+		if _, err := compileExternal(&spec); err == nil {
+			t.Errorf("%+v: expected an error", spec)
+		}
+	}
+}
+
+func TestExternalWebhook(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "hook.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		in := externalRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		switch in.Body["Image"] {
+		case "rewrite":
+			if in.Method != "POST" || in.Path != "/containers/create" || in.Version != "1.41" ||
+				in.URL != "/v1.41/containers/create?name=x" || in.Headers.Get("X-Keep") != "1" {
+				http.Error(w, "bad request", 400)
+				return
+			}
+			w.Write([]byte(`{"headers":{"X-Drop":[],"X-New":["2"]},"body":{"Image":"new"}}`))
+		case "same":
+			w.Write([]byte(`{}`))
+		case "deny":
+			w.Write([]byte(`{"allowed":false,"message":"Nope"}`))
+		case "garbage":
+			w.Write([]byte(`{"body":`))
+		case "slow":
+			time.Sleep(time.Second)
+			w.Write([]byte(`{}`))
+		default:
+			http.Error(w, "oops", 500)
+		}
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	spec := externalSpec{Webhook: "http://hook/mutate", Socket: sock, Timeout: "200ms"}
+
+	c, body, err := runExternal(t, spec, `{"Image":"rewrite"}`)
+	if err != nil || body != `{"Image":"new"}` {
+		t.Errorf("Expected the new body, got %s %v", body, err)
+	}
+	if h := c.req.Header; h.Get("X-Keep") != "1" || h.Get("X-Drop") != "" || h.Get("X-New") != "2" {
+		t.Errorf("Expected the headers to be changed, got %v", h)
+	}
+
+	if _, body, err = runExternal(t, spec, `{"Image":"same","a":1}`); err != nil ||
+		body != `{"Image":"same","a":1}` {
+		t.Errorf("Expected the same body, got %s %v", body, err)
+	}
+
+	_, _, err = runExternal(t, spec, `{"Image":"deny"}`)
+	if he, ok := err.(*httpError); !ok || he.code != http.StatusForbidden || he.msg != "Nope" {
+		t.Errorf("Expected a 403, got %v", err)
+	}
+
+	// Failures are rejected, unless it's told to fail open
+	for _, image := range []string{"garbage", "slow", "error"} {
+		body := `{"Image":"` + image + `"}`
+		if _, _, err := runExternal(t, spec, body); err == nil ||
+			!strings.HasPrefix(err.Error(), "External twiddler failed") {
+			t.Errorf("%s: expected it to fail, got %v", image, err)
+		}
+
+		open := spec
+		open.FailOpen = true
+		if _, newBody, err := runExternal(t, open, body); err != nil || newBody != body {
+			t.Errorf("%s: expected it to be let thru, got %s %v", image, newBody, err)
+		}
+	}
+}
+
+func TestExternalExec(t *testing.T) {
+	tests := []struct {
+		script string
+		body   string // "" means it fails
+	}{
+		{`cat >/dev/null; echo '{"body":{"b":2}}'`, `{"b":2}`},
+		{`grep -q '"path":"/containers/create"' && echo '{}'`, `{"a":1}`},
+		{`cat >/dev/null; echo oops >&2; exit 1`, ""},
+		{`sleep 5`, ""},
+	}
+	for _, test := range tests {
+		spec := externalSpec{Exec: []string{"sh", "-c", test.script}, Timeout: "500ms"}
+		_, body, err := runExternal(t, spec, `{"a":1}`)
+		if test.body == "" {
+			if err == nil {
+				t.Errorf("%s: expected it to fail, got %s", test.script, body)
+			}
+			continue
+		}
+		var got, want interface{}
+		json.Unmarshal([]byte(body), &got)
+		json.Unmarshal([]byte(test.body), &want)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %s, got %s %v", test.script, test.body, body, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+)
+
+// Image name patterns are globs where "*" matches anything (including
+// "/"), e.g. "docker.io/library/*" or "*:latest". A pattern is checked
+// against the image name as it was written and its full form (see
+// normalizeImage), so "ubuntu:*" and "docker.io/library/ubuntu:*" both
+// match "ubuntu:22.04".
+
+func matchGlob(pattern, str string) bool {
+	_, ok := globCaptures(pattern, str)
+	return ok
+}
+
+// If 'str' matches 'pattern' then return what each "*" matched
+func globCaptures(pattern, str string) ([]string, bool) {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return nil, pattern == str
+	}
+
+	if !strings.HasPrefix(str, parts[0]) {
+		return nil, false
+	}
+	str = str[len(parts[0]):]
+
+	captures := []string{}
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(str, part)
+		if i < 0 {
+			return nil, false
+		}
+		captures = append(captures, str[:i])
+		str = str[i+len(part):]
+	}
+
+	last := parts[len(parts)-1]
+	if !strings.HasSuffix(str, last) {
+		return nil, false
+	}
+	return append(captures, str[:len(str)-len(last)]), true
+}
+
+// The name the way the daemon sees it: "ubuntu" and "index.docker.io/ubuntu"
+// -> "docker.io/library/ubuntu", "example.com:5000/app:1.0" ->
+// "example.com:5000/app:1.0". The registry is lower cased since it's a host
+// name.
+func fullImageName(name string) string {
+	registry, rest := "docker.io", name
+	if slash := strings.IndexByte(name, '/'); slash >= 0 {
+		host := name[:slash]
+		if strings.ContainsAny(host, ".:") || host == "localhost" || strings.ToLower(host) != host {
+			registry, rest = strings.ToLower(host), name[slash+1:]
+		}
+	}
+	if registry == "index.docker.io" {
+		registry = "docker.io"
+	}
+	if registry == "docker.io" && !strings.Contains(rest, "/") {
+		rest = "library/" + rest
+	}
+	return registry + "/" + rest
+}
+
+// "ubuntu" -> "docker.io/library/ubuntu:latest",
+// "example.com:5000/app" -> "example.com:5000/app:latest"
+func normalizeImage(name string) string {
+	name = fullImageName(name)
+	if _, tag, digest := splitImage(name); tag == "" && digest == "" {
+		name += ":latest"
+	}
+	return name
+}
+
+// "example.com:5000/app:1.0@sha256:abc" -> "example.com:5000/app", "1.0", "sha256:abc"
+func splitImage(name string) (repo, tag, digest string) {
+	if i := strings.IndexByte(name, '@'); i >= 0 {
+		name, digest = name[:i], name[i+1:]
+	}
+	if i := strings.LastIndexByte(name, ':'); i > strings.LastIndexByte(name, '/') {
+		name, tag = name[:i], name[i+1:]
+	}
+	return name, tag, digest
+}
+
+// The registry the image comes from, e.g. "docker.io"
+func imageRegistry(name string) string {
+	name = fullImageName(name)
+	return name[:strings.IndexByte(name, '/')]
+}
+
+func matchImage(patterns []string, image string) bool {
+	full := normalizeImage(image)
+	for _, pattern := range patterns {
+		if matchGlob(pattern, image) || matchGlob(pattern, full) {
+			return true
+		}
+	}
+	return false
+}
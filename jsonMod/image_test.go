@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFullImageName(t *testing.T) {
+	tests := []struct {
+		name string
+		full string
+	}{
+		{"ubuntu", "docker.io/library/ubuntu"},
+		{"ubuntu:22.04", "docker.io/library/ubuntu:22.04"},
+		{"ubuntu@sha256:abc", "docker.io/library/ubuntu@sha256:abc"},
+		{"me/app", "docker.io/me/app"},
+		{"docker.io/ubuntu", "docker.io/library/ubuntu"},
+		{"docker.io/library/ubuntu", "docker.io/library/ubuntu"},
+		{"docker.io/me/app:1", "docker.io/me/app:1"},
+		{"index.docker.io/ubuntu", "docker.io/library/ubuntu"},
+		{"index.docker.io/me/app", "docker.io/me/app"},
+		{"Docker.IO/evil/app", "docker.io/evil/app"},
+		{"localhost/app", "localhost/app"},
+		{"localhost:5000/app", "localhost:5000/app"},
+		{"example.com:5000/app:1.0", "example.com:5000/app:1.0"},
+		{"Example.com/a/b/c", "example.com/a/b/c"},
+		{"Me/app", "me/app"},
+	}
+	for _, test := range tests {
+		if full := fullImageName(test.name); full != test.full {
+			t.Errorf("fullImageName(%q): expected %q, got %q", test.name, test.full, full)
+		}
+	}
+}
+
+func TestNormalizeImage(t *testing.T) {
+	tests := []struct {
+		name string
+		norm string
+	}{
+		{"ubuntu", "docker.io/library/ubuntu:latest"},
+		{"docker.io/ubuntu:22.04", "docker.io/library/ubuntu:22.04"},
+		{"index.docker.io/library/ubuntu", "docker.io/library/ubuntu:latest"},
+		{"ubuntu@sha256:abc", "docker.io/library/ubuntu@sha256:abc"},
+		{"localhost:5000/app", "localhost:5000/app:latest"},
+	}
+	for _, test := range tests {
+		if norm := normalizeImage(test.name); norm != test.norm {
+			t.Errorf("normalizeImage(%q): expected %q, got %q", test.name, test.norm, norm)
+		}
+	}
+}
+
+func TestMatchImage(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		image    string
+		match    bool
+	}{
+		{[]string{"docker.io/library/*"}, "ubuntu", true},
+		{[]string{"docker.io/library/*"}, "docker.io/ubuntu", true},
+		{[]string{"docker.io/library/*"}, "index.docker.io/ubuntu:22.04", true},
+		{[]string{"docker.io/library/*"}, "me/app", false},
+		{[]string{"docker.io/evil/*"}, "index.docker.io/evil/app", true},
+		{[]string{"docker.io/evil/*"}, "DOCKER.IO/evil/app", true},
+		{[]string{"*:latest"}, "ubuntu", true},
+		{[]string{"*:latest"}, "ubuntu:22.04", false},
+		{[]string{"ubuntu:*"}, "ubuntu:22.04", true},
+		{[]string{"registry.example.com/*"}, "registry.example.com/app", true},
+		{[]string{"registry.example.com/*"}, "registry.example.com.evil.io/app", false},
+		{[]string{"a", "b/*"}, "b/c", true},
+		{nil, "ubuntu", false},
+	}
+	for _, test := range tests {
+		if match := matchImage(test.patterns, test.image); match != test.match {
+			t.Errorf("matchImage(%q, %q): expected %v, got %v", test.patterns, test.image,
+				test.match, match)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/*
+
+Injecting metadata:
+
+A "POST /containers/create" rule can stamp labels, environment variables
+and annotations (HostConfig.Annotations) on each new container. The values
+are Go templates (text/template):
+
+  { "verb": "POST", "url": "/containers/create",
+    "inject": {
+      "labels": {
+        "com.example.owner": "{{.User}}",
+        "com.example.cost-center": "{{or (.Headers.Get \"X-Cost-Center\") \"none\"}}",
+        "com.example.created": "{{.Timestamp}}"
+      },
+      "env": { "CREATED_ON": "{{.Hostname}}" },
+      "annotations": { "com.example.image": "{{.Image}}" }
+    }
+  }
+
+The templates can use:
+  .UID .GID .PID .User  - the caller, "" if not on a unix socket
+  .Remote               - the client's address, if not on a unix socket
+  .Hostname             - the name of the host jsonMod is running on
+  .Timestamp            - the current time (UTC, RFC 3339)
+  .Time                 - the same as a time.Time, e.g. {{.Time.Format "2006-01-02"}}
+  .Image                - the "Image" in the request
+  .Name                 - the "name" query parameter
+  .Headers              - the request's headers (an http.Header)
+
+Values the client already set are replaced, unless "keepExisting" is true.
+If a template fails the request is rejected.
+
+*/
+
+type injectSpec struct {
+	Labels       map[string]string `json:"labels"`
+	Env          map[string]string `json:"env"`
+	Annotations  map[string]string `json:"annotations"`
+	KeepExisting bool              `json:"keepExisting"`
+}
+
+type injectTemplate struct {
+	key  string
+	tmpl *template.Template
+}
+
+type injector struct {
+	labels       []injectTemplate
+	env          []injectTemplate
+	annotations  []injectTemplate
+	keepExisting bool
+}
+
+// What the templates can use
+type injectVars struct {
+	UID, GID, PID string
+	User          string
+	Remote        string
+	Hostname      string
+	Timestamp     string
+	Time          time.Time
+	Image         string
+	Name          string
+	Headers       http.Header
+}
+
+var hostname, _ = os.Hostname()
+
+func compileTemplates(what string, specs map[string]string) ([]injectTemplate, error) {
+	keys := []string{}
+	for key := range specs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	list := []injectTemplate{}
+	for _, key := range keys {
+		tmpl, err := template.New(what + " " + key).Option("missingkey=error").
+			Parse(specs[key])
+		if err == nil {
+			// Catch things like misspelled fields now rather than on each request
+			err = tmpl.Execute(ioutil.Discard, &injectVars{Headers: http.Header{}})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bad template for %s %q: %s", what, key, err)
+		}
+		list = append(list, injectTemplate{key, tmpl})
+	}
+	return list, nil
+}
+
+func compileInject(spec *injectSpec) (tFunc, error) {
+	inj := &injector{keepExisting: spec.KeepExisting}
+	var err error
+	if inj.labels, err = compileTemplates("label", spec.Labels); err != nil {
+		return nil, err
+	}
+	if inj.env, err = compileTemplates("env", spec.Env); err != nil {
+		return nil, err
+	}
+	if inj.annotations, err = compileTemplates("annotation", spec.Annotations); err != nil {
+		return nil, err
+	}
+	if len(inj.labels)+len(inj.env)+len(inj.annotations) == 0 {
+		return nil, fmt.Errorf("\"inject\" needs some \"labels\", \"env\" or \"annotations\"")
+	}
+	return createTwiddler(inj.inject), nil
+}
+
+func newInjectVars(c *call, req *ContainerCreateRequest) *injectVars {
+	now := time.Now().UTC()
+	vars := &injectVars{
+		Remote:    c.remote,
+		Hostname:  hostname,
+		Timestamp: now.Format(time.RFC3339),
+		Time:      now,
+		Image:     req.Image,
+		Name:      c.req.URL.Query().Get("name"),
+		Headers:   c.req.Header,
+	}
+	if c.peer != nil {
+		vars.UID = strconv.Itoa(c.peer.UID)
+		vars.GID = strconv.Itoa(c.peer.GID)
+		vars.PID = strconv.Itoa(c.peer.PID)
+		vars.User = c.peer.User
+		if vars.User == "" {
+			vars.User = vars.UID
+		}
+	}
+	return vars
+}
+
+// Fill in each of the templates, in order
+func fillTemplates(list []injectTemplate, vars *injectVars, fn func(key, val string)) error {
+	for _, it := range list {
+		buf := &bytes.Buffer{}
+		if err := it.tmpl.Execute(buf, vars); err != nil {
+			return &httpError{http.StatusInternalServerError,
+				fmt.Sprintf("Error filling in %s: %s", it.tmpl.Name(), err)}
+		}
+		fn(it.key, buf.String())
+	}
+	return nil
+}
+
+func (inj *injector) inject(c *call, req *ContainerCreateRequest) error {
+	vars := newInjectVars(c, req)
+
+	err := fillTemplates(inj.labels, vars, func(key, val string) {
+		if req.Labels == nil {
+			req.Labels = map[string]string{}
+		}
+		if _, ok := req.Labels[key]; ok && inj.keepExisting {
+			return
+		}
+		log(3, "%d: Setting label %q to %q\n", c.id, key, val)
+		req.Labels[key] = val
+	})
+	if err != nil {
+		return err
+	}
+
+	err = fillTemplates(inj.env, vars, func(key, val string) {
+		for i, env := range req.Env {
+			if env == key || strings.HasPrefix(env, key+"=") {
+				if !inj.keepExisting {
+					log(3, "%d: Setting env %q to %q\n", c.id, key, val)
+					req.Env[i] = key + "=" + val
+				}
+				return
+			}
+		}
+		log(3, "%d: Setting env %q to %q\n", c.id, key, val)
+		req.Env = append(req.Env, key+"="+val)
+	})
+	if err != nil {
+		return err
+	}
+
+	return fillTemplates(inj.annotations, vars, func(key, val string) {
+		if req.HostConfig == nil {
+			req.HostConfig = &HostConfig{}
+		}
+		if req.HostConfig.Annotations == nil {
+			req.HostConfig.Annotations = map[string]string{}
+		}
+		if _, ok := req.HostConfig.Annotations[key]; ok && inj.keepExisting {
+			return
+		}
+		log(3, "%d: Setting annotation %q to %q\n", c.id, key, val)
+		req.HostConfig.Annotations[key] = val
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompileInject(t *testing.T) {
+	for _, spec := range []injectSpec{
+		{},
+		{Labels: map[string]string{"a": "{{.User"}},
+		{Labels: map[string]string{"a": "{{.Usr}}"}},
+		{Env: map[string]string{"A": "{{.Headers.Nope}}"}},
+		{Annotations: map[string]string{"a": "{{nope}}"}},
+	} {
+		if _, err := compileInject(&spec); err == nil {
+			t.Errorf("%+v: expected an error", spec)
+		}
+	}
+}
+
+func TestInject(t *testing.T) {
+	spec := injectSpec{
+		Labels: map[string]string{
+			"owner": "{{.User}}",
+			"cost":  `{{or (.Headers.Get "X-Cost-Center") "none"}}`,
+			"name":  "{{.Name}}/{{.Image}}",
+		},
+		Env:         map[string]string{"OWNER": "{{.UID}}:{{.GID}}", "HOST": "{{.Hostname}}"},
+		Annotations: map[string]string{"created": `{{.Time.Format "2006"}}`},
+	}
+
+	tests := []struct {
+		keep bool
+		body string
+		want string
+	}{
+		{false, `{"Image":"alpine"}`,
+			`{"Image":"alpine","Env":["HOST=h","OWNER=1000:100"],` +
+				`"Labels":{"cost":"blue","name":"web/alpine","owner":"me"},` +
+				`"HostConfig":{"Annotations":{"created":"Y"}}}`},
+		{false, `{"Image":"alpine","Labels":{"owner":"root"},"Env":["OWNER=0","PATH=/bin"],` +
+			`"HostConfig":{"Annotations":{"created":"never"}}}`,
+			`{"Image":"alpine","Labels":{"owner":"me","cost":"blue","name":"web/alpine"},` +
+				`"Env":["OWNER=1000:100","PATH=/bin","HOST=h"],` +
+				`"HostConfig":{"Annotations":{"created":"Y"}}}`},
+		{true, `{"Image":"alpine","Labels":{"owner":"root"},"Env":["OWNER"],` +
+			`"HostConfig":{"Annotations":{"created":"never"}}}`,
+			`{"Image":"alpine","Labels":{"owner":"root","cost":"blue","name":"web/alpine"},` +
+				`"Env":["OWNER","HOST=h"],"HostConfig":{"Annotations":{"created":"never"}}}`},
+	}
+
+	defer func(name string) { hostname = name }(hostname)
+	hostname = "h"
+
+	for _, test := range tests {
+		spec.KeepExisting = test.keep
+		fn, err := compileInject(&spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ := http.NewRequest("POST", "/containers/create?name=web", nil)
+		req.Header.Set("X-Cost-Center", "blue")
+		c := &call{req: req, peer: &peerCred{UID: 1000, GID: 100, User: "me"}}
+
+		body := map[string]interface{}{}
+		if err := decodeJSON([]byte(test.body), &body); err != nil {
+			t.Fatal(err)
+		}
+		newBody, err := fn(c, body)
+		if err != nil {
+			t.Errorf("%s: %s", test.body, err)
+			continue
+		}
+		buf, _ := encodeLike([]byte(test.body), newBody)
+
+		// The year changes, so just check it's one
+		got := string(buf)
+		if i := strings.Index(got, `"created":"2`); i >= 0 {
+			got = got[:i] + `"created":"Y"` + got[i+len(`"created":"2025"`):]
+		}
+		var gotV, wantV interface{}
+		json.Unmarshal([]byte(got), &gotV)
+		json.Unmarshal([]byte(test.want), &wantV)
+		if !reflect.DeepEqual(gotV, wantV) {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", test.body, test.want, got)
+		}
+	}
+}
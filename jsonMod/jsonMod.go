@@ -4,76 +4,99 @@ package main
 
 jsonMod:
 
-This program acts as a proxy in-front of a unix-socket and allows for
-you to modify the incoming JSON.
+This program acts as a proxy in-front of a unix-socket (or a TCP/TLS port)
+and allows for you to modify the incoming JSON, and the JSON that comes back.
 
-Add your twiddler func to the mapping struct.
+Add your twiddler func to the mapping struct (a "POST /containers/create"
+one can use a typed body, see create.go), or describe the mappings in a
+rule file and use "-rules" (see rules.go).
 
 */
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var inSock = "/var/run/incoming.sock"
 var outSock = "/var/run/docker.sock"
+var rulesFile = ""
+var watchInterval = 2 * time.Second
+var metricsAddr = ""
+var maxBodySize int64 = 16 << 20
 var verbose = 0
 var packetSize = 4096
 
+// Where level 0 logs go, "-audit -" moves them to stderr so stdout is just
+// the audit records
+var logOut io.Writer = os.Stdout
+
 func log(v int, format string, args ...interface{}) {
 	if verbose < v {
 		return
 	}
 	if v == 0 {
-		fmt.Fprintf(os.Stdout, format, args...)
+		fmt.Fprintf(logOut, format, args...)
 	} else {
 		fmt.Fprintf(os.Stderr, format, args...)
 	}
 }
 
-// Just copy from one connection to the other
-func copyConn(id int, src, tgt *net.UnixConn) {
+// Just copy from one connection to the other. Reads come from the readers
+// since they might already have some data buffered in them.
+func copyConn(id int, src, tgt net.Conn, srcReader, tgtReader io.Reader) {
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 
 	go func() {
 		buf := make([]byte, packetSize)
+		total := 0
 		for {
-			n, err := src.Read(buf)
+			n, err := srcReader.Read(buf)
 			if err != nil {
 				break
 			}
 			writeN, err := tgt.Write(buf[:n])
+			total += writeN
 			if err != nil || writeN != n {
 				break
 			}
 		}
-		src.CloseRead()
-		tgt.CloseWrite()
+		metrics.copiedBytes.observe(float64(total), "in")
+		closeRead(src)
+		closeWrite(tgt)
 		wg.Done()
 	}()
 	go func() {
 		buf := make([]byte, packetSize)
+		total := 0
 		for {
-			n, err := tgt.Read(buf)
+			n, err := tgtReader.Read(buf)
 			if err != nil {
 				break
 			}
 			writeN, err := src.Write(buf[:n])
+			total += writeN
 			if err != nil || writeN != n {
 				break
 			}
 		}
-		tgt.CloseRead()
-		src.CloseWrite()
+		metrics.copiedBytes.observe(float64(total), "out")
+		closeRead(tgt)
+		closeWrite(src)
 		wg.Done()
 	}()
 
@@ -81,213 +104,700 @@ func copyConn(id int, src, tgt *net.UnixConn) {
 	wg.Wait()
 }
 
-// read in one line, ended by \n. If we hit maxBuffer then something is wrong
-func readLine(in *net.UnixConn) ([]byte, error) {
-	ch := make([]byte, 1)
-	maxBuffer := 10000
-	line := new(bytes.Buffer)
-
-	i := 0
-	for ; i < maxBuffer; i++ {
-		count, err := in.Read(ch)
-		if err != nil || count == 0 {
-			if count == 0 || err == io.EOF {
-				break
-			}
-			return nil, err
+// Info about the request being processed, passed to the twiddlers. Any
+// changes to req.Header are sent along to the daemon.
+type call struct {
+	id     int
+	req    *http.Request
+	peer   *peerCred            // nil if not a unix socket
+	remote string               // the client's address, if not unix
+	tls    *tls.ConnectionState // nil if not TLS
+
+	version string            // API version from the URL, "" if none
+	path    string            // URL path without the version prefix
+	params  map[string]string // values of the {name} parts of the url
+
+	diff []diffEntry // what the twiddler changed, if we're auditing
+	rec  *recording  // copies of the bodies, if we're recording
+
+	shadow    bool      // a shadow mapping is looking at a copy of the request
+	shadowErr error     // why a shadow mapping would have rejected the request
+	upstream  *upstream // where the request is sent, nil means "-out"
+	release   func()    // frees up the request's "maxConcurrent" spot
+}
+
+// A twiddler can reject the request by returning an error. An httpError
+// lets it pick the status code, anything else is a 500.
+type tFunc func(*call, map[string]interface{}) (map[string]interface{}, error)
+
+// Run the request thru the mapping, an error means it should be rejected
+func checkRequest(c *call, m *mapping) error {
+	if m.isShadow() {
+		return shadowRequest(c, m)
+	}
+	return enforceRequest(c, m)
+}
+
+func enforceRequest(c *call, m *mapping) error {
+	if m.isDeny() {
+		if m.deny == "" {
+			return &httpError{http.StatusForbidden, "Request denied by jsonMod"}
 		}
-		line.Write(ch)
-		if ch[0] == '\n' {
-			break
+		return &httpError{http.StatusForbidden, m.deny}
+	}
+	if err := checkLimits(c, m); err != nil {
+		return err
+	}
+	if m.pullImages != nil {
+		if err := rewritePull(c, m.pullImages); err != nil {
+			return err
 		}
 	}
-	if i == maxBuffer {
-		return nil, fmt.Errorf("Buffer overflow read header")
+	c.upstream = m.upstream
+	if m.fn != nil || len(m.policies) > 0 || m.build != nil || m.buildImages != nil {
+		return parseRequest(c, m)
 	}
-
-	return line.Bytes(), nil
+	return nil
 }
 
-type tFunc func(int, [][]byte, map[string]interface{}) ([][]byte, map[string]interface{})
+// Read in the request's JSON body, run it thru the mapping's policies and
+// twiddler, and then set it up as the new body of the request
+func parseRequest(c *call, m *mapping) error {
+	req := c.req
 
-func parseRequest(id int, in *net.UnixConn, firstLine []byte, twiddler tFunc) {
-	log(1, "%d: Modifying the request\n", id)
-
-	headers := [][]byte{}
-	var ctHeader []byte
-	var line []byte
-	var err error
+	contentType := req.Header.Get("Content-Type")
+	if !matchContentType(m, contentType) {
+		log(3, "%d: Body is %q, passing it thru\n", c.id, contentType)
+		return nil
+	}
 
-	if twiddler != nil {
-		for {
-			line, err = readLine(in)
-			if err != nil || len(line) == 0 {
-				// No input or an error stops us - something is wrong.
-				return
-			}
+	if m.buildImages != nil {
+		if err := rewriteBuild(c, m.buildImages); err != nil {
+			return err
+		}
+		if m.build == nil {
+			return nil
+		}
+	}
+	if m.build != nil {
+		return checkBuild(c, m.build)
+	}
 
-			// Remove any Content-Length header
-			if i := strings.IndexRune(string(line), ':'); i >= 1 {
-				header := string(line[:i])
-				if strings.EqualFold(header, "Content-Length") {
-					ctHeader = line
-					continue
-				}
-			}
+	if req.ContentLength == 0 {
+		log(3, "%d: No body to modify\n", c.id)
+		return nil
+	}
 
-			// Until we hit a blank line (the body), buffer it then loop
-			if string(line) != "\r\n" {
-				headers = append(headers, line)
-				continue
-			}
+	// Note: this also takes care of any chunked encoding
+	buf, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodySize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(buf)) > maxBodySize {
+		return &httpError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Body is too large to check (over %d bytes)", maxBodySize)}
+	}
+	if len(buf) == 0 {
+		// Empty chunked bodies end up here
+		log(3, "%d: No body to modify\n", c.id)
+		setRequestBody(req, buf)
+		return nil
+	}
 
-			// We hit the body, so read it in as JSON
-			dec := json.NewDecoder(in)
-			body := map[string]interface{}{}
-			if err := dec.Decode(&body); err != nil {
-				log(0, "%d: Error reading body: %#v\n", id, err)
-				in.Write([]byte(fmt.Sprintf("Error parsing body: %s\n", err)))
-				return
-			}
+	body := map[string]interface{}{}
+	if err := decodeJSON(buf, &body); err != nil {
+		metrics.parseErrors.inc("request_body")
+		return &httpError{http.StatusBadRequest,
+			fmt.Sprintf("Error parsing body: %s", err)}
+	}
 
-			headers, body = twiddler(id, headers, body)
+	for _, policy := range m.policies {
+		if err := policy(c, body); err != nil {
+			return err
+		}
+	}
 
-			// Now generate the new Body (note: it may not have changed)
-			line, err = json.Marshal(body)
-			if err != nil {
-				log(0, "%d: Error encoding new body: %s\n%s\n", err, body)
-			}
+	// Nothing to change so send along the original bytes
+	if m.fn == nil {
+		setRequestBody(req, buf)
+		return nil
+	}
 
-			ctHeader = []byte(fmt.Sprintf("Content-Length: %d\r\n", len(line)))
+	var orig interface{}
+	if auditLog != nil || m.isShadow() {
+		orig = copyValue(body)
+	}
 
-			log(5, "%d: Len:%s\nBody: %s\n", id, ctHeader, string(line))
+	log(1, "%d: Modifying the request\n", c.id)
+	if body, err = m.fn(c, body); err != nil {
+		return err
+	}
+	metrics.rewrites.inc(m.name())
 
-			break
-		}
+	if auditLog != nil || m.isShadow() {
+		c.diff = diffValues(orig, body)
 	}
 
-	// Open the connection to outSocket
-	out, err := net.DialUnix("unix", nil, &net.UnixAddr{outSock, "unix"})
+	// Now generate the new Body (note: it may not have changed). Whatever
+	// wasn't touched is copied from the original bytes, see encode.go.
+	buf, err = encodeLike(buf, body)
 	if err != nil {
-		log(0, "%d: Error connecting to out socket: %v\n", id, err)
-		return
+		log(0, "%d: Error encoding new body: %s\n%s\n", c.id, err, body)
 	}
-	defer log(1, "%d: Outgoing connection closed\n", id)
-	defer out.Close()
 
-	// Match or not, write the first line
-	out.Write(firstLine)
+	if !m.skipValidate {
+		if err := validateBody(c, buf); err != nil {
+			log(0, "%d: %s\n", c.id, err)
+			return err
+		}
+	}
+
+	setRequestBody(req, buf)
+
+	log(5, "%d: Len:%d Chunked:%v\nBody: %s\n", c.id, len(buf),
+		req.ContentLength < 0, string(buf))
+	return nil
+}
+
+// Find the first mapping that matches the request, if any
+func findMapping(rules []mapping, c *call) *mapping {
+	query := c.req.URL.Query()
 
-	if twiddler != nil {
-		// All done, pass new header and body to docker
-		for _, header := range headers {
-			out.Write(header)
+	for i, mapping := range rules {
+		if (mapping.verb != c.req.Method && mapping.verb != "*") || mapping.mode == "off" {
+			continue
+		}
+		params, ok := matchPath(mapping.url, c.path)
+		if !ok {
+			continue
 		}
-		out.Write([]byte(ctHeader))
-		out.Write([]byte("\r\n"))
-		out.Write(line)
+		if !mapping.matchVersion(c.version) || !mapping.matchQuery(query) {
+			continue
+		}
+		if !mapping.matchCaller(c.peer) {
+			continue
+		}
+		c.params = params
+		return &rules[i]
+	}
+	return nil
+}
+
+// When the daemon switches protocols (e.g. attach/exec), or sends back a
+// raw stream with no length, we stop parsing and just copy bytes around
+func isHijack(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return true
 	}
 
-	// Become a proxy/pass-thru
-	copyConn(id, in, out)
+	ct := resp.Header.Get("Content-Type")
+	return resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 &&
+		(strings.HasPrefix(ct, "application/vnd.docker.raw-stream") ||
+			strings.HasPrefix(ct, "application/vnd.docker.multiplexed-stream"))
 }
 
-func processRequest(id int, conn *net.UnixConn) {
+// Write just the status line and headers, the body (if any) is left to
+// whoever calls us
+func writeResponseHeader(w io.Writer, resp *http.Response) error {
+	if _, err := fmt.Fprintf(w, "HTTP/%d.%d %s\r\n", resp.ProtoMajor,
+		resp.ProtoMinor, resp.Status); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// Send back an error the same way the Docker daemon does, so the client
+// can show the message to the user. 'close' tells the client we're hanging
+// up after this.
+func writeError(w io.Writer, code int, msg string, close bool) error {
+	buf, _ := json.Marshal(map[string]string{"message": msg})
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(buf)),
+		ContentLength: int64(len(buf)),
+		Close:         close,
+	}
+	return resp.Write(w)
+}
+
+func processRequest(id int, conn net.Conn) {
 	log(1, "%d: New connection\n", id)
 
+	if !trackConn(id, conn) {
+		log(1, "%d: Shutting down, dropping the connection\n", id)
+		conn.Close()
+		return
+	}
+	defer untrackConn(id)
+
+	metrics.activeConns.inc()
+	defer metrics.activeConns.dec()
+
 	defer log(1, "%d: Incoming connection closed\n", id)
 	defer conn.Close()
 
-	// Grab just the first line to see if its what we're looking for
-	line, err := readLine(conn)
-	if err != nil {
-		log(0, "%d: Error reading header line: %v\n", id, err)
-		return
+	peer, err := getPeerCred(conn)
+	if err != nil && err != errNoPeerCred {
+		log(0, "%d: Error getting peer credentials: %v\n", id, err)
 	}
-	log(1, "%d: Request: %s\n", id, strings.TrimSpace(string(line)))
-
-	words := strings.Split(strings.TrimSpace(string(line)), " ")
-	if len(words) < 2 {
-		log(0, "%d: Error extracting verb/url from header: %s\n", id, line)
+	if peer != nil {
+		peer.lookup()
+		log(2, "%d: Peer uid:%d gid:%d pid:%d\n", id, peer.UID, peer.GID, peer.PID)
 	}
 
-	for _, mapping := range mappings {
-		if mapping.verb != words[0] {
-			continue
+	in := bufio.NewReaderSize(conn, packetSize)
+
+	// The connection to each upstream is opened on the first request that
+	// needs it and then reused for the rest of the requests on this
+	// connection
+	outs := map[*upstream]*upstreamConn{}
+	defer func() {
+		for u, out := range outs {
+			out.conn.Close()
+			log(1, "%d: Outgoing connection to %q closed\n", id, u.name)
 		}
-		if !strings.Contains(words[1], mapping.url) {
-			continue
+	}()
+
+	// The last request on this connection, so its "maxConcurrent" spot (if
+	// it has one) can be given up once it's done
+	var last *call
+	defer func() { last.done() }()
+
+	// A connection keeps the rules that were loaded when it was opened, a
+	// reload only applies to new connections
+	rules := currentMappings()
+
+	for {
+		last.done()
+		if !setConnBusy(id, false) {
+			return
 		}
 
-		// No func means we just reject the request
-		if mapping.fn == nil {
+		// Wait for the start of the next request before we say we're busy
+		// so that idle connections can be closed when we're shutting down.
+		// With "-max-conns" it (and its headers) has to show up within
+		// "-idle-timeout".
+		if idle := connIdleTimeout(); idle > 0 {
+			conn.SetReadDeadline(time.Now().Add(idle))
+		}
+		if _, err := in.Peek(1); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				log(1, "%d: Idle for %s, closing the connection\n", id, idleTimeout)
+			} else if err != io.EOF && !isDraining() {
+				log(0, "%d: Error reading request: %v\n", id, err)
+			}
+			return
+		}
+		if !setConnBusy(id, true) {
 			return
 		}
 
-		parseRequest(id, conn, line, mapping.fn)
-		return
-	}
+		req, err := http.ReadRequest(in)
+		if err != nil {
+			if err != io.EOF {
+				log(0, "%d: Error reading request: %v\n", id, err)
+				metrics.parseErrors.inc("request")
+			}
+			return
+		}
 
-	// Just act like a proxy
-	parseRequest(id, conn, line, nil)
-}
+		// Bodies (e.g. a build context) and attached streams can take as
+		// long as they need
+		conn.SetReadDeadline(time.Time{})
+		start := time.Now()
+		verbLabel := metricVerb(req.Method)
+		log(1, "%d: Request: %s %s\n", id, req.Method, req.RequestURI)
+
+		// The client won't send the body until it sees a "100 Continue", so
+		// send one the first time something (us or the upstream) reads it
+		var expect *continueReader
+		if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+			req.Header.Del("Expect")
+			if req.ContentLength != 0 {
+				expect = &continueReader{body: req.Body, w: conn}
+				req.Body = expect
+			}
+		}
 
-// Add our own Label to the "docker create" cmd
-func twiddleCreate(id int, headers [][]byte, body map[string]interface{}) ([][]byte, map[string]interface{}) {
-	log(1, "%d: Adding a label\n", id)
+		c := &call{id: id, req: req, peer: peer}
+		last = c
+		c.version, c.path = splitVersion(req.URL.Path)
+		if peer == nil {
+			c.remote = conn.RemoteAddr().String()
+		}
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			state := tlsConn.ConnectionState()
+			c.tls = &state
+		}
+		mapping := findMapping(rules, c)
+		recordRequest(c)
 
-	if obj := body["Labels"]; obj != nil {
-		log(3, "%d: Found some labels\n", id)
-		var ok bool
-		labels, ok := obj.(map[string]interface{})
-		if !ok {
-			log(0, "%d: Error casting label: %v\n", body["Labels"])
-			return nil, nil
+		metrics.requests.inc(verbLabel, metricPath(c, mapping))
+		if mapping != nil {
+			metrics.matches.inc(mapping.name())
+		}
+
+		// Send back an error instead of the daemon's response, returns false
+		// if the connection needs to be closed
+		sendError := func(code int, err error) bool {
+			audit(c, mapping, code, err)
+
+			// Toss whatever is left of the body so we can keep going. If
+			// the client is still waiting to send it we just hang up.
+			closing := req.Close
+			if expect != nil && !expect.sent {
+				closing = true
+			} else {
+				io.Copy(ioutil.Discard, req.Body)
+			}
+			record(c, mapping, nil, code, err)
+			err = writeError(conn, code, err.Error(), closing)
+			metrics.requestDuration.observe(time.Since(start).Seconds(), verbLabel)
+			return err == nil && !closing
+		}
+
+		if mapping != nil {
+			if err := checkRequest(c, mapping); err != nil {
+				code := http.StatusInternalServerError
+				if he, ok := err.(*httpError); ok {
+					code = he.code
+				}
+				log(1, "%d: Rejecting request(%d): %s\n", id, code, err)
+				metrics.rejections.inc(strconv.Itoa(code))
+				if !sendError(code, err) {
+					return
+				}
+				continue
+			}
+		}
+
+		// Don't let Go add its own User-Agent if there wasn't one
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header["User-Agent"] = []string{""}
+		}
+
+		if c.upstream == nil {
+			c.upstream = defaultUpstream
+		}
+		u := c.upstream.pick()
+		out := outs[u]
+		if out == nil {
+			var conn net.Conn
+			u, conn, err = dialUpstream(c, c.upstream)
+			if err != nil {
+				err = fmt.Errorf("Can't connect to the Docker daemon (upstream %q): %s",
+					c.upstream.name, err)
+				if !sendError(http.StatusBadGateway, err) {
+					return
+				}
+				continue
+			}
+			if out = outs[u]; out == nil {
+				out = &upstreamConn{conn, bufio.NewReaderSize(conn, packetSize)}
+				outs[u] = out
+			} else {
+				conn.Close()
+			}
+		}
+		if u != c.upstream {
+			log(1, "%d: Sending to upstream %q\n", id, u.name)
+		}
+		c.upstream = u
+
+		recordSend(c)
+		if err := req.Write(out.conn); err != nil {
+			log(0, "%d: Error sending request: %v\n", id, err)
+			audit(c, mapping, 0, err)
+			record(c, mapping, nil, 0, err)
+			return
 		}
 
-		labels["test"] = "added me!"
-		body["Labels"] = labels
+		resp, err := http.ReadResponse(out.reader, req)
+		if err != nil {
+			log(0, "%d: Error reading response: %v\n", id, err)
+			audit(c, mapping, 0, err)
+			record(c, mapping, nil, 0, err)
+			metrics.parseErrors.inc("response")
+			return
+		}
+		log(1, "%d: Response: %s\n", id, resp.Status)
+		recordResponse(c, resp)
+
+		if isHijack(resp) {
+			log(1, "%d: Connection hijacked, switching to pass-thru\n", id)
+			err := writeResponseHeader(conn, resp)
+			audit(c, mapping, resp.StatusCode, err)
+			record(c, mapping, resp, resp.StatusCode, err)
+			metrics.requestDuration.observe(time.Since(start).Seconds(), verbLabel)
+			if err != nil {
+				return
+			}
+			copyConn(id, conn, out.conn, in, out.reader)
+			return
+		}
+
+		if mapping != nil && mapping.respFn != nil {
+			twiddle := twiddleResponse
+			if mapping.isShadow() {
+				twiddle = shadowResponse
+			}
+			if err := twiddle(c, resp, mapping.respFn); err != nil {
+				log(0, "%d: Error processing response: %s\n", id, err)
+				audit(c, mapping, resp.StatusCode, err)
+				record(c, mapping, resp, 0, err)
+				return
+			}
+		}
+
+		// Let the client know not to send anything else
+		if isDraining() {
+			resp.Close = true
+		}
+
+		recordReply(c, resp)
+		err = resp.Write(conn)
+		resp.Body.Close()
+		audit(c, mapping, resp.StatusCode, err)
+		record(c, mapping, resp, resp.StatusCode, err)
+		metrics.requestDuration.observe(time.Since(start).Seconds(), verbLabel)
+		if err != nil {
+			log(0, "%d: Error sending response: %v\n", id, err)
+			return
+		}
+
+		if req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// Add our own Label to the "docker create" cmd
+func twiddleCreate(c *call, req *ContainerCreateRequest) error {
+	log(1, "%d: Adding a label\n", c.id)
+
+	if req.Labels != nil {
+		log(3, "%d: Found some labels\n", c.id)
+		req.Labels["test"] = "added me!"
 	} else {
-		body["Labels"] = map[string]string{"test": "inserted me!"}
+		req.Labels = map[string]string{"test": "inserted me!"}
 	}
 
-	return headers, body
+	return nil
 }
 
-var mappings = []struct {
-	verb string
-	url  string
-	fn   tFunc
-}{
-	{"POST", "/containers/create", twiddleCreate},
+type mapping struct {
+	verb     string
+	url      string  // path pattern, see match.go
+	fn       tFunc   // modifies the request
+	respFn   rFunc   // modifies the response
+	policies []pFunc // checked before 'fn' is called
+	deny     string  // reject the request with this message
+
+	// Only match callers with one of these uids/gids (unix sockets only)
+	uids       []int
+	gids       []int
+	exceptUIDs []int
+	exceptGIDs []int
+
+	// Only match these API versions, e.g. "1.41", "" means no limit
+	minVersion string
+	maxVersion string
+
+	// Query params the request must have, "*" means any value
+	query map[string]string
+
+	// The type of body 'fn' and the policies expect, "" means JSON
+	contentType string
+
+	// Checks the build context of a "POST /build", see build.go
+	build *buildSpec
+
+	// "enforce" (or ""), "shadow" or "off", see shadow.go
+	mode string
+
+	// Send the request here instead of "-out", see upstream.go
+	upstream *upstream
+
+	// See limit.go
+	rateLimit   *rateLimiter
+	concurrency *concurrencyLimiter
+
+	// Rewrite the images of a pull or a build, see mirror.go
+	pullImages  *imageRewriter
+	buildImages *imageRewriter
+
+	// Don't check the new body against schema.json, see schema.go
+	skipValidate bool
+}
+
+// A request without a Content-Type matches anything
+func matchContentType(m *mapping, contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	want := m.contentType
+	if want == "" {
+		if m.build != nil || m.buildImages != nil {
+			return true
+		}
+		want = "application/json"
+	}
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	return strings.EqualFold(mediaType, want)
+}
+
+// How the mapping shows up in logs, audit records and metrics
+func (m *mapping) name() string {
+	return m.verb + " " + m.url
+}
+
+// No funcs at all means we just reject the request
+func (m *mapping) isDeny() bool {
+	return m.deny != "" || (m.fn == nil && m.respFn == nil && len(m.policies) == 0 &&
+		m.build == nil && m.upstream == nil && m.rateLimit == nil &&
+		m.concurrency == nil && m.pullImages == nil && m.buildImages == nil)
+}
+
+var mappings = []mapping{
+	{verb: "POST", url: "/containers/create", fn: createTwiddler(twiddleCreate)},
 }
 
 func main() {
-	flag.StringVar(&inSock, "in", inSock, "Path to incoming socket")
-	flag.StringVar(&outSock, "out", outSock, "Path to outgoing socket")
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayMain(os.Args[2:]))
+	}
+
+	flag.StringVar(&inSock, "in", inSock,
+		"Incoming socket path, or unix://, tcp:// or tls:// address")
+	flag.StringVar(&outSock, "out", outSock,
+		"Outgoing socket path, or unix://, tcp:// or tls:// address")
+	flag.StringVar(&sockOwner, "owner", sockOwner,
+		"User (name or uid) to own the -in unix socket")
+	flag.StringVar(&sockGroup, "group", sockGroup,
+		"Group (name or gid) to own the -in unix socket, e.g. docker")
+	flag.StringVar(&sockMode, "mode", sockMode,
+		"Permissions (octal) for the -in unix socket, e.g. 0660")
+	flag.StringVar(&inTLS.caCert, "tlscacert", "",
+		"CA cert that clients of a tls:// -in must be signed by (required)")
+	flag.StringVar(&inTLS.cert, "tlscert", "", "Cert for a tls:// -in")
+	flag.StringVar(&inTLS.key, "tlskey", "", "Key for a tls:// -in")
+	flag.StringVar(&outTLS.caCert, "out-tlscacert", "",
+		"CA cert to verify a tls:// -out with (default: system's)")
+	flag.StringVar(&outTLS.cert, "out-tlscert", "", "Client cert for a tls:// -out")
+	flag.StringVar(&outTLS.key, "out-tlskey", "", "Client key for a tls:// -out")
+	flag.StringVar(&rulesFile, "rules", rulesFile, "Path to JSON rule file")
+	flag.DurationVar(&watchInterval, "watch", watchInterval,
+		"How often to check the rule file for changes (0 to disable)")
+	flag.StringVar(&auditFile, "audit", auditFile,
+		"File to append JSON audit records to (\"-\" for stdout)")
+	flag.StringVar(&recordFile, "record", recordFile,
+		"File to append each request/response to, for \"jsonMod replay\"")
+	flag.IntVar(&recordMaxBody, "record-max-body", recordMaxBody,
+		"Largest body (in bytes) to record, anything more is cut off")
+	flag.StringVar(&metricsAddr, "metrics", metricsAddr,
+		"Address (e.g. :9323) to serve Prometheus metrics on")
+	flag.Int64Var(&maxBodySize, "max-body", maxBodySize,
+		"Largest request body (in bytes) that we'll parse")
+	flag.Int64Var(&maxContextSize, "max-context", maxContextSize,
+		"Largest build context (in bytes) that we'll check")
+	flag.BoolVar(&allowLargeContext, "allow-large-context", allowLargeContext,
+		"Send build contexts over -max-context along unchecked instead of rejecting them")
+	flag.DurationVar(&gracePeriod, "grace", gracePeriod,
+		"How long to wait for connections to finish when shutting down")
+	flag.IntVar(&maxConns, "max-conns", maxConns,
+		"Max number of client connections at once, 0 means no limit")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout,
+		"With -max-conns, how long a client connection can wait between requests (0 to disable)")
+	flag.DurationVar(&healthInterval, "health-interval", healthInterval,
+		"How often to check that the upstreams are up (0 to disable)")
 	flag.IntVar(&verbose, "v", verbose, "Verbose/debugging level")
 	flag.Parse()
 
+	// First, so that with "-audit -" all of our logs go to stderr
+	if auditFile != "" {
+		if err := openAudit(auditFile); err != nil {
+			log(0, "Error opening audit file(%s): %v\n", auditFile, err)
+			os.Exit(-1)
+		}
+	}
+
+	// Rules can refer to "-out" so set it up first
+	if err := setupUpstream(outSock); err != nil {
+		log(0, "Error with outgoing address(%s): %v\n", outSock, err)
+		os.Exit(-1)
+	}
+
+	// A rule file replaces the compiled-in mappings
+	if rulesFile != "" {
+		newMappings, err := loadRules(rulesFile)
+		if err != nil {
+			log(0, "Error loading rules: %s\n", err)
+			os.Exit(-1)
+		}
+		setMappings(newMappings)
+		log(0, "Loaded %d rule(s) from: %s\n", len(newMappings), rulesFile)
+
+		go watchRules(watchInterval)
+	}
+
 	connID := 0
-	os.Remove(inSock)
 
-	listener, err := net.ListenUnix("unix", &net.UnixAddr{inSock, "unix"})
+	if recordFile != "" {
+		if err := openRecord(recordFile); err != nil {
+			log(0, "Error opening record file(%s): %v\n", recordFile, err)
+			os.Exit(-1)
+		}
+	}
+
+	if healthInterval > 0 {
+		go watchUpstreams(healthInterval)
+	}
+
+	listener, err := listen(inSock)
 	if err != nil {
 		log(0, "Can't open our listener socket(%s): %v\n", inSock, err)
 		os.Exit(-1)
 	}
-	defer os.Remove(inSock)
+	defer removeSocket(inSock)
 	log(0, "Listening on: %s\n", inSock)
 	log(0, "Sending to  : %s\n", outSock)
 
+	if metricsAddr != "" {
+		go serveMetrics(metricsAddr)
+	}
+
+	go handleShutdown(listener)
+
+	setupMaxConns(maxConns)
 	for {
-		conn, err := listener.AcceptUnix()
+		if !acquireConn() {
+			break
+		}
+		conn, err := listener.Accept()
 		if err != nil {
+			releaseConn()
+			if isDraining() {
+				break
+			}
 			log(0, "Error in accept: %v\n", err)
 			continue
 		}
 
 		connID++
-		go processRequest(connID, conn)
+		metrics.connections.inc()
+		go func(id int, conn net.Conn) {
+			defer releaseConn()
+			processRequest(id, conn)
+		}(connID, conn)
 	}
+
+	<-drained
+	log(0, "Exiting\n")
 }
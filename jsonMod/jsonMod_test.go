@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// What the fake daemon got
+type daemonEcho struct {
+	Method           string
+	URL              string
+	Body             string
+	ContentLength    int64
+	TransferEncoding []string
+	Header           http.Header
+}
+
+// Start a fake daemon on a unix socket. It sends back what it got as JSON,
+// except for an attach, which is upgraded and then echoes whatever is sent.
+func startDaemon(t *testing.T) string {
+	sock := filepath.Join(t.TempDir(), "daemon.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/attach") {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(rw, "HTTP/1.1 101 UPGRADED\r\n"+
+				"Content-Type: application/vnd.docker.raw-stream\r\n"+
+				"Connection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+			rw.Flush()
+			io.Copy(conn, rw)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		buf, _ := json.Marshal(daemonEcho{r.Method, r.URL.String(), string(body),
+			r.ContentLength, r.TransferEncoding, r.Header})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf)
+	})}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return "unix://" + sock
+}
+
+// Connection ids have to be unique across all of the proxies, like main()
+var testConnID int64
+
+// Start jsonMod with 'rules' in front of a fake daemon (or 'out' if it's
+// set), and return the socket to connect to
+func startProxy(t *testing.T, rules []mapping, out string) string {
+	if out == "" {
+		out = startDaemon(t)
+	}
+
+	oldUpstream, oldMappings := defaultUpstream, currentMappings()
+	if err := setupUpstream(out); err != nil {
+		t.Fatal(err)
+	}
+	setMappings(rules)
+	t.Cleanup(func() {
+		defaultUpstream = oldUpstream
+		setMappings(oldMappings)
+	})
+
+	sock := filepath.Join(t.TempDir(), "jsonMod.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The clients are closed first (see dialProxy), so wait for their
+	// connections to finish so they don't run into the next test
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	t.Cleanup(func() {
+		l.Close()
+		wg.Wait()
+	})
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				processRequest(int(atomic.AddInt64(&testConnID, 1)), conn)
+			}()
+		}
+	}()
+	return sock
+}
+
+// A client connection to jsonMod
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+func dialProxy(t *testing.T, sock string) *testConn {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t, conn, bufio.NewReader(conn)}
+}
+
+func (tc *testConn) send(raw string) {
+	tc.t.Helper()
+	if _, err := io.WriteString(tc.conn, raw); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+func (tc *testConn) read() *http.Response {
+	tc.t.Helper()
+	resp, err := http.ReadResponse(tc.in, nil)
+	if err != nil {
+		tc.t.Fatalf("Error reading response: %s", err)
+	}
+	return resp
+}
+
+// Read a response from the fake daemon
+func (tc *testConn) readEcho() daemonEcho {
+	tc.t.Helper()
+	resp := tc.read()
+	defer resp.Body.Close()
+	echo := daemonEcho{}
+	buf, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		tc.t.Fatalf("Expected a 200, got %s: %s", resp.Status, buf)
+	}
+	if err := json.Unmarshal(buf, &echo); err != nil {
+		tc.t.Fatalf("Bad echo %q: %s", buf, err)
+	}
+	return echo
+}
+
+// Read an error response from jsonMod
+func (tc *testConn) readError(code int) (string, *http.Response) {
+	tc.t.Helper()
+	resp := tc.read()
+	defer resp.Body.Close()
+	buf, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != code {
+		tc.t.Fatalf("Expected a %d, got %s: %s", code, resp.Status, buf)
+	}
+	msg := struct{ Message string }{}
+	if err := json.Unmarshal(buf, &msg); err != nil || msg.Message == "" {
+		tc.t.Errorf("Expected a Docker style error, got %q", buf)
+	}
+	return msg.Message, resp
+}
+
+func testRules(t *testing.T, rules ...ruleSpec) []mapping {
+	list := []mapping{}
+	for _, rule := range rules {
+		m, err := compileRule(rule, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, m)
+	}
+	return list
+}
+
+var labelRule = ruleSpec{Verb: "POST", URL: "/containers/create",
+	Ops: []opSpec{{Op: "set", Path: "Labels.proxied", Value: "yes"}}}
+
+func post(path, body string) string {
+	return fmt.Sprintf("POST %s HTTP/1.1\r\nHost: docker\r\nContent-Type: application/json\r\n"+
+		"Content-Length: %d\r\n\r\n%s", path, len(body), body)
+}
+
+func TestKeepAlive(t *testing.T) {
+	sock := startProxy(t, testRules(t, labelRule), "")
+	tc := dialProxy(t, sock)
+
+	// Both requests on the connection (and in one write) get rewritten
+	tc.send(post("/v1.41/containers/create", `{"Image":"alpine"}`) +
+		post("/containers/create?name=x", `{"Image":"busybox","Labels":{"a":"b"}}`))
+	for _, want := range []string{`{"Image":"alpine","Labels":{"proxied":"yes"}}`,
+		`{"Image":"busybox","Labels":{"a":"b","proxied":"yes"}}`} {
+		echo := tc.readEcho()
+		if echo.Body != want || echo.ContentLength != int64(len(want)) {
+			t.Errorf("Expected %s (%d), got %s (%d)", want, len(want), echo.Body,
+				echo.ContentLength)
+		}
+	}
+
+	// Anything that doesn't match is sent along as is
+	tc.send("GET /v1.41/_ping HTTP/1.1\r\nHost: docker\r\n\r\n" +
+		post("/containers/x/start", `{"a": 1}`))
+	if echo := tc.readEcho(); echo.Method != "GET" || echo.URL != "/v1.41/_ping" {
+		t.Errorf("Expected GET /v1.41/_ping, got %s %s", echo.Method, echo.URL)
+	}
+	if echo := tc.readEcho(); echo.URL != "/containers/x/start" || echo.Body != `{"a": 1}` {
+		t.Errorf("Expected the start to be unchanged, got %s %s", echo.URL, echo.Body)
+	}
+
+	// "Connection: close" is the last one
+	tc.send("GET /_ping HTTP/1.1\r\nHost: docker\r\nConnection: close\r\n\r\n")
+	tc.readEcho()
+	if _, err := tc.in.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestRejectKeepsConnection(t *testing.T) {
+	deny := ruleSpec{Verb: "POST", URL: "/containers/{id}/exec"}
+	sock := startProxy(t, testRules(t, deny, labelRule), "")
+	tc := dialProxy(t, sock)
+
+	// The rejected request's body is skipped, and the next one still works
+	tc.send(post("/containers/x/exec", `{"Cmd":["sh"]}`) +
+		post("/containers/create", `{}`))
+	tc.readError(http.StatusForbidden)
+	if echo := tc.readEcho(); echo.Body != `{"Labels":{"proxied":"yes"}}` {
+		t.Errorf("Expected the label to be added, got %s", echo.Body)
+	}
+}
+
+func TestAttachUpgrade(t *testing.T) {
+	sock := startProxy(t, testRules(t, labelRule), "")
+	tc := dialProxy(t, sock)
+
+	tc.send(post("/containers/create", `{}`))
+	tc.readEcho()
+
+	tc.send("POST /v1.41/containers/x/attach?stream=1&stdin=1 HTTP/1.1\r\nHost: docker\r\n" +
+		"Connection: Upgrade\r\nUpgrade: tcp\r\nContent-Length: 0\r\n\r\n")
+	resp := tc.read()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected a 101, got %s", resp.Status)
+	}
+
+	// From here on it's a raw stream both ways
+	for _, data := range []string{"hello\n", "POST /containers/create HTTP/1.1\r\n\r\n"} {
+		tc.send(data)
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(tc.in, buf); err != nil || string(buf) != data {
+			t.Errorf("Expected %q back, got %q %v", data, buf, err)
+		}
+	}
+}
+
+func chunked(path string, chunks ...string) string {
+	str := fmt.Sprintf("POST %s HTTP/1.1\r\nHost: docker\r\nContent-Type: application/json\r\n"+
+		"Transfer-Encoding: chunked\r\n\r\n", path)
+	for _, chunk := range chunks {
+		str += fmt.Sprintf("%x\r\n%s\r\n", len(chunk), chunk)
+	}
+	return str + "0\r\n\r\n"
+}
+
+func TestChunkedBody(t *testing.T) {
+	sock := startProxy(t, testRules(t, labelRule), "")
+	tc := dialProxy(t, sock)
+
+	// Rewritten and still chunked, with the next request right behind it
+	tc.send(chunked("/containers/create", `{"Image":`, `"alpine"}`) +
+		chunked("/containers/x/start", `{"a":`, `1}`) +
+		chunked("/containers/create") +
+		post("/containers/create", `{}`))
+
+	echo := tc.readEcho()
+	if want := `{"Image":"alpine","Labels":{"proxied":"yes"}}`; echo.Body != want {
+		t.Errorf("Expected %s, got %s", want, echo.Body)
+	}
+	if !isChunked(echo.TransferEncoding) || echo.ContentLength != -1 ||
+		echo.Header.Get("Content-Length") != "" {
+		t.Errorf("Expected only chunked framing, got %v %d", echo.TransferEncoding,
+			echo.ContentLength)
+	}
+
+	// Not ours, sent along as it was
+	echo = tc.readEcho()
+	if echo.Body != `{"a":1}` || !isChunked(echo.TransferEncoding) {
+		t.Errorf("Expected a chunked {\"a\":1}, got %v %s", echo.TransferEncoding, echo.Body)
+	}
+
+	// An empty chunked body has nothing to change
+	if echo = tc.readEcho(); echo.Body != "" {
+		t.Errorf("Expected an empty body, got %s", echo.Body)
+	}
+
+	echo = tc.readEcho()
+	if echo.Body != `{"Labels":{"proxied":"yes"}}` || echo.ContentLength != int64(len(echo.Body)) ||
+		len(echo.TransferEncoding) != 0 {
+		t.Errorf("Expected a Content-Length, got %v %d %s", echo.TransferEncoding,
+			echo.ContentLength, echo.Body)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	deny := ruleSpec{Verb: "POST", URL: "/containers/{id}/exec"}
+	sock := startProxy(t, testRules(t, deny, labelRule), "")
+
+	expect := func(path string, body string) string {
+		return fmt.Sprintf("POST %s HTTP/1.1\r\nHost: docker\r\n"+
+			"Content-Type: application/json\r\nContent-Length: %d\r\n"+
+			"Expect: 100-continue\r\n\r\n", path, len(body))
+	}
+
+	// We ask for the body once we need it, both for our own rules and when
+	// it's sent along as is
+	tc := dialProxy(t, sock)
+	for _, path := range []string{"/containers/create", "/containers/x/start"} {
+		body := `{"Image":"alpine"}`
+		tc.send(expect(path, body))
+		if resp := tc.read(); resp.StatusCode != http.StatusContinue {
+			t.Fatalf("%s: expected a 100, got %s", path, resp.Status)
+		}
+		tc.send(body)
+		echo := tc.readEcho()
+		if path == "/containers/create" {
+			body = `{"Image":"alpine","Labels":{"proxied":"yes"}}`
+		}
+		if echo.Body != body || echo.Header.Get("Expect") != "" {
+			t.Errorf("%s: expected %s without an Expect, got %s %v", path, body, echo.Body,
+				echo.Header)
+		}
+	}
+
+	// A rejected request never gets a 100, and since the client didn't
+	// send the body we have to hang up
+	tc = dialProxy(t, sock)
+	tc.send(expect("/containers/x/exec", `{"Cmd":["sh"]}`))
+	if _, resp := tc.readError(http.StatusForbidden); !resp.Close {
+		t.Errorf("Expected \"Connection: close\"")
+	}
+	if _, err := tc.in.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestNoUpstream(t *testing.T) {
+	sock := startProxy(t, testRules(t, labelRule), "unix://"+t.TempDir()+"/none.sock")
+	tc := dialProxy(t, sock)
+
+	// Both the ones we rewrite and the ones we don't, on the same connection
+	tc.send("GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n" + post("/containers/create", `{}`))
+	for i := 0; i < 2; i++ {
+		if msg, resp := tc.readError(http.StatusBadGateway); resp.Close ||
+			!strings.Contains(msg, "Can't connect to the Docker daemon") {
+			t.Errorf("Expected a 502 on an open connection, got %v %q", resp.Close, msg)
+		}
+	}
+}
+
+func TestReloadKeepsConnRules(t *testing.T) {
+	sock := startProxy(t, testRules(t, labelRule), "")
+	old := dialProxy(t, sock)
+	old.send(post("/containers/create", `{}`))
+	if echo := old.readEcho(); echo.Body != `{"Labels":{"proxied":"yes"}}` {
+		t.Fatalf("Expected the label, got %s", echo.Body)
+	}
+
+	setMappings(nil)
+
+	// Still has the rules it started with
+	old.send(post("/containers/create", `{}`))
+	if echo := old.readEcho(); echo.Body != `{"Labels":{"proxied":"yes"}}` {
+		t.Errorf("Expected the old rules, got %s", echo.Body)
+	}
+
+	tc := dialProxy(t, sock)
+	tc.send(post("/containers/create", `{}`))
+	if echo := tc.readEcho(); echo.Body != `{}` {
+		t.Errorf("Expected the new rules, got %s", echo.Body)
+	}
+}
+
+func TestShadowBuild(t *testing.T) {
+	defer func(size int64) { maxBodySize = size }(maxBodySize)
+	maxBodySize = 1024
+
+	rule := ruleSpec{Verb: "POST", URL: "/build", Mode: "shadow",
+		Build: &buildSpec{DenyImages: []string{"alpine"}}}
+	sock := startProxy(t, testRules(t, rule), "")
+	tc := dialProxy(t, sock)
+
+	// Would be rejected, and is bigger than -max-body, but it all still
+	// gets to the daemon
+	body := makeContext(t, []tarEntry{{name: "Dockerfile", body: "FROM alpine"},
+		{name: "big", body: strings.Repeat("x", 8192)}})
+	tc.send(fmt.Sprintf("POST /build HTTP/1.1\r\nHost: docker\r\n"+
+		"Content-Type: application/x-tar\r\nContent-Length: %d\r\n\r\n%s", len(body), body))
+	if echo := tc.readEcho(); echo.Body != string(body) {
+		t.Errorf("Expected the whole context, got %d bytes", len(echo.Body))
+	}
+}
+
+func TestResponseRules(t *testing.T) {
+	rule := ruleSpec{Verb: "GET", URL: "/containers/json",
+		Response: &responseSpec{Ops: []opSpec{{Op: "set", Path: "Method", Value: "changed"},
+			{Op: "delete", Path: "Header"}}}}
+	sock := startProxy(t, testRules(t, rule), "")
+	tc := dialProxy(t, sock)
+
+	tc.send("GET /v1.41/containers/json HTTP/1.1\r\nHost: docker\r\n\r\n" +
+		"GET /containers/json?all=1 HTTP/1.1\r\nHost: docker\r\n\r\n" +
+		"GET /images/json HTTP/1.1\r\nHost: docker\r\n\r\n")
+	for i := 0; i < 2; i++ {
+		if echo := tc.readEcho(); echo.Method != "changed" || echo.Header != nil {
+			t.Errorf("Expected the response to be changed, got %+v", echo)
+		}
+	}
+	if echo := tc.readEcho(); echo.Method != "GET" || echo.Header == nil {
+		t.Errorf("Expected the response to be left alone, got %+v", echo)
+	}
+}
+
+func TestValidateRule(t *testing.T) {
+	bad := ruleSpec{Verb: "POST", URL: "/containers/create",
+		Ops: []opSpec{{Op: "set", Path: "Labels", Value: []interface{}{"a=b"}}}}
+	noValidate := bad
+	noValidate.URL = "/containers/{id}/update"
+	noValidate.Ops = []opSpec{{Op: "set", Path: "Memory", Value: "lots"}}
+	no := false
+	noValidate.Validate = &no
+	sock := startProxy(t, testRules(t, bad, noValidate), "")
+
+	tc := dialProxy(t, sock)
+	tc.send(post("/containers/create", `{}`) + post("/containers/x/update", `{}`))
+	if msg, _ := tc.readError(http.StatusInternalServerError); !strings.Contains(msg, "Labels") {
+		t.Errorf("Expected the bad Labels to be caught, got %q", msg)
+	}
+	if echo := tc.readEcho(); echo.Body != `{"Memory":"lots"}` {
+		t.Errorf("Expected it to be sent along unchecked, got %s", echo.Body)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+
+Limits:
+
+A rule can limit how often its requests are made, and how many of them
+can be running at once:
+
+  { "verb": "POST", "url": "/containers/create",
+    "rateLimit": { "requests": 30, "per": "1m" } },
+  { "verb": "POST", "url": "/build",
+    "maxConcurrent": { "max": 2, "by": "all" } }
+
+"rateLimit" is a token bucket that holds "burst" requests (the default is
+"requests") and refills at "requests" per "per". "maxConcurrent" counts a
+request as running until its response has been sent back (or, if it was
+hijacked, until the connection is closed). "by" is "caller" (the default)
+to give each uid (or client IP address when not on a unix socket) its own
+limit, or "all" to share one limit between everyone. Requests over a
+limit get a 429.
+
+Reloading the rules starts the limits over.
+
+"-max-conns" limits the number of client connections, new ones wait to be
+accepted until one of the others is closed. So that idle clients can't
+hang on to all of them, a connection is then closed if the next request
+(up to the end of its headers) doesn't show up within "-idle-timeout".
+Without "-max-conns" idle connections are left alone.
+
+*/
+
+var maxConns = 0
+var idleTimeout = 2 * time.Minute
+
+// Replays run requests back to back, so the limits would just get in the way
+var ignoreLimits = false
+
+type rateLimitSpec struct {
+	Requests int    `json:"requests"`
+	Per      string `json:"per"`
+	Burst    int    `json:"burst"`
+	By       string `json:"by"`
+}
+
+type concurrencySpec struct {
+	Max int    `json:"max"`
+	By  string `json:"by"`
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	requests int
+	per      time.Duration
+	burst    int
+	byCaller bool
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type concurrencyLimiter struct {
+	max      int
+	byCaller bool
+
+	mu      sync.Mutex
+	running map[string]int
+}
+
+// Don't let the buckets for callers we haven't seen in a while pile up
+const maxBuckets = 1024
+
+func checkBy(by string) (bool, error) {
+	switch by {
+	case "", "caller":
+		return true, nil
+	case "all":
+		return false, nil
+	}
+	return false, fmt.Errorf("\"by\" must be \"caller\" or \"all\"")
+}
+
+func compileRateLimit(spec *rateLimitSpec) (*rateLimiter, error) {
+	if spec == nil {
+		return nil, nil
+	}
+	if spec.Requests <= 0 {
+		return nil, fmt.Errorf("\"rateLimit\" needs a \"requests\" greater than 0")
+	}
+	per, err := time.ParseDuration(spec.Per)
+	if err != nil || per <= 0 {
+		return nil, fmt.Errorf("Bad \"per\" in \"rateLimit\": %q", spec.Per)
+	}
+	byCaller, err := checkBy(spec.By)
+	if err != nil {
+		return nil, err
+	}
+
+	rl := &rateLimiter{
+		requests: spec.Requests,
+		per:      per,
+		burst:    spec.Burst,
+		byCaller: byCaller,
+		buckets:  map[string]*bucket{},
+	}
+	if rl.burst <= 0 {
+		rl.burst = spec.Requests
+	}
+	return rl, nil
+}
+
+func compileConcurrency(spec *concurrencySpec) (*concurrencyLimiter, error) {
+	if spec == nil {
+		return nil, nil
+	}
+	if spec.Max <= 0 {
+		return nil, fmt.Errorf("\"maxConcurrent\" needs a \"max\" greater than 0")
+	}
+	byCaller, err := checkBy(spec.By)
+	if err != nil {
+		return nil, err
+	}
+	return &concurrencyLimiter{
+		max:      spec.Max,
+		byCaller: byCaller,
+		running:  map[string]int{},
+	}, nil
+}
+
+// Who the limits are counted against, e.g. "uid 1000" or "10.0.0.5"
+func callerKey(c *call) string {
+	if c.peer != nil {
+		return "uid " + strconv.Itoa(c.peer.UID)
+	}
+	if host, _, err := net.SplitHostPort(c.remote); err == nil {
+		return host
+	}
+	return c.remote
+}
+
+// Take a token from the caller's bucket. If there isn't one, returns how
+// long until there will be.
+func (rl *rateLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	if !rl.byCaller {
+		key = ""
+	}
+	rate := float64(rl.requests) / rl.per.Seconds() // tokens per second
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b := rl.buckets[key]
+	if b == nil {
+		if len(rl.buckets) >= maxBuckets {
+			rl.prune(now, rate)
+		}
+		b = &bucket{tokens: float64(rl.burst), last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(rl.burst) {
+		b.tokens = float64(rl.burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Drop the buckets that have filled back up, they're the same as new ones
+func (rl *rateLimiter) prune(now time.Time, rate float64) {
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(rl.burst) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// Returns a func to call when the request is done, or nil if the caller
+// already has the max number of requests running
+func (cl *concurrencyLimiter) acquire(key string) func() {
+	if !cl.byCaller {
+		key = ""
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.running[key] >= cl.max {
+		return nil
+	}
+	cl.running[key]++
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			cl.mu.Lock()
+			defer cl.mu.Unlock()
+			if cl.running[key]--; cl.running[key] <= 0 {
+				delete(cl.running, key)
+			}
+		})
+	}
+}
+
+// Check the mapping's limits. If the request is let thru, and counts
+// against "maxConcurrent", then c.release needs to be called once it's done.
+// A shadow mapping doesn't count against them, it'd take away from the
+// enforced ones.
+func checkLimits(c *call, m *mapping) error {
+	if ignoreLimits || c.shadow {
+		return nil
+	}
+	key := callerKey(c)
+	who := func(byCaller bool) string {
+		if byCaller && key != "" {
+			return " for " + key
+		}
+		return ""
+	}
+
+	// Check this first so a request that's turned away doesn't use up a
+	// token too
+	release := func() {}
+	if cl := m.concurrency; cl != nil {
+		if release = cl.acquire(key); release == nil {
+			metrics.limited.inc(m.name(), "concurrent")
+			return &httpError{http.StatusTooManyRequests,
+				fmt.Sprintf("Too many %s requests running at once%s (limit is %d)",
+					m.name(), who(cl.byCaller), cl.max)}
+		}
+	}
+
+	if rl := m.rateLimit; rl != nil {
+		if ok, wait := rl.take(key, time.Now()); !ok {
+			release()
+			metrics.limited.inc(m.name(), "rate")
+			return &httpError{http.StatusTooManyRequests,
+				fmt.Sprintf("Too many %s requests%s (limit is %d per %s), try again in %s",
+					m.name(), who(rl.byCaller), rl.requests, rl.per,
+					wait.Truncate(time.Second)+time.Second)}
+		}
+	}
+
+	if m.concurrency != nil {
+		c.release = release
+	}
+	return nil
+}
+
+// Let the next request take this one's spot, if it was holding one
+func (c *call) done() {
+	if c != nil && c.release != nil {
+		c.release()
+		c.release = nil
+	}
+}
+
+// Used to make new connections wait when we have "-max-conns" of them
+var connSlots chan struct{}
+
+func setupMaxConns(max int) {
+	if max > 0 {
+		connSlots = make(chan struct{}, max)
+	}
+}
+
+// Wait for a free slot, returns false if we started shutting down first
+func acquireConn() bool {
+	if connSlots == nil {
+		return true
+	}
+	select {
+	case connSlots <- struct{}{}:
+		return true
+	case <-stopping:
+		return false
+	}
+}
+
+// An idle connection only holds others up when there's a "-max-conns"
+func connIdleTimeout() time.Duration {
+	if connSlots == nil {
+		return 0
+	}
+	return idleTimeout
+}
+
+func releaseConn() {
+	if connSlots != nil {
+		<-connSlots
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl, err := compileRateLimit(&rateLimitSpec{Requests: 2, Per: "1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		if ok, _ := rl.take("a", now); ok != want {
+			t.Errorf("take #%d: expected %v, got %v", i+1, want, ok)
+		}
+	}
+	if ok, _ := rl.take("b", now); !ok {
+		t.Errorf("each caller should get their own bucket")
+	}
+	if ok, wait := rl.take("a", now); ok || wait != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms, got %v %s", ok, wait)
+	}
+	if ok, _ := rl.take("a", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("the bucket should have refilled")
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	cl, err := compileConcurrency(&concurrencySpec{Max: 1, By: "all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := cl.acquire("a")
+	if release == nil {
+		t.Fatal("the first one should get in")
+	}
+	if cl.acquire("b") != nil {
+		t.Errorf("\"all\" should share the limit")
+	}
+	release()
+	release()
+	if cl.running[""] != 0 {
+		t.Errorf("releasing twice should only count once, running is %d", cl.running[""])
+	}
+	if cl.acquire("b") == nil {
+		t.Errorf("there should be a free spot")
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	m := &mapping{verb: "POST", url: "/build"}
+	m.rateLimit, _ = compileRateLimit(&rateLimitSpec{Requests: 1, Per: "1h"})
+	m.concurrency, _ = compileConcurrency(&concurrencySpec{Max: 1})
+	peer := &peerCred{UID: 1000}
+
+	// A shadow mapping doesn't use up the token or the spot
+	if err := checkLimits(&call{peer: peer, shadow: true}, m); err != nil {
+		t.Fatalf("shadow: %s", err)
+	}
+
+	c := &call{peer: peer}
+	if err := checkLimits(c, m); err != nil || c.release == nil {
+		t.Fatalf("expected to get in, got %v", err)
+	}
+	err := checkLimits(&call{peer: peer}, m)
+	if he, ok := err.(*httpError); !ok || he.code != http.StatusTooManyRequests {
+		t.Errorf("expected a 429 while the first one is running, got %v", err)
+	}
+	c.done()
+	err = checkLimits(&call{peer: peer}, m)
+	if he, ok := err.(*httpError); !ok || he.code != http.StatusTooManyRequests {
+		t.Errorf("expected a 429 once the token is used up, got %v", err)
+	}
+	if err := checkLimits(&call{peer: &peerCred{UID: 1001}}, m); err != nil {
+		t.Errorf("another caller should get in, got %v", err)
+	}
+}
+
+func TestConnIdleTimeout(t *testing.T) {
+	defer func(slots chan struct{}) { connSlots = slots }(connSlots)
+
+	connSlots = nil
+	if idle := connIdleTimeout(); idle != 0 {
+		t.Errorf("without -max-conns there shouldn't be an idle timeout, got %s", idle)
+	}
+	setupMaxConns(2)
+	if idle := connIdleTimeout(); idle != idleTimeout {
+		t.Errorf("with -max-conns expected %s, got %s", idleTimeout, idle)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// A mapping's url is a path pattern, matched against the request's path
+// after any API version prefix (e.g. "/v1.41") has been removed. A segment
+// of "{name}" matches any one segment, and a last segment of "{name*}"
+// matches the rest of the path (e.g. image names with "/" in them). The
+// values are saved in the call's "params" under 'name'. For example:
+//   /containers/{id}/start
+//   /images/{name*}
+
+// The daemon takes any "/v{version}" prefix where the version is made of
+// digits and dots (e.g. "/v1.41" or "/v1.41.0"), so we have to strip all
+// of those too or the request wouldn't match any of the mappings.
+func splitVersion(path string) (version string, rest string) {
+	if !strings.HasPrefix(path, "/v") {
+		return "", path
+	}
+
+	end := strings.IndexByte(path[1:], '/') + 1
+	if end == 0 {
+		end = len(path)
+	}
+	if !isVersion(path[2:end]) {
+		return "", path
+	}
+	return path[2:end], path[end:]
+}
+
+func isVersion(version string) bool {
+	if version == "" {
+		return false
+	}
+	for _, ch := range version {
+		if ch != '.' && (ch < '0' || ch > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns <0, 0, >0 like strings.Compare. This is the same as the daemon's
+// versions.compare - each part is compared as a number, and missing parts
+// (or ones that aren't numbers) count as 0, so "1.41.0" is the same as
+// "1.41".
+func compareVersions(a, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		aNum, bNum := 0, 0
+		if i < len(aParts) {
+			aNum, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bNum, _ = strconv.Atoi(bParts[i])
+		}
+		if aNum != bNum {
+			if aNum < bNum {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func checkPattern(pattern string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("URL pattern %q must start with a '/'", pattern)
+	}
+	segments := strings.Split(pattern[1:], "/")
+	for i, seg := range segments {
+		if !strings.HasPrefix(seg, "{") && !strings.HasSuffix(seg, "}") {
+			continue
+		}
+		if len(seg) < 3 || seg[0] != '{' || seg[len(seg)-1] != '}' {
+			return fmt.Errorf("Bad segment %q in URL pattern %q", seg, pattern)
+		}
+		if strings.HasSuffix(seg, "*}") && i != len(segments)-1 {
+			return fmt.Errorf("%q must be the last segment in %q", seg, pattern)
+		}
+	}
+	return nil
+}
+
+// See if 'path' matches 'pattern' and if so return the values of any of
+// the {name} segments
+func matchPath(pattern string, path string) (map[string]string, bool) {
+	patSegs := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	pathSegs := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	params := map[string]string{}
+
+	for i, seg := range patSegs {
+		isParam := len(seg) > 2 && seg[0] == '{' && seg[len(seg)-1] == '}'
+
+		if isParam && strings.HasSuffix(seg, "*}") {
+			if i >= len(pathSegs) {
+				return nil, false
+			}
+			params[seg[1:len(seg)-2]] = strings.Join(pathSegs[i:], "/")
+			return params, true
+		}
+
+		if i >= len(pathSegs) {
+			return nil, false
+		}
+
+		if isParam {
+			if pathSegs[i] == "" {
+				return nil, false
+			}
+			params[seg[1:len(seg)-1]] = pathSegs[i]
+		} else if seg != pathSegs[i] {
+			return nil, false
+		}
+	}
+
+	if len(patSegs) != len(pathSegs) {
+		return nil, false
+	}
+	return params, true
+}
+
+// Requests without a version are treated as the newest version since
+// that's what the daemon will use for them
+func (m *mapping) matchVersion(version string) bool {
+	if m.minVersion != "" && version != "" &&
+		compareVersions(version, m.minVersion) < 0 {
+		return false
+	}
+	if m.maxVersion != "" &&
+		(version == "" || compareVersions(version, m.maxVersion) > 0) {
+		return false
+	}
+	return true
+}
+
+// Each query param in the mapping must be in the request with the same
+// value, or with any value if the mapping's value is "*"
+func (m *mapping) matchQuery(query url.Values) bool {
+	for key, val := range m.query {
+		vals, ok := query[key]
+		if !ok {
+			return false
+		}
+		if val == "*" {
+			continue
+		}
+		found := false
+		for _, v := range vals {
+			if v == val {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
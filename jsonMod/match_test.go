@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitVersion(t *testing.T) {
+	tests := []struct {
+		path    string
+		version string
+		rest    string
+	}{
+		{"/containers/create", "", "/containers/create"},
+		{"/v1.41/containers/create", "1.41", "/containers/create"},
+		{"/v1.41.0/containers/create", "1.41.0", "/containers/create"},
+		{"/v1/containers/create", "1", "/containers/create"},
+		{"/v1..41/containers/create", "1..41", "/containers/create"},
+		{"/v1.41", "1.41", ""},
+		{"/v/containers/create", "", "/v/containers/create"},
+		{"/v1.41x/containers/create", "", "/v1.41x/containers/create"},
+		{"/vol/create", "", "/vol/create"},
+		{"/volumes/create", "", "/volumes/create"},
+		{"/", "", "/"},
+	}
+	for _, test := range tests {
+		version, rest := splitVersion(test.path)
+		if version != test.version || rest != test.rest {
+			t.Errorf("splitVersion(%q): expected %q %q, got %q %q", test.path,
+				test.version, test.rest, version, rest)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		cmp  int
+	}{
+		{"1.41", "1.41", 0},
+		{"1.41.0", "1.41", 0},
+		{"1.41", "1.41.0", 0},
+		{"1.41.1", "1.41", 1},
+		{"1.9", "1.41", -1},
+		{"1.41", "1.9", 1},
+		{"2", "1.99", 1},
+		{"1..41", "1.0.41", 0},
+		{"1.", "1", 0},
+	}
+	for _, test := range tests {
+		if cmp := compareVersions(test.a, test.b); cmp != test.cmp {
+			t.Errorf("compareVersions(%q, %q): expected %d, got %d", test.a, test.b,
+				test.cmp, cmp)
+		}
+	}
+}
+
+func TestMatchVersion(t *testing.T) {
+	m := &mapping{minVersion: "1.40", maxVersion: "1.41"}
+	tests := []struct {
+		version string
+		match   bool
+	}{
+		{"1.40", true},
+		{"1.41", true},
+		{"1.41.0", true},
+		{"1.40.9", true},
+		{"1.39", false},
+		{"1.41.1", false},
+		{"1.42", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if match := m.matchVersion(test.version); match != test.match {
+			t.Errorf("matchVersion(%q): expected %v, got %v", test.version, test.match, match)
+		}
+	}
+
+	if !(&mapping{minVersion: "1.40"}).matchVersion("") {
+		t.Errorf("matchVersion: a request without a version should be the newest one")
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		params  map[string]string // nil means no match
+	}{
+		{"/containers/create", "/containers/create", map[string]string{}},
+		{"/containers/create", "/containers/create/", nil},
+		{"/containers/create", "/containers", nil},
+		{"/containers/create", "/containers/create/x", nil},
+		{"/containers/{id}/start", "/containers/abc/start", map[string]string{"id": "abc"}},
+		{"/containers/{id}/start", "/containers//start", nil},
+		{"/containers/{id}/start", "/containers/abc", nil},
+		{"/images/{name*}", "/images/library/alpine/json",
+			map[string]string{"name": "library/alpine/json"}},
+		{"/images/{name*}", "/images", nil},
+		{"/{path*}", "/anything/at/all", map[string]string{"path": "anything/at/all"}},
+	}
+	for _, test := range tests {
+		params, ok := matchPath(test.pattern, test.path)
+		if ok != (test.params != nil) || (ok && !reflect.DeepEqual(params, test.params)) {
+			t.Errorf("matchPath(%q, %q): expected %v, got %v %v", test.pattern, test.path,
+				test.params, params, ok)
+		}
+	}
+
+	// Every way the daemon takes a version prefix has to hit the mapping
+	for _, path := range []string{"/containers/create", "/v1.41/containers/create",
+		"/v1.41.0/containers/create", "/v1/containers/create"} {
+		_, rest := splitVersion(path)
+		if _, ok := matchPath("/containers/create", rest); !ok {
+			t.Errorf("%q should match /containers/create", path)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Just enough of the Prometheus text format to expose our counters and
+// histograms on "-metrics", without pulling in the client library.
+
+type series struct {
+	labels []string
+	value  float64
+
+	// Only used by histograms, 'value' is the count
+	counts []uint64
+	sum    float64
+}
+
+type metricVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	kind    string // "counter", "gauge" or "histogram"
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+var allMetrics = []*metricVec{}
+
+func newMetric(kind, name, help string, labels ...string) *metricVec {
+	m := &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: map[string]*series{},
+	}
+	allMetrics = append(allMetrics, m)
+	return m
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metricVec {
+	m := newMetric("histogram", name, help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+func (m *metricVec) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("%s: wrong number of labels", m.name))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: labelValues, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metricVec) add(val float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += val
+}
+
+func (m *metricVec) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metricVec) dec(labelValues ...string) {
+	m.add(-1, labelValues...)
+}
+
+func (m *metricVec) set(val float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value = val
+}
+
+func (m *metricVec) observe(val float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	for i, bound := range m.buckets {
+		if val <= bound {
+			s.counts[i]++
+		}
+	}
+	s.value++
+	s.sum += val
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	parts := []string{}
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", name, labelEscaper.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", extra[i], extra[i+1]))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(val float64) string {
+	if math.IsInf(val, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", val)
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := []string{}
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labels),
+				formatFloat(s.value))
+			continue
+		}
+
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name,
+				formatLabels(m.labels, s.labels, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %s\n", m.name,
+			formatLabels(m.labels, s.labels, "le", "+Inf"), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labels),
+			formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %s\n", m.name, formatLabels(m.labels, s.labels),
+			formatFloat(s.value))
+	}
+}
+
+var metrics = struct {
+	connections      *metricVec
+	activeConns      *metricVec
+	requests         *metricVec
+	matches          *metricVec
+	rewrites         *metricVec
+	rejections       *metricVec
+	shadowRejections *metricVec
+	limited          *metricVec
+	parseErrors      *metricVec
+	dialFailures     *metricVec
+	upstreamUp       *metricVec
+	requestDuration  *metricVec
+	copiedBytes      *metricVec
+}{
+	connections: newMetric("counter", "jsonmod_connections_total",
+		"Connections accepted"),
+	activeConns: newMetric("gauge", "jsonmod_connections_active",
+		"Connections currently open"),
+	requests: newMetric("counter", "jsonmod_requests_total",
+		"Requests by verb and path (the mapping's url, the first part of the path, or \"other\")",
+		"verb", "path"),
+	matches: newMetric("counter", "jsonmod_mapping_matches_total",
+		"Requests that matched a mapping", "mapping"),
+	rewrites: newMetric("counter", "jsonmod_rewrites_total",
+		"Request bodies passed thru a twiddler", "mapping"),
+	rejections: newMetric("counter", "jsonmod_rejections_total",
+		"Requests rejected by jsonMod", "code"),
+	shadowRejections: newMetric("counter", "jsonmod_shadow_rejections_total",
+		"Requests that a shadow mapping would have rejected", "mapping"),
+	limited: newMetric("counter", "jsonmod_limited_total",
+		"Requests rejected for going over a rate or concurrency limit", "mapping", "limit"),
+	parseErrors: newMetric("counter", "jsonmod_parse_errors_total",
+		"Requests/responses (or their bodies) that couldn't be parsed", "kind"),
+	dialFailures: newMetric("counter", "jsonmod_upstream_dial_failures_total",
+		"Failed connections to an upstream", "upstream"),
+	upstreamUp: newMetric("gauge", "jsonmod_upstream_up",
+		"Whether an upstream passed its last health check", "upstream"),
+	requestDuration: newHistogram("jsonmod_request_duration_seconds",
+		"Time from reading a request to sending back its response",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		"verb"),
+	copiedBytes: newHistogram("jsonmod_copied_bytes",
+		"Bytes copied in each direction of a hijacked connection",
+		[]float64{1 << 10, 1 << 14, 1 << 17, 1 << 20, 1 << 24, 1 << 27, 1 << 30},
+		"direction"),
+}
+
+// The top level parts of the Engine API's paths
+var apiPaths = map[string]bool{
+	"_ping": true, "auth": true, "build": true, "commit": true, "configs": true,
+	"containers": true, "distribution": true, "events": true, "exec": true,
+	"grpc": true, "images": true, "info": true, "networks": true, "nodes": true,
+	"plugins": true, "secrets": true, "services": true, "session": true,
+	"swarm": true, "system": true, "tasks": true, "version": true, "volumes": true,
+}
+
+// The "path" label for a request. Raw paths have ids in them, so to keep
+// the number of series down we use the mapping's pattern or just the first
+// part of the path. Anything else is "other" so clients can't make up new
+// series just by sending junk.
+func metricPath(c *call, m *mapping) string {
+	if m != nil {
+		return m.url
+	}
+	parts := strings.SplitN(strings.TrimPrefix(c.path, "/"), "/", 2)
+	if !apiPaths[parts[0]] {
+		return "other"
+	}
+	return "/" + parts[0]
+}
+
+// The "verb" label for a request, the same idea as metricPath
+func metricVerb(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "PATCH", "OPTIONS":
+		return method
+	}
+	return "other"
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range allMetrics {
+			m.write(w)
+		}
+	})
+
+	log(0, "Metrics on  : %s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log(0, "Error serving metrics: %s\n", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func metricValue(m *metricVec, labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.get(labelValues).value
+}
+
+func TestMetricWrite(t *testing.T) {
+	counter := &metricVec{name: "c_total", help: "A counter", kind: "counter",
+		labels: []string{"path"}, series: map[string]*series{}}
+	counter.inc("/b")
+	counter.add(2, "/a\"\n")
+	counter.inc("/b")
+
+	hist := &metricVec{name: "h", help: "A histogram", kind: "histogram",
+		labels: []string{"verb"}, buckets: []float64{1, 10}, series: map[string]*series{}}
+	hist.observe(0.5, "GET")
+	hist.observe(5, "GET")
+	hist.observe(50, "GET")
+
+	buf := &bytes.Buffer{}
+	counter.write(buf)
+	hist.write(buf)
+	want := `# HELP c_total A counter
+# TYPE c_total counter
+c_total{path="/a\"\n"} 2
+c_total{path="/b"} 2
+# HELP h A histogram
+# TYPE h histogram
+h_bucket{verb="GET",le="1"} 1
+h_bucket{verb="GET",le="10"} 2
+h_bucket{verb="GET",le="+Inf"} 3
+h_sum{verb="GET"} 55.5
+h_count{verb="GET"} 3
+`
+	if buf.String() != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, buf)
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	m := &mapping{url: "/containers/{id}/start"}
+	tests := []struct {
+		path string
+		m    *mapping
+		want string
+	}{
+		{"/containers/abc/start", m, "/containers/{id}/start"},
+		{"/containers/abc/json", nil, "/containers"},
+		{"/_ping", nil, "/_ping"},
+		{"/random/junk", nil, "other"},
+		{"/", nil, "other"},
+	}
+	for _, test := range tests {
+		if got := metricPath(&call{path: test.path}, test.m); got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.path, test.want, got)
+		}
+	}
+
+	for verb, want := range map[string]string{"GET": "GET", "DELETE": "DELETE", "BREW": "other"} {
+		if got := metricVerb(verb); got != want {
+			t.Errorf("%s: expected %q, got %q", verb, want, got)
+		}
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	deny := ruleSpec{Verb: "POST", URL: "/containers/{id}/exec"}
+	sock := startProxy(t, testRules(t, deny, labelRule), "")
+
+	before := []float64{
+		metricValue(metrics.requests, "POST", "/containers/create"),
+		metricValue(metrics.matches, "POST /containers/create"),
+		metricValue(metrics.rewrites, "POST /containers/create"),
+		metricValue(metrics.rejections, "403"),
+		metricValue(metrics.requests, "other", "other"),
+	}
+
+	tc := dialProxy(t, sock)
+	tc.send(post("/containers/create", `{}`) + post("/containers/x/exec", `{}`) +
+		"BREW /coffee HTTP/1.1\r\nHost: docker\r\n\r\n")
+	tc.readEcho()
+	tc.readError(http.StatusForbidden)
+	tc.read()
+
+	after := []float64{
+		metricValue(metrics.requests, "POST", "/containers/create"),
+		metricValue(metrics.matches, "POST /containers/create"),
+		metricValue(metrics.rewrites, "POST /containers/create"),
+		metricValue(metrics.rejections, "403"),
+		metricValue(metrics.requests, "other", "other"),
+	}
+	for i := range before {
+		if after[i]-before[i] != 1 {
+			t.Errorf("%d: expected it to go up by 1, got %g -> %g", i, before[i], after[i])
+		}
+	}
+}
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+/*
+
+Rewriting images:
+
+A rule on "POST /images/create" (a pull), "POST /containers/create" or
+"POST /build" can change the images they use:
+
+  { "verb": "POST", "url": "/images/create",
+    "images": {
+      "mirrors": [
+        { "from": "docker.io/library/*", "to": "mirror.internal/library/*" },
+        { "from": "docker.io/*", "to": "mirror.internal/hub/*" }
+      ],
+      "lockfile": "/etc/jsonMod/images.lock",
+      "allowRegistries": [ "mirror.internal", "*.example.com" ]
+    } }
+
+The first of the "mirrors" whose "from" matches the image (see image.go)
+is used, and each "*" in its "to" is replaced with what the same "*"
+matched in "from". Then if the image has a tag (or no tag, which means
+"latest") that's in the "lockfile" it's pinned to that digest. The lockfile
+is a JSON map of images to digests that's read when the rules are loaded:
+
+  { "alpine:3.19": "sha256:c5b1261d...", "docker.io/library/redis:7": "sha256:..." }
+
+Lastly, if "allowRegistries" is set then the image must come from one of
+them (globs are ok) or the request is rejected with a 403.
+
+For a pull that's the "fromImage" and "tag" query params (a pull with no
+tag, i.e. all tags, isn't pinned), for a new container it's the "Image" in
+the body (unless it's a full image ID, i.e. "sha256:..." or 64 hex digits),
+and for a build it's each FROM and "COPY --from=<image>" in the Dockerfile
+plus the "cachefrom" query param. The other images a build can pull (see
+build.go) aren't rewritten, but still have to be from "allowRegistries".
+If the Dockerfile changes then the build context is sent along as an
+uncompressed tar stream with the new Dockerfile in it. Remote and BuildKit
+builds are rejected since we can't see their Dockerfiles.
+
+When an image is moved to another registry the client's credentials for
+the registry it asked for aren't sent to the new one: the X-Registry-Auth
+header of a pull (or create) is dropped, and so are the X-Registry-Config
+entries of a build for registries that none of its images use any more.
+A mirror that needs a login has to be set up on the daemon's side.
+
+Note that a container or build that uses a local image whose name matches
+a mirror (e.g. "myapp:dev" and "docker.io/*") will end up looking for the
+mirrored name instead.
+
+*/
+
+type imagesSpec struct {
+	Mirrors         []mirrorSpec `json:"mirrors"`
+	Lockfile        string       `json:"lockfile"`
+	AllowRegistries []string     `json:"allowRegistries"`
+}
+
+type mirrorSpec struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type imageRewriter struct {
+	mirrors         []mirrorSpec
+	lock            map[string]string // normalized image -> digest
+	allowRegistries []string
+}
+
+// Only these are sure to be IDs, anything shorter could be a name too
+var imageIDRE = regexp.MustCompile(`^(sha256:[0-9a-f]+|[0-9a-f]{64})$`)
+
+func compileImages(spec *imagesSpec) (*imageRewriter, error) {
+	ir := &imageRewriter{
+		mirrors:         spec.Mirrors,
+		allowRegistries: spec.AllowRegistries,
+	}
+
+	for _, m := range spec.Mirrors {
+		if m.From == "" || m.To == "" {
+			return nil, fmt.Errorf("Each of the \"mirrors\" needs a \"from\" and a \"to\"")
+		}
+		if strings.Count(m.To, "*") > strings.Count(m.From, "*") {
+			return nil, fmt.Errorf("Mirror %q has more \"*\"s than %q", m.To, m.From)
+		}
+	}
+
+	if spec.Lockfile != "" {
+		var err error
+		if ir.lock, err = loadLockfile(spec.Lockfile); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ir.mirrors) == 0 && ir.lock == nil && len(ir.allowRegistries) == 0 {
+		return nil, fmt.Errorf("\"images\" needs \"mirrors\", a \"lockfile\" or \"allowRegistries\"")
+	}
+	return ir, nil
+}
+
+func loadLockfile(file string) (map[string]string, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]string{}
+	if err := decodeJSON(buf, &entries); err != nil {
+		return nil, fmt.Errorf("Error parsing %q: %s", file, err)
+	}
+
+	lock := map[string]string{}
+	for image, digest := range entries {
+		if !strings.Contains(digest, ":") {
+			return nil, fmt.Errorf("Bad digest for %q in %q: %q", image, file, digest)
+		}
+		lock[normalizeImage(image)] = digest
+	}
+	return lock, nil
+}
+
+// Fill in the "*"s in 'pattern' with the 'captures'
+func fillGlob(pattern string, captures []string) string {
+	parts := strings.Split(pattern, "*")
+	str := parts[0]
+	for i, part := range parts[1:] {
+		if i < len(captures) {
+			str += captures[i]
+		}
+		str += part
+	}
+	return str
+}
+
+// Mirror, pin and check one image reference
+func (ir *imageRewriter) rewrite(c *call, image string, pin bool) (string, error) {
+	newImage := image
+	full := fullImageName(image)
+	for _, m := range ir.mirrors {
+		captures, ok := globCaptures(m.From, image)
+		if !ok {
+			captures, ok = globCaptures(m.From, full)
+		}
+		if ok {
+			newImage = fillGlob(m.To, captures)
+			break
+		}
+	}
+
+	if repo, _, digest := splitImage(newImage); pin && ir.lock != nil && digest == "" {
+		for _, name := range []string{image, newImage} {
+			if digest, ok := ir.lock[normalizeImage(name)]; ok {
+				newImage = repo + "@" + digest
+				break
+			}
+		}
+	}
+
+	if err := ir.checkRegistry(newImage); err != nil {
+		return "", err
+	}
+
+	if newImage != image {
+		log(1, "%d: Image %q is now %q\n", c.id, image, newImage)
+	}
+	return newImage, nil
+}
+
+// Is the image from one of the "allowRegistries"?
+func (ir *imageRewriter) checkRegistry(image string) error {
+	if len(ir.allowRegistries) == 0 {
+		return nil
+	}
+	registry := imageRegistry(image)
+	for _, pattern := range ir.allowRegistries {
+		if matchGlob(pattern, registry) {
+			return nil
+		}
+	}
+	return denyf("Images from %q are not allowed (%q)", registry, image)
+}
+
+// The "fromImage" and "tag" of a "POST /images/create"
+func rewritePull(c *call, ir *imageRewriter) error {
+	query := c.req.URL.Query()
+	from := query.Get("fromImage")
+	if from == "" {
+		// An import ("fromSrc") or something we don't know about
+		return nil
+	}
+
+	image := from
+	tag := query.Get("tag")
+	if strings.Contains(tag, ":") {
+		image += "@" + tag
+	} else if tag != "" {
+		image += ":" + tag
+	}
+	_, imageTag, imageDigest := splitImage(image)
+	allTags := imageTag == "" && imageDigest == ""
+
+	newImage, err := ir.rewrite(c, image, !allTags)
+	if err != nil || newImage == image {
+		return err
+	}
+	dropRegistryAuth(c, image, newImage)
+
+	repo, newTag, digest := splitImage(newImage)
+	if digest != "" {
+		newTag = digest
+	}
+	query.Set("fromImage", repo)
+	if newTag != "" {
+		query.Set("tag", newTag)
+	} else {
+		query.Del("tag")
+	}
+	c.req.URL.RawQuery = query.Encode()
+	return nil
+}
+
+// The "Image" of a "POST /containers/create"
+func (ir *imageRewriter) rewriteCreate(c *call, req *ContainerCreateRequest) error {
+	if req.Image == "" || imageIDRE.MatchString(req.Image) {
+		return nil
+	}
+	newImage, err := ir.rewrite(c, req.Image, true)
+	if err != nil {
+		return err
+	}
+	dropRegistryAuth(c, req.Image, newImage)
+	req.Image = newImage
+	return nil
+}
+
+// The client's X-Registry-Auth is for the registry of the image it asked
+// for, so don't let it go to a different one
+func dropRegistryAuth(c *call, image, newImage string) {
+	if imageRegistry(image) == imageRegistry(newImage) ||
+		c.req.Header.Get("X-Registry-Auth") == "" {
+		return
+	}
+	log(1, "%d: Dropping X-Registry-Auth, %q is now from %q\n", c.id, image,
+		imageRegistry(newImage))
+	c.req.Header.Del("X-Registry-Auth")
+}
+
+// Drop the X-Registry-Config entries (registry -> auth) for the registries
+// in 'drop'. If we can't make sense of it then it all goes.
+func dropRegistryConfig(c *call, drop map[string]bool) {
+	header := c.req.Header.Get("X-Registry-Config")
+	if header == "" || len(drop) == 0 {
+		return
+	}
+
+	configs := map[string]json.RawMessage{}
+	buf, err := base64.URLEncoding.DecodeString(header)
+	if err != nil {
+		buf, err = base64.StdEncoding.DecodeString(header)
+	}
+	if err == nil {
+		err = json.Unmarshal(buf, &configs)
+	}
+	if err != nil {
+		log(0, "%d: Dropping X-Registry-Config, can't parse it: %s\n", c.id, err)
+		c.req.Header.Del("X-Registry-Config")
+		return
+	}
+
+	for key := range configs {
+		if registry := configRegistry(key); drop[registry] {
+			log(1, "%d: Dropping the X-Registry-Config entry for %q\n", c.id, key)
+			delete(configs, key)
+		}
+	}
+	buf, _ = json.Marshal(configs)
+	c.req.Header.Set("X-Registry-Config", base64.URLEncoding.EncodeToString(buf))
+}
+
+// The registry an X-Registry-Config key is for, e.g.
+// "https://index.docker.io/v1/" -> "docker.io"
+func configRegistry(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		key = key[:i]
+	}
+	key = strings.ToLower(key)
+	if key == "index.docker.io" || key == "registry-1.docker.io" {
+		key = "docker.io"
+	}
+	return key
+}
+
+// The images used by a "POST /build"
+func rewriteBuild(c *call, ir *imageRewriter) error {
+	req := c.req
+	query := req.URL.Query()
+
+	if query.Get("remote") != "" {
+		return denyf("Can't check the images of a remote build context")
+	}
+	if query.Get("version") == "2" {
+		return denyf("Can't check the images of a BuildKit build")
+	}
+
+	// Registries that images were moved away from, and the ones that are
+	// still used, so the credentials for the first can be dropped
+	moved, used := map[string]bool{}, map[string]bool{}
+	rewrite := func(image string, pin bool) (string, error) {
+		newImage, err := ir.rewrite(c, image, pin)
+		if err == nil && imageRegistry(image) != imageRegistry(newImage) {
+			moved[imageRegistry(image)] = true
+		}
+		return newImage, err
+	}
+
+	if str := query.Get("cachefrom"); str != "" {
+		images := []string{}
+		if err := json.Unmarshal([]byte(str), &images); err != nil {
+			return &httpError{http.StatusBadRequest,
+				fmt.Sprintf("Error parsing cachefrom: %s", err)}
+		}
+		changed := false
+		for i, image := range images {
+			newImage, err := rewrite(image, false)
+			if err != nil {
+				return err
+			}
+			changed = changed || newImage != image
+			images[i] = newImage
+		}
+		if changed {
+			buf, _ := json.Marshal(images)
+			query.Set("cachefrom", string(buf))
+			req.URL.RawQuery = query.Encode()
+		}
+	}
+
+	name := query.Get("dockerfile")
+	if name == "" {
+		name = "Dockerfile"
+	}
+	args, err := buildArgs(query)
+	if err != nil {
+		return err
+	}
+
+	dockerfile, err := findDockerfile(c, name)
+	if skipLargeContext(c, err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	newDockerfile, err := rewriteDockerfile(dockerfile, args, func(image string) (string, error) {
+		if image == "scratch" {
+			return image, nil
+		}
+		return rewrite(image, true)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Anything else it pulls (e.g. a "# syntax=" image) isn't rewritten but
+	// still has to come from an allowed registry
+	for _, image := range baseImages(newDockerfile, args) {
+		if image == "scratch" {
+			continue
+		}
+		if err := ir.checkRegistry(image); err != nil {
+			return err
+		}
+		used[imageRegistry(image)] = true
+	}
+	if str := query.Get("cachefrom"); str != "" {
+		images := []string{}
+		json.Unmarshal([]byte(str), &images)
+		for _, image := range images {
+			used[imageRegistry(image)] = true
+		}
+	}
+	for registry := range used {
+		delete(moved, registry)
+	}
+	dropRegistryConfig(c, moved)
+
+	if newDockerfile == dockerfile {
+		return nil
+	}
+	if int64(len(dockerfile)) >= maxDockerfileSize {
+		return &httpError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("%q is too large to rewrite", name)}
+	}
+
+	log(3, "%d: New Dockerfile:\n%s\n", c.id, newDockerfile)
+	replaceDockerfile(c, name, newDockerfile)
+	return nil
+}
+
+// Change the images in the Dockerfile's FROMs and COPY --froms. This works
+// on the lines as they are (rather than dockerfileLines) so that nothing
+// else in the file changes.
+func rewriteDockerfile(dockerfile string, buildArgs map[string]string,
+	rewrite func(string) (string, error)) (string, error) {
+
+	escape := "\\"
+	directives := true
+	continued := false
+
+	stages := map[string]bool{}
+	args := map[string]string{}
+	seenFrom := false
+
+	// The instruction we're in the middle of
+	instr := ""
+	words := []string{}
+
+	lines := strings.Split(dockerfile, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+
+		if directives {
+			if strings.HasPrefix(trimmed, "#") {
+				if key, val, ok := parseDirective(trimmed); ok && key == "escape" {
+					escape = val
+				}
+				continue
+			}
+			directives = false
+		}
+		if strings.HasPrefix(trimmed, "#") || trimmed == "" {
+			continue
+		}
+
+		// Don't count the continuation char as part of a word
+		content := line
+		isContinued := escape != "" && strings.HasSuffix(trimmed, escape)
+		if isContinued {
+			content = line[:strings.LastIndex(line, escape)]
+		}
+
+		edits := []wordEdit{}
+		for _, w := range findWords(content) {
+			if !continued && instr == "" {
+				instr = strings.ToUpper(w.text)
+				words = []string{}
+				continue
+			}
+
+			switch instr {
+			case "ARG":
+				// Only ARGs before the first FROM can be used in a FROM
+				if seenFrom {
+					continue
+				}
+				parts := strings.SplitN(w.text, "=", 2)
+				if val, ok := buildArgs[parts[0]]; ok {
+					args[parts[0]] = val
+				} else if len(parts) == 2 {
+					args[parts[0]] = strings.Trim(parts[1], `"'`)
+				}
+
+			case "FROM":
+				seenFrom = true
+				if strings.HasPrefix(w.text, "--") {
+					continue
+				}
+				words = append(words, w.text)
+				switch len(words) {
+				case 1:
+					image := expandArgs(w.text, args)
+					if stages[strings.ToLower(image)] {
+						continue
+					}
+					newImage, err := rewrite(image)
+					if err != nil {
+						return "", err
+					}
+					if newImage != image {
+						edits = append(edits, wordEdit{w, newImage})
+					}
+				case 3:
+					if strings.EqualFold(words[1], "AS") {
+						stages[strings.ToLower(w.text)] = true
+					}
+				}
+
+			case "COPY":
+				if !strings.HasPrefix(w.text, "--from=") {
+					continue
+				}
+				from := strings.TrimPrefix(w.text, "--from=")
+				if stages[strings.ToLower(from)] || strings.Trim(from, "0123456789") == "" {
+					continue
+				}
+				newImage, err := rewrite(from)
+				if err != nil {
+					return "", err
+				}
+				if newImage != from {
+					edits = append(edits, wordEdit{w, "--from=" + newImage})
+				}
+			}
+		}
+
+		// Back to front so the offsets stay right
+		for j := len(edits) - 1; j >= 0; j-- {
+			e := edits[j]
+			line = line[:e.start] + e.text + line[e.end:]
+		}
+		lines[i] = line
+
+		continued = isContinued
+		if !continued {
+			instr = ""
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+type word struct {
+	text       string
+	start, end int
+}
+
+type wordEdit struct {
+	word
+	text string
+}
+
+// The whitespace separated words in the line, and where they are
+func findWords(line string) []word {
+	words := []word{}
+	start := -1
+	for i, r := range line + " " {
+		isSpace := r == ' ' || r == '\t' || r == '\r'
+		if start < 0 && !isSpace {
+			start = i
+		} else if start >= 0 && isSpace {
+			words = append(words, word{line[start:i], start, i})
+			start = -1
+		}
+	}
+	return words
+}
+
+// Send the build context along with 'content' as the Dockerfile. The tar
+// stream is rewritten as it's sent, but not until the body is first read
+// (a shadow mapping never reads it).
+func replaceDockerfile(c *call, name string, content string) {
+	req := c.req
+	orig := req.Body
+
+	req.Body = &lazyBody{orig: orig, start: func() io.ReadCloser {
+		pr, pw := io.Pipe()
+		go func() {
+			in := bufio.NewReaderSize(orig, packetSize)
+			context, err := openContext(in)
+			if err == nil {
+				err = copyContext(tar.NewReader(context), tar.NewWriter(pw), name, content)
+			}
+			if err != nil {
+				log(0, "%d: Error rewriting the build context: %s\n", c.id, err)
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr
+	}}
+
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+}
+
+func copyContext(tr *tar.Reader, tw *tar.Writer, name string, content string) error {
+	replaced := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if isDockerfile(hdr, name) {
+			// findDockerfile already turned these away, but just in case
+			// since the daemon would use the last one
+			if replaced || !hdr.FileInfo().Mode().IsRegular() {
+				return fmt.Errorf("Unexpected %q in the build context", hdr.Name)
+			}
+			hdr.Size = int64(len(content))
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(tw, content); err != nil {
+				return err
+			}
+			replaced = true
+			continue
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+type lazyBody struct {
+	start func() io.ReadCloser
+	body  io.ReadCloser
+	orig  io.Closer
+}
+
+func (b *lazyBody) Read(p []byte) (int, error) {
+	if b.body == nil {
+		b.body = b.start()
+	}
+	return b.body.Read(p)
+}
+
+func (b *lazyBody) Close() error {
+	if b.body != nil {
+		b.body.Close()
+	}
+	return b.orig.Close()
+}
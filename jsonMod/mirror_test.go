@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func testRewriter() *imageRewriter {
+	return &imageRewriter{
+		mirrors:         []mirrorSpec{{From: "docker.io/library/*", To: "mirror.internal/library/*"}},
+		allowRegistries: []string{"mirror.internal"},
+	}
+}
+
+func TestRewritePull(t *testing.T) {
+	tests := []struct {
+		query string
+		image string // "" means it's rejected
+	}{
+		{"fromImage=alpine&tag=3", "mirror.internal/library/alpine:3"},
+		{"fromImage=index.docker.io/library/alpine", "mirror.internal/library/alpine"},
+		{"fromImage=deadbeefcafe", "mirror.internal/library/deadbeefcafe"},
+		{"fromImage=me/app", ""},
+		{"fromImage=" + url.QueryEscape("sha256:deadbeef"), "mirror.internal/library/sha256:deadbeef"},
+		{"fromImage=0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			"mirror.internal/library/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "/images/create?"+test.query, nil)
+		err := rewritePull(&call{req: req}, testRewriter())
+		if test.image == "" {
+			if err == nil {
+				t.Errorf("%s: expected it to be rejected, got %s", test.query, req.URL.RawQuery)
+			}
+			continue
+		}
+		query := req.URL.Query()
+		image := query.Get("fromImage")
+		if tag := query.Get("tag"); tag != "" {
+			image += ":" + tag
+		}
+		if err != nil || image != test.image {
+			t.Errorf("%s: expected %q, got %q %v", test.query, test.image, image, err)
+		}
+	}
+
+	// Things that look like IDs are still checked
+	ir := &imageRewriter{allowRegistries: []string{"mirror.internal"}}
+	for _, from := range []string{"deadbeefcafe", "sha256:deadbeef",
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"} {
+		req, _ := http.NewRequest("POST", "/images/create?fromImage="+url.QueryEscape(from), nil)
+		if err := rewritePull(&call{req: req}, ir); err == nil {
+			t.Errorf("%s: expected it to be rejected", from)
+		}
+	}
+}
+
+func TestRewriteCreate(t *testing.T) {
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		image    string
+		newImage string // "" means it's rejected
+	}{
+		{"alpine", "mirror.internal/library/alpine"},
+		{id, id},
+		{"sha256:" + id, "sha256:" + id},
+		{"sha256:0123", "sha256:0123"},
+		{"deadbeefcafe", "mirror.internal/library/deadbeefcafe"},
+		{"0123456789abcdef", "mirror.internal/library/0123456789abcdef"},
+		{"me/deadbeefcafe", ""},
+	}
+	for _, test := range tests {
+		req := &ContainerCreateRequest{}
+		req.Image = test.image
+		httpReq, _ := http.NewRequest("POST", "/containers/create", nil)
+		err := testRewriter().rewriteCreate(&call{req: httpReq}, req)
+		if test.newImage == "" {
+			if err == nil {
+				t.Errorf("%q: expected it to be rejected, got %q", test.image, req.Image)
+			}
+			continue
+		}
+		if err != nil || req.Image != test.newImage {
+			t.Errorf("%q: expected %q, got %q %v", test.image, test.newImage, req.Image, err)
+		}
+	}
+}
+
+func TestRegistryAuth(t *testing.T) {
+	ir := &imageRewriter{
+		mirrors: []mirrorSpec{{From: "docker.io/library/*", To: "mirror.internal/library/*"}},
+	}
+
+	// Pulls (and creates) that are moved to the mirror lose their auth
+	for _, test := range []struct {
+		from string
+		kept bool
+	}{
+		{"alpine", false},
+		{"docker.io/library/alpine", false},
+		{"mirror.internal/library/alpine", true},
+		{"docker.io/me/app", true},
+	} {
+		req, _ := http.NewRequest("POST", "/images/create?fromImage="+test.from, nil)
+		req.Header.Set("X-Registry-Auth", "creds")
+		if err := rewritePull(&call{req: req}, ir); err != nil {
+			t.Fatal(err)
+		}
+		if kept := req.Header.Get("X-Registry-Auth") != ""; kept != test.kept {
+			t.Errorf("Pull %s: expected the auth to be kept: %v", test.from, test.kept)
+		}
+
+		req, _ = http.NewRequest("POST", "/containers/create", nil)
+		req.Header.Set("X-Registry-Auth", "creds")
+		create := &ContainerCreateRequest{}
+		create.Image = test.from
+		if err := ir.rewriteCreate(&call{req: req}, create); err != nil {
+			t.Fatal(err)
+		}
+		if kept := req.Header.Get("X-Registry-Auth") != ""; kept != test.kept {
+			t.Errorf("Create %s: expected the auth to be kept: %v", test.from, test.kept)
+		}
+	}
+
+	// Builds only lose the entries for registries they no longer use
+	configs := `{"https://index.docker.io/v1/":{"auth":"hub"},"mirror.internal":{"auth":"m"},` +
+		`"other.io":{"auth":"o"}}`
+	for _, test := range []struct {
+		header     string
+		dockerfile string
+		cachefrom  string
+		want       string // "" means the header is gone
+	}{
+		{base64.URLEncoding.EncodeToString([]byte(configs)), "FROM alpine\nFROM other.io/x\n", "",
+			`{"mirror.internal":{"auth":"m"},"other.io":{"auth":"o"}}`},
+		{base64.StdEncoding.EncodeToString([]byte(configs)), "FROM alpine\nFROM me/app\n", "",
+			configs},
+		{base64.URLEncoding.EncodeToString([]byte(configs)), "FROM alpine\n",
+			url.QueryEscape(`["me/app"]`), configs},
+		{base64.URLEncoding.EncodeToString([]byte(configs)), "FROM other.io/x\n", "", configs},
+		{"not base64!", "FROM alpine\n", "", ""},
+	} {
+		c := buildCall(makeContext(t, []tarEntry{{name: "Dockerfile", body: test.dockerfile}}),
+			"cachefrom="+test.cachefrom)
+		c.req.Header.Set("X-Registry-Config", test.header)
+		if err := rewriteBuild(c, ir); err != nil {
+			t.Fatal(err)
+		}
+
+		header := c.req.Header.Get("X-Registry-Config")
+		if test.want == "" {
+			if header != "" {
+				t.Errorf("%q: expected the header to be dropped, got %q", test.dockerfile, header)
+			}
+			continue
+		}
+		buf, err := base64.URLEncoding.DecodeString(header)
+		if err != nil {
+			buf, _ = base64.StdEncoding.DecodeString(header)
+		}
+		var got, want interface{}
+		json.Unmarshal(buf, &got)
+		json.Unmarshal([]byte(test.want), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: expected %s, got %s", test.dockerfile, test.want, buf)
+		}
+	}
+}
+
+func TestRewriteBuild(t *testing.T) {
+	tests := []struct {
+		entries    []tarEntry
+		dockerfile string // "" means it's rejected
+	}{
+		{[]tarEntry{{name: "a", body: "x"}, {name: "Dockerfile", body: "FROM alpine\n"}},
+			"FROM mirror.internal/library/alpine\n"},
+		{[]tarEntry{{name: "Dockerfile", body: "FROM mirror.internal/x\n"}},
+			"FROM mirror.internal/x\n"},
+		{[]tarEntry{{name: "Dockerfile", body: "FROM alpine\n"},
+			{name: "Dockerfile", body: "FROM me/app\n"}}, ""},
+		{[]tarEntry{{name: "Dockerfile", body: "FROM alpine\n"},
+			{name: "dockerfile", body: "FROM me/app\n"}}, ""},
+		{[]tarEntry{{name: "Dockerfile", body: "# syntax=docker/dockerfile:1\nFROM alpine\n"}}, ""},
+		{[]tarEntry{{name: "Dockerfile",
+			body: "FROM alpine\nRUN --mount=from=me/app,target=/x true\n"}}, ""},
+		{[]tarEntry{{name: "Dockerfile", body: "FROM me/app\n"}}, ""},
+	}
+	for i, test := range tests {
+		c := buildCall(makeContext(t, test.entries), "")
+		err := rewriteBuild(c, testRewriter())
+		if test.dockerfile == "" {
+			if err == nil {
+				t.Errorf("%d: expected it to be rejected", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", i, err)
+			continue
+		}
+
+		// Every entry should still be there, with the new Dockerfile
+		body, err := ioutil.ReadAll(c.req.Body)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		tr := tar.NewReader(bytes.NewReader(body))
+		for _, e := range test.entries {
+			hdr, err := tr.Next()
+			if err != nil {
+				t.Fatalf("%d: %s", i, err)
+			}
+			want := e.body
+			if hdr.Name == "Dockerfile" {
+				want = test.dockerfile
+			}
+			got, _ := ioutil.ReadAll(tr)
+			if hdr.Name != e.name || string(got) != want {
+				t.Errorf("%d: expected %q %q, got %q %q", i, e.name, want, hdr.Name, got)
+			}
+		}
+		if _, err := tr.Next(); err != io.EOF {
+			t.Errorf("%d: expected the end of the context, got %v", i, err)
+		}
+	}
+}
+
+func TestCopyContext(t *testing.T) {
+	in := makeContext(t, []tarEntry{{name: "Dockerfile", body: "FROM a"},
+		{name: "./Dockerfile", body: "FROM b"}})
+	err := copyContext(tar.NewReader(bytes.NewReader(in)), tar.NewWriter(ioutil.Discard),
+		"Dockerfile", "FROM c")
+	if err == nil {
+		t.Errorf("A second Dockerfile should be an error")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Addresses for "-in" and "-out" can be:
+//   unix:///var/run/docker.sock  (or just a path)
+//   tcp://host:port
+//   tls://host:port
+
+type tlsFiles struct {
+	caCert string
+	cert   string
+	key    string
+}
+
+var inTLS = tlsFiles{}
+var outTLS = tlsFiles{}
+
+func parseAddr(addr string) (network string, address string, useTLS bool, err error) {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		return "unix", addr, false, nil
+	}
+
+	scheme, address := addr[:i], addr[i+3:]
+	if address == "" {
+		return "", "", false, fmt.Errorf("Missing address in %q", addr)
+	}
+
+	switch scheme {
+	case "unix":
+		return "unix", address, false, nil
+	case "tcp":
+		return "tcp", address, false, nil
+	case "tls":
+		return "tcp", address, true, nil
+	}
+	return "", "", false, fmt.Errorf("Unknown scheme %q in %q", scheme, addr)
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("No certs found in %q", file)
+	}
+	return pool, nil
+}
+
+// Our side of TLS. All clients must present a cert signed by the CA cert,
+// without one anyone who can reach the port would have the run of the
+// daemon.
+func listenerTLSConfig(files tlsFiles) (*tls.Config, error) {
+	if files.cert == "" || files.key == "" {
+		return nil, fmt.Errorf("tls:// listener needs a cert and key")
+	}
+	if files.caCert == "" {
+		return nil, fmt.Errorf("tls:// listener needs a CA cert (-tlscacert) to verify clients with")
+	}
+	cert, err := tls.LoadX509KeyPair(files.cert, files.key)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if config.ClientCAs, err = loadCertPool(files.caCert); err != nil {
+		return nil, err
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// The daemon's side of TLS. Without a CA cert we use the system's roots.
+func upstreamTLSConfig(files tlsFiles, address string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		config.ServerName = host
+	}
+
+	var err error
+	if files.caCert != "" {
+		if config.RootCAs, err = loadCertPool(files.caCert); err != nil {
+			return nil, err
+		}
+	}
+
+	if files.cert != "" || files.key != "" {
+		cert, err := tls.LoadX509KeyPair(files.cert, files.key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func listen(addr string) (net.Listener, error) {
+	network, address, useTLS, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		os.Remove(address)
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		if err := setSocketPerms(address); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	if useTLS {
+		config, err := listenerTLSConfig(inTLS)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, config)
+	}
+	return listener, nil
+}
+
+// Ownership and permissions of the -in unix socket, empty means leave it as
+// it was created (owned by us, with our umask). e.g. to stand in for
+// docker.sock use "-group docker -mode 0660".
+var sockOwner = ""
+var sockGroup = ""
+var sockMode = ""
+
+func setSocketPerms(path string) error {
+	uid, gid := -1, -1
+
+	if sockOwner != "" {
+		if id, err := strconv.Atoi(sockOwner); err == nil {
+			uid = id
+		} else if u, err := user.Lookup(sockOwner); err == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+		} else {
+			return fmt.Errorf("Unknown socket owner %q", sockOwner)
+		}
+	}
+
+	if sockGroup != "" {
+		if id, err := strconv.Atoi(sockGroup); err == nil {
+			gid = id
+		} else if g, err := user.LookupGroup(sockGroup); err == nil {
+			gid, _ = strconv.Atoi(g.Gid)
+		} else {
+			return fmt.Errorf("Unknown socket group %q", sockGroup)
+		}
+	}
+
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	if sockMode != "" {
+		mode, err := strconv.ParseUint(sockMode, 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("Bad socket mode %q", sockMode)
+		}
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the unix socket file, if that's what we were listening on
+func removeSocket(addr string) {
+	if network, address, _, err := parseAddr(addr); err == nil && network == "unix" {
+		os.Remove(address)
+	}
+}
+
+// Not all connections can be half-closed (e.g. TLS can't close just its
+// read side) so do what we can. If we can't close the write side then
+// close the whole thing so the other side sees an EOF.
+func closeRead(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		c.CloseRead()
+	}
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		network string
+		address string
+		useTLS  bool
+		err     bool
+	}{
+		{"/var/run/docker.sock", "unix", "/var/run/docker.sock", false, false},
+		{"unix:///var/run/docker.sock", "unix", "/var/run/docker.sock", false, false},
+		{"tcp://127.0.0.1:2375", "tcp", "127.0.0.1:2375", false, false},
+		{"tls://docker.example.com:2376", "tcp", "docker.example.com:2376", true, false},
+		{"tcp://", "", "", false, true},
+		{"http://127.0.0.1:2375", "", "", false, true},
+	}
+	for _, test := range tests {
+		network, address, useTLS, err := parseAddr(test.addr)
+		if (err != nil) != test.err || network != test.network || address != test.address ||
+			useTLS != test.useTLS {
+			t.Errorf("%q: expected %q %q %v %v, got %q %q %v %v", test.addr, test.network,
+				test.address, test.useTLS, test.err, network, address, useTLS, err)
+		}
+	}
+}
+
+func TestSocketPerms(t *testing.T) {
+	defer func(mode string) { sockMode = mode }(sockMode)
+	sockMode = "0660"
+
+	sock := filepath.Join(t.TempDir(), "in.sock")
+	l, err := listen("unix://" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if info, err := os.Stat(sock); err != nil || info.Mode().Perm() != 0660 {
+		t.Errorf("Expected 0660, got %v %v", info.Mode().Perm(), err)
+	}
+
+	sockMode = "999"
+	if l, err := listen("unix://" + sock + "2"); err == nil {
+		l.Close()
+		t.Errorf("Expected a bad mode to fail")
+	}
+}
+
+// Write a CA, and a cert signed by it, to 'dir' and return their files
+func makeCerts(t *testing.T, dir string, name string) (caFile, certFile, keyFile string) {
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	writePEM := func(file, kind string, der []byte) string {
+		file = filepath.Join(dir, name+"-"+file)
+		buf := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+		if err := ioutil.WriteFile(file, buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	caKey := newKey()
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name + " CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := newKey()
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	return writePEM("ca.pem", "CERTIFICATE", caDER), writePEM("cert.pem", "CERTIFICATE", der),
+		writePEM("key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCA, serverCert, serverKey := makeCerts(t, dir, "server")
+	clientCA, clientCert, clientKey := makeCerts(t, dir, "client")
+
+	if _, err := listenerTLSConfig(tlsFiles{cert: serverCert, key: serverKey}); err == nil {
+		t.Errorf("Expected a listener without a CA cert to fail")
+	}
+
+	defer func(files tlsFiles) { inTLS = files }(inTLS)
+	inTLS = tlsFiles{caCert: clientCA, cert: serverCert, key: serverKey}
+	l, err := listen("tls://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if conn.(*tls.Conn).Handshake() == nil {
+					conn.Write([]byte("hi"))
+				}
+			}()
+		}
+	}()
+	addr := "tls://" + l.Addr().String()
+
+	tests := []struct {
+		files tlsFiles
+		ok    bool
+	}{
+		{tlsFiles{caCert: serverCA, cert: clientCert, key: clientKey}, true},
+		{tlsFiles{caCert: serverCA}, false},                                   // no client cert
+		{tlsFiles{caCert: clientCA, cert: clientCert, key: clientKey}, false}, // wrong CA
+	}
+	for i, test := range tests {
+		u, err := newUpstream("test", addr, test.files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok := false
+		if conn, err := u.dial(); err == nil {
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			buf, _ := ioutil.ReadAll(conn)
+			ok = string(buf) == "hi"
+			conn.Close()
+		}
+		if ok != test.ok {
+			t.Errorf("%d: expected the connection to work: %v", i, test.ok)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+
+JSON Patch and JSON Merge Patch:
+
+A rule can carry an RFC 6902 JSON Patch in "patch", and/or an RFC 7386 JSON
+Merge Patch in "mergePatch":
+
+  "patch": [
+    { "op": "test", "path": "/HostConfig/NetworkMode", "value": "default" },
+    { "op": "add", "path": "/Labels/com.example.team", "value": "blue" },
+    { "op": "remove", "path": "/HostConfig/CapAdd" }
+  ],
+  "mergePatch": { "HostConfig": { "ReadonlyRootfs": true, "CapAdd": null } },
+  "onTestFail": "reject"
+
+The whole patch is applied or none of it is. If a "test" op fails then the
+patch is skipped, or with "onTestFail": "reject" the request is rejected.
+Any other error (e.g. removing something that isn't there) is logged and
+the patch is skipped.
+
+*/
+
+type patchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from"`
+	Value interface{} `json:"value"`
+}
+
+type patchTestError struct {
+	path string
+}
+
+func (e *patchTestError) Error() string {
+	return fmt.Sprintf("JSON Patch test of %q failed", e.path)
+}
+
+// RFC 6901 - "/a/b~1c" is [ "a", "b/c" ], "" is the whole document
+func parsePointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return []string{}, nil
+	}
+	if ptr[0] != '/' {
+		return nil, fmt.Errorf("JSON Pointer %q must start with a '/'", ptr)
+	}
+	tokens := strings.Split(ptr[1:], "/")
+	for i, tok := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(tok, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func checkPatch(ops []patchOp) error {
+	for i, op := range ops {
+		if _, err := parsePointer(op.Path); err != nil {
+			return fmt.Errorf("Patch op #%d: %s", i+1, err)
+		}
+		switch op.Op {
+		case "add", "replace", "test", "remove":
+		case "move", "copy":
+			if _, err := parsePointer(op.From); err != nil {
+				return fmt.Errorf("Patch op #%d: %s", i+1, err)
+			}
+		default:
+			return fmt.Errorf("Patch op #%d: unknown op %q", i+1, op.Op)
+		}
+	}
+	return nil
+}
+
+// 'max' is the largest index allowed
+func arrayIndex(tok string, max int) (int, error) {
+	i, err := strconv.Atoi(tok)
+	if err != nil || i < 0 || i > max || (len(tok) > 1 && tok[0] == '0') {
+		return 0, fmt.Errorf("Bad array index %q", tok)
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, tokens []string) (interface{}, error) {
+	for _, tok := range tokens {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			val, ok := d[tok]
+			if !ok {
+				return nil, fmt.Errorf("%q not found", tok)
+			}
+			doc = val
+		case []interface{}:
+			i, err := arrayIndex(tok, len(d)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("Can't look up %q in a non-container", tok)
+		}
+	}
+	return doc, nil
+}
+
+// Each of these returns the new version of 'doc' since arrays may need to
+// be replaced in their parent
+
+func pointerAdd(doc interface{}, tokens []string, val interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return val, nil
+	}
+	tok := tokens[0]
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		if len(tokens) == 1 {
+			d[tok] = val
+			return d, nil
+		}
+		child, ok := d[tok]
+		if !ok {
+			return nil, fmt.Errorf("%q not found", tok)
+		}
+		child, err := pointerAdd(child, tokens[1:], val)
+		d[tok] = child
+		return d, err
+
+	case []interface{}:
+		if len(tokens) == 1 {
+			if tok == "-" {
+				return append(d, val), nil
+			}
+			i, err := arrayIndex(tok, len(d))
+			if err != nil {
+				return nil, err
+			}
+			d = append(d, nil)
+			copy(d[i+1:], d[i:])
+			d[i] = val
+			return d, nil
+		}
+		i, err := arrayIndex(tok, len(d)-1)
+		if err != nil {
+			return nil, err
+		}
+		child, err := pointerAdd(d[i], tokens[1:], val)
+		d[i] = child
+		return d, err
+	}
+	return nil, fmt.Errorf("Can't add %q to a non-container", tok)
+}
+
+func pointerRemove(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("Can't remove the whole document")
+	}
+	tok := tokens[0]
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[tok]
+		if !ok {
+			return nil, fmt.Errorf("%q not found", tok)
+		}
+		if len(tokens) == 1 {
+			delete(d, tok)
+			return d, nil
+		}
+		child, err := pointerRemove(child, tokens[1:])
+		d[tok] = child
+		return d, err
+
+	case []interface{}:
+		i, err := arrayIndex(tok, len(d)-1)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens) == 1 {
+			return append(d[:i:i], d[i+1:]...), nil
+		}
+		child, err := pointerRemove(d[i], tokens[1:])
+		d[i] = child
+		return d, err
+	}
+	return nil, fmt.Errorf("Can't remove %q from a non-container", tok)
+}
+
+func applyPatchOp(doc interface{}, op patchOp) (interface{}, error) {
+	path, _ := parsePointer(op.Path)
+	from, _ := parsePointer(op.From)
+
+	switch op.Op {
+	case "add":
+		return pointerAdd(doc, path, copyValue(op.Value))
+
+	case "remove":
+		return pointerRemove(doc, path)
+
+	case "replace":
+		if _, err := pointerGet(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return copyValue(op.Value), nil
+		}
+		doc, err := pointerRemove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, copyValue(op.Value))
+
+	case "move", "copy":
+		val, err := pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, fmt.Errorf("Can't move %q into itself", op.From)
+			}
+			if doc, err = pointerRemove(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			val = copyValue(val)
+		}
+		return pointerAdd(doc, path, val)
+
+	case "test":
+		val, err := pointerGet(doc, path)
+		if err != nil || !equalValues(val, op.Value) {
+			return nil, &patchTestError{op.Path}
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("Unknown op %q", op.Op)
+}
+
+func applyPatch(body map[string]interface{}, ops []patchOp) (map[string]interface{}, error) {
+	var doc interface{} = copyValue(body)
+	var err error
+
+	for _, op := range ops {
+		if doc, err = applyPatchOp(doc, op); err != nil {
+			return nil, err
+		}
+	}
+
+	newBody, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("JSON Patch result isn't an object")
+	}
+	return newBody, nil
+}
+
+func patchTwiddler(ops []patchOp, rejectOnTestFail bool) tFunc {
+	return func(c *call, body map[string]interface{}) (map[string]interface{}, error) {
+		newBody, err := applyPatch(body, ops)
+		if err == nil {
+			log(3, "%d: Applied JSON Patch\n", c.id)
+			return newBody, nil
+		}
+
+		if _, ok := err.(*patchTestError); ok {
+			if rejectOnTestFail {
+				return nil, &httpError{http.StatusForbidden, err.Error()}
+			}
+			log(3, "%d: Skipping JSON Patch: %s\n", c.id, err)
+			return body, nil
+		}
+
+		log(0, "%d: Error applying JSON Patch, skipping it: %s\n", c.id, err)
+		return body, nil
+	}
+}
+
+func mergePatchTwiddler(patch map[string]interface{}) tFunc {
+	return func(c *call, body map[string]interface{}) (map[string]interface{}, error) {
+		log(3, "%d: Applying JSON Merge Patch\n", c.id)
+		return mergeValue(body, patch).(map[string]interface{}), nil
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParsePointer(t *testing.T) {
+	tests := []struct {
+		ptr    string
+		tokens []string // nil means it's bad
+	}{
+		{"", []string{}},
+		{"/", []string{""}},
+		{"/a/b", []string{"a", "b"}},
+		{"/a~1b/c~0d", []string{"a/b", "c~d"}},
+		{"/~01", []string{"~1"}},
+		{"a/b", nil},
+	}
+	for _, test := range tests {
+		tokens, err := parsePointer(test.ptr)
+		if (err == nil) != (test.tokens != nil) || !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("parsePointer(%q): expected %q, got %q %v", test.ptr, test.tokens,
+				tokens, err)
+		}
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	in := `{"a":{"b":1},"arr":[1,2,3],"big":12345678901234567890}`
+	tests := []struct {
+		name string
+		ops  []patchOp
+		want string // "" means it fails
+	}{
+		{"add", []patchOp{{Op: "add", Path: "/c", Value: "x"}},
+			`{"a":{"b":1},"arr":[1,2,3],"big":12345678901234567890,"c":"x"}`},
+		{"add nested", []patchOp{{Op: "add", Path: "/a/c", Value: true}},
+			`{"a":{"b":1,"c":true},"arr":[1,2,3],"big":12345678901234567890}`},
+		{"add replaces", []patchOp{{Op: "add", Path: "/a/b", Value: 2}},
+			`{"a":{"b":2},"arr":[1,2,3],"big":12345678901234567890}`},
+		{"insert", []patchOp{{Op: "add", Path: "/arr/1", Value: 9}},
+			`{"a":{"b":1},"arr":[1,9,2,3],"big":12345678901234567890}`},
+		{"insert at end", []patchOp{{Op: "add", Path: "/arr/3", Value: 9}},
+			`{"a":{"b":1},"arr":[1,2,3,9],"big":12345678901234567890}`},
+		{"append", []patchOp{{Op: "add", Path: "/arr/-", Value: 9}},
+			`{"a":{"b":1},"arr":[1,2,3,9],"big":12345678901234567890}`},
+		{"remove", []patchOp{{Op: "remove", Path: "/a/b"}, {Op: "remove", Path: "/arr/0"}},
+			`{"a":{},"arr":[2,3],"big":12345678901234567890}`},
+		{"replace", []patchOp{{Op: "replace", Path: "/arr/2", Value: "x"}},
+			`{"a":{"b":1},"arr":[1,2,"x"],"big":12345678901234567890}`},
+		{"move", []patchOp{{Op: "move", From: "/a/b", Path: "/b"}},
+			`{"a":{},"arr":[1,2,3],"big":12345678901234567890,"b":1}`},
+		{"move to itself", []patchOp{{Op: "move", From: "/a", Path: "/a"}}, in},
+		{"copy", []patchOp{{Op: "copy", From: "/a", Path: "/c"}, {Op: "add", Path: "/c/d", Value: 1}},
+			`{"a":{"b":1},"arr":[1,2,3],"big":12345678901234567890,"c":{"b":1,"d":1}}`},
+		{"test", []patchOp{{Op: "test", Path: "/big", Value: json.Number("12345678901234567890")},
+			{Op: "test", Path: "/a/b", Value: 1.0}, {Op: "remove", Path: "/big"}},
+			`{"a":{"b":1},"arr":[1,2,3]}`},
+		{"escaped", []patchOp{{Op: "add", Path: "/x~1y", Value: 1}},
+			`{"a":{"b":1},"arr":[1,2,3],"big":12345678901234567890,"x/y":1}`},
+
+		{"add missing parent", []patchOp{{Op: "add", Path: "/x/y", Value: 1}}, ""},
+		{"remove missing", []patchOp{{Op: "remove", Path: "/x"}}, ""},
+		{"remove whole doc", []patchOp{{Op: "remove", Path: ""}}, ""},
+		{"replace missing", []patchOp{{Op: "replace", Path: "/x", Value: 1}}, ""},
+		{"bad index", []patchOp{{Op: "add", Path: "/arr/4", Value: 1}}, ""},
+		{"leading zero", []patchOp{{Op: "remove", Path: "/arr/01"}}, ""},
+		{"negative index", []patchOp{{Op: "remove", Path: "/arr/-1"}}, ""},
+		{"move into itself", []patchOp{{Op: "move", From: "/a", Path: "/a/b/c"}}, ""},
+		{"not a container", []patchOp{{Op: "add", Path: "/big/x", Value: 1}}, ""},
+		{"not an object", []patchOp{{Op: "replace", Path: "", Value: []interface{}{}}}, ""},
+		{"test fails", []patchOp{{Op: "test", Path: "/big", Value: json.Number("12345678901234567891")}}, ""},
+		{"all or nothing", []patchOp{{Op: "remove", Path: "/a"}, {Op: "remove", Path: "/x"}}, ""},
+	}
+	for _, test := range tests {
+		body := map[string]interface{}{}
+		if err := decodeJSON([]byte(in), &body); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkPatch(test.ops); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		newBody, err := applyPatch(body, test.ops)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if buf, _ := encodeLike([]byte(in), newBody); string(buf) != test.want {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", test.name, test.want, buf)
+		}
+
+		// The original body is never changed
+		if buf, _ := encodeLike([]byte(in), body); string(buf) != in {
+			t.Errorf("%s: the original body changed: %s", test.name, buf)
+		}
+	}
+}
+
+func TestCheckPatch(t *testing.T) {
+	tests := []struct {
+		ops []patchOp
+		ok  bool
+	}{
+		{[]patchOp{{Op: "add", Path: "/a"}, {Op: "copy", From: "/a", Path: "/b"}}, true},
+		{[]patchOp{{Op: "frob", Path: "/a"}}, false},
+		{[]patchOp{{Op: "add", Path: "a"}}, false},
+		{[]patchOp{{Op: "move", From: "a", Path: "/b"}}, false},
+	}
+	for _, test := range tests {
+		if err := checkPatch(test.ops); (err == nil) != test.ok {
+			t.Errorf("checkPatch(%v): expected ok=%v, got %v", test.ops, test.ok, err)
+		}
+	}
+}
+
+func TestPatchTwiddler(t *testing.T) {
+	ops := []patchOp{{Op: "test", Path: "/a", Value: "x"}, {Op: "add", Path: "/b", Value: 1}}
+	for _, test := range []struct {
+		body   string
+		reject bool
+		want   string
+		code   int
+	}{
+		{`{"a":"x"}`, false, `{"a":"x","b":1}`, 0},
+		{`{"a":"y"}`, false, `{"a":"y"}`, 0},
+		{`{"a":"y"}`, true, "", http.StatusForbidden},
+		{`{}`, true, "", http.StatusForbidden},
+	} {
+		body := map[string]interface{}{}
+		if err := decodeJSON([]byte(test.body), &body); err != nil {
+			t.Fatal(err)
+		}
+		newBody, err := patchTwiddler(ops, test.reject)(&call{}, body)
+		if test.code != 0 {
+			if he, ok := err.(*httpError); !ok || he.code != test.code {
+				t.Errorf("%s: expected a %d, got %v", test.body, test.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.body, err)
+			continue
+		}
+		if buf, _ := encodeLike([]byte(test.body), newBody); string(buf) != test.want {
+			t.Errorf("%s: expected %s, got %s", test.body, test.want, buf)
+		}
+	}
+}
+
+// The examples from RFC 7386 appendix A
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, test := range tests {
+		body, patch := map[string]interface{}{}, map[string]interface{}{}
+		if err := decodeJSON([]byte(test.target), &body); err != nil {
+			t.Fatal(err)
+		}
+		if err := decodeJSON([]byte(test.patch), &patch); err != nil {
+			t.Fatal(err)
+		}
+		newBody, err := mergePatchTwiddler(patch)(&call{}, body)
+		if err != nil {
+			t.Fatalf("%s %s: %s", test.target, test.patch, err)
+		}
+		if buf, _ := encodeLike([]byte(test.target), newBody); string(buf) != test.want {
+			t.Errorf("%s + %s: expected %s, got %s", test.target, test.patch, test.want, buf)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A JSON path is a list of keys/indexes into the body, written as:
+//
+//	Labels.team
+//	Labels["com.example.team"]     (for keys that have dots in them)
+//	HostConfig.Binds[0]
+type pathElem struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+func (e pathElem) String() string {
+	if e.isIndex {
+		return fmt.Sprintf("[%d]", e.index)
+	}
+	return e.key
+}
+
+func parsePath(path string) ([]pathElem, error) {
+	elems := []pathElem{}
+	i := 0
+
+	for i < len(path) {
+		switch path[i] {
+		case '.':
+			if i == 0 || i+1 == len(path) || path[i+1] == '.' {
+				return nil, fmt.Errorf("Bad path %q: misplaced '.'", path)
+			}
+			i++
+
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("Bad path %q: missing ']'", path)
+			}
+			inner := path[i+1 : i+end]
+			i += end + 1
+
+			if len(inner) >= 2 && (inner[0] == '"' || inner[0] == '\'') {
+				if inner[len(inner)-1] != inner[0] {
+					return nil, fmt.Errorf("Bad path %q: unterminated quote", path)
+				}
+				elems = append(elems, pathElem{key: inner[1 : len(inner)-1]})
+				continue
+			}
+
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("Bad path %q: bad index %q", path, inner)
+			}
+			elems = append(elems, pathElem{index: index, isIndex: true})
+
+		default:
+			end := strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path) - i
+			}
+			elems = append(elems, pathElem{key: path[i : i+end]})
+			i += end
+		}
+	}
+
+	if len(elems) == 0 {
+		return nil, fmt.Errorf("Empty path")
+	}
+	return elems, nil
+}
+
+// Find the value at 'path'. The bool is false if any part of it is missing.
+func getPath(body interface{}, path []pathElem) (interface{}, bool) {
+	cur := body
+	for _, elem := range path {
+		if elem.isIndex {
+			arr, ok := cur.([]interface{})
+			if !ok || elem.index >= len(arr) {
+				return nil, false
+			}
+			cur = arr[elem.index]
+			continue
+		}
+
+		obj, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = obj[elem.key]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// Walk down to the parent of the last element of 'path', creating any
+// missing objects along the way. Arrays are never created or grown.
+func parentPath(body map[string]interface{}, path []pathElem) (interface{}, error) {
+	var cur interface{} = body
+	for i, elem := range path[:len(path)-1] {
+		if elem.isIndex {
+			arr, ok := cur.([]interface{})
+			if !ok || elem.index >= len(arr) {
+				return nil, fmt.Errorf("No array element at %q", joinPath(path[:i+1]))
+			}
+			cur = arr[elem.index]
+			continue
+		}
+
+		obj, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%q is not an object", joinPath(path[:i]))
+		}
+		next, ok := obj[elem.key]
+		if !ok || next == nil {
+			next = map[string]interface{}{}
+			obj[elem.key] = next
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+func setPath(body map[string]interface{}, path []pathElem, val interface{}) error {
+	parent, err := parentPath(body, path)
+	if err != nil {
+		return err
+	}
+
+	last := path[len(path)-1]
+	if last.isIndex {
+		arr, ok := parent.([]interface{})
+		if !ok || last.index >= len(arr) {
+			return fmt.Errorf("No array element at %q", joinPath(path))
+		}
+		arr[last.index] = val
+		return nil
+	}
+
+	obj, ok := parent.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%q is not an object", joinPath(path[:len(path)-1]))
+	}
+	obj[last.key] = val
+	return nil
+}
+
+// Remove the value at 'path'. Deleting something that isn't there is not
+// an error.
+func deletePath(body map[string]interface{}, path []pathElem) error {
+	var parent interface{} = body
+	if len(path) > 1 {
+		var ok bool
+		if parent, ok = getPath(body, path[:len(path)-1]); !ok {
+			return nil
+		}
+	}
+
+	last := path[len(path)-1]
+	if last.isIndex {
+		// Arrays have to be shrunk in their parent, so do it via setPath
+		arr, ok := parent.([]interface{})
+		if !ok || last.index >= len(arr) {
+			return nil
+		}
+		newArr := append(arr[:last.index:last.index], arr[last.index+1:]...)
+		return setPath(body, path[:len(path)-1], newArr)
+	}
+
+	if obj, ok := parent.(map[string]interface{}); ok {
+		delete(obj, last.key)
+	}
+	return nil
+}
+
+func joinPath(path []pathElem) string {
+	str := ""
+	for _, elem := range path {
+		switch {
+		case elem.isIndex:
+			str += elem.String()
+		case strings.ContainsAny(elem.key, ".[]"):
+			str += fmt.Sprintf("[%q]", elem.key)
+		case str == "":
+			str = elem.key
+		default:
+			str += "." + elem.key
+		}
+	}
+	return str
+}
+
+// Make a deep copy of a decoded JSON value so that each request gets its
+// own copy of any values we insert.
+func copyValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		newMap := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			newMap[k] = copyValue(item)
+		}
+		return newMap
+	case []interface{}:
+		newArr := make([]interface{}, len(v))
+		for i, item := range v {
+			newArr[i] = copyValue(item)
+		}
+		return newArr
+	}
+	return val
+}
+
+// RFC 7386 style merge - objects are merged recursively, a null deletes the
+// key and anything else replaces what was there.
+func mergeValue(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return copyValue(patch)
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+			continue
+		}
+		targetObj[k] = mergeValue(targetObj[k], v)
+	}
+	return targetObj
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+)
+
+func getPeerCred(conn net.Conn) (*peerCred, error) {
+	return nil, errNoPeerCred
+}
+
+func getGroups(pid int) []int {
+	return nil
+}
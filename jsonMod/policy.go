@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Return one of these from a twiddler or policy to reject the request with
+// a specific HTTP status code
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func denyf(format string, args ...interface{}) error {
+	return &httpError{http.StatusForbidden, fmt.Sprintf(format, args...)}
+}
+
+// A policy looks at the request's body and returns an error if the request
+// should be rejected. Policies don't modify the body.
+type pFunc func(*call, map[string]interface{}) error
+
+var policyPaths = struct {
+	privileged  []pathElem
+	networkMode []pathElem
+	binds       []pathElem
+	mounts      []pathElem
+}{
+	privileged:  mustParsePath("HostConfig.Privileged"),
+	networkMode: mustParsePath("HostConfig.NetworkMode"),
+	binds:       mustParsePath("HostConfig.Binds"),
+	mounts:      mustParsePath("HostConfig.Mounts"),
+}
+
+func mustParsePath(path string) []pathElem {
+	elems, err := parsePath(path)
+	if err != nil {
+		panic(err)
+	}
+	return elems
+}
+
+// The daemon decodes the body with encoding/json, which matches keys to
+// fields without caring about case, so "hostconfig.privileged" is the same
+// as "HostConfig.Privileged" to it and the policies have to look at both.
+// If there's more than one key that only differs by case we can't tell
+// which one the daemon will use, so the request is rejected.
+func lookupFold(obj map[string]interface{}, key string) (interface{}, bool, error) {
+	keys := []string{}
+	for k := range obj {
+		if strings.EqualFold(k, key) {
+			keys = append(keys, k)
+		}
+	}
+	switch len(keys) {
+	case 0:
+		return nil, false, nil
+	case 1:
+		return obj[keys[0]], true, nil
+	}
+	sort.Strings(keys)
+	return nil, false, &httpError{http.StatusBadRequest,
+		fmt.Sprintf("Body has more than one %q key: %s", key, strings.Join(keys, ", "))}
+}
+
+// Like getPath but the keys are found with lookupFold
+func getPathFold(body interface{}, path []pathElem) (interface{}, error) {
+	cur := body
+	for _, elem := range path {
+		if elem.isIndex {
+			arr, ok := cur.([]interface{})
+			if !ok || elem.index >= len(arr) {
+				return nil, nil
+			}
+			cur = arr[elem.index]
+			continue
+		}
+
+		obj, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		var err error
+		if cur, ok, err = lookupFold(obj, elem.key); !ok {
+			return nil, err
+		}
+	}
+	return cur, nil
+}
+
+// The built-in policies that a rule can name in its "policies" list
+var policies = map[string]pFunc{
+	"no-privileged":   noPrivileged,
+	"no-host-network": noHostNetwork,
+}
+
+func noPrivileged(c *call, body map[string]interface{}) error {
+	val, err := getPathFold(body, policyPaths.privileged)
+	if err != nil {
+		return err
+	}
+	if val == true {
+		return denyf("Privileged containers are not allowed")
+	}
+	return nil
+}
+
+func noHostNetwork(c *call, body map[string]interface{}) error {
+	val, err := getPathFold(body, policyPaths.networkMode)
+	if err != nil {
+		return err
+	}
+	if val == "host" {
+		return denyf("Host networking is not allowed")
+	}
+	return nil
+}
+
+// Only allow bind mounts of host paths that are under one of 'allowed'.
+// Named volumes are ok.
+func allowBinds(allowed []string) pFunc {
+	clean := []string{}
+	for _, dir := range allowed {
+		clean = append(clean, filepath.Clean(dir))
+	}
+
+	isAllowed := func(src string) bool {
+		src = filepath.Clean(src)
+		for _, dir := range clean {
+			if src == dir || dir == "/" || strings.HasPrefix(src, dir+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(c *call, body map[string]interface{}) error {
+		// "Binds" look like: src:dst[:options], and 'src' is only a host
+		// path if it starts with a "/"
+		list, err := getPathFold(body, policyPaths.binds)
+		if err != nil {
+			return err
+		}
+		binds, _ := list.([]interface{})
+		for _, bind := range binds {
+			str, _ := bind.(string)
+			src := strings.SplitN(str, ":", 2)[0]
+			if strings.HasPrefix(src, "/") && !isAllowed(src) {
+				return denyf("Bind mount of %q is not allowed", src)
+			}
+		}
+
+		if list, err = getPathFold(body, policyPaths.mounts); err != nil {
+			return err
+		}
+		mounts, _ := list.([]interface{})
+		for _, mount := range mounts {
+			obj, _ := mount.(map[string]interface{})
+			mountType, _, err := lookupFold(obj, "Type")
+			if err != nil {
+				return err
+			}
+			if mountType != "bind" {
+				continue
+			}
+			val, _, err := lookupFold(obj, "Source")
+			if err != nil {
+				return err
+			}
+			src, _ := val.(string)
+			if !isAllowed(src) {
+				return denyf("Bind mount of %q is not allowed", src)
+			}
+		}
+		return nil
+	}
+}
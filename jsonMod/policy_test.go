@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func checkPolicy(t *testing.T, name string, policy pFunc, body string, wantCode int) {
+	t.Helper()
+	obj := map[string]interface{}{}
+	if err := decodeJSON([]byte(body), &obj); err != nil {
+		t.Fatalf("%s: bad test body %s: %s", name, body, err)
+	}
+
+	code := 0
+	if err := policy(&call{}, obj); err != nil {
+		he, ok := err.(*httpError)
+		if !ok {
+			t.Fatalf("%s: %s: expected an httpError, got %T: %s", name, body, err, err)
+		}
+		code = he.code
+	}
+	if code != wantCode {
+		t.Errorf("%s: %s: expected %d, got %d", name, body, wantCode, code)
+	}
+}
+
+func TestNoPrivileged(t *testing.T) {
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{}`, 0},
+		{`{"HostConfig":null}`, 0},
+		{`{"HostConfig":{"Privileged":false}}`, 0},
+		{`{"HostConfig":{"Privileged":true}}`, http.StatusForbidden},
+		{`{"hostconfig":{"privileged":true}}`, http.StatusForbidden},
+		{`{"HOSTCONFIG":{"PrivilegeD":true}}`, http.StatusForbidden},
+		{`{"HostConfig":{"Privileged":false,"privileged":true}}`, http.StatusBadRequest},
+		{`{"HostConfig":{},"hostConfig":{"Privileged":true}}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		checkPolicy(t, "no-privileged", noPrivileged, test.body, test.code)
+	}
+}
+
+func TestNoHostNetwork(t *testing.T) {
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{}`, 0},
+		{`{"HostConfig":{"NetworkMode":"bridge"}}`, 0},
+		{`{"HostConfig":{"NetworkMode":"host"}}`, http.StatusForbidden},
+		{`{"hostconfig":{"networkmode":"host"}}`, http.StatusForbidden},
+		{`{"HostConfig":{"NetworkMode":"bridge","networkMode":"host"}}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		checkPolicy(t, "no-host-network", noHostNetwork, test.body, test.code)
+	}
+}
+
+func TestAllowBinds(t *testing.T) {
+	policy := allowBinds([]string{"/tmp", "/home/"})
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{}`, 0},
+		{`{"HostConfig":{"Binds":["/tmp:/x","/home/me/src:/src:ro","vol:/data"]}}`, 0},
+		{`{"HostConfig":{"Binds":["/etc:/x"]}}`, http.StatusForbidden},
+		{`{"HostConfig":{"Binds":["/tmp/../etc:/x"]}}`, http.StatusForbidden},
+		{`{"HostConfig":{"Binds":["/tmpx:/x"]}}`, http.StatusForbidden},
+		{`{"hostconfig":{"binds":["/etc:/x"]}}`, http.StatusForbidden},
+		{`{"HostConfig":{"Binds":[],"binds":["/etc:/x"]}}`, http.StatusBadRequest},
+
+		{`{"HostConfig":{"Mounts":[{"Type":"bind","Source":"/tmp/a","Target":"/a"}]}}`, 0},
+		{`{"HostConfig":{"Mounts":[{"Type":"volume","Source":"/etc","Target":"/a"}]}}`, 0},
+		{`{"HostConfig":{"Mounts":[{"Type":"bind","Source":"/etc","Target":"/a"}]}}`,
+			http.StatusForbidden},
+		{`{"hostconfig":{"mounts":[{"type":"bind","source":"/etc","target":"/a"}]}}`,
+			http.StatusForbidden},
+		{`{"HostConfig":{"Mounts":[{"Type":"bind","Source":"/tmp","source":"/etc"}]}}`,
+			http.StatusBadRequest},
+		{`{"HostConfig":{"Mounts":[{"Type":"volume","type":"bind","Source":"/etc"}]}}`,
+			http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		checkPolicy(t, "allowBinds", policy, test.body, test.code)
+	}
+}
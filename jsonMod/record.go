@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// With "-record" we write one of these, as a line of JSON, for each request
+// that passes thru us. It has the request as the client sent it, the body
+// we sent on to the daemon (if we changed it), the daemon's response, and
+// the body we sent back (if we changed it). "jsonMod replay" (see
+// replay.go) can then re-run the requests against new rules, or pretend to
+// be the daemon. Bodies are cut off at "-record-max-body" bytes.
+//
+// Credentials are never recorded: the values of headers like
+// X-Registry-Auth are replaced with "REDACTED", and the bodies of logins
+// and anything that carries a secret or config's data (see secretPaths)
+// are left out, both ways.
+type recordEntry struct {
+	Time    time.Time `json:"time"`
+	Conn    int       `json:"conn"`
+	Peer    *peerCred `json:"peer,omitempty"`
+	Remote  string    `json:"remote,omitempty"`
+	Mapping string    `json:"mapping,omitempty"`
+
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	SentURL  string      `json:"sentUrl,omitempty"`
+	Header   http.Header `json:"header"`
+	Body     recBody     `json:"body,omitempty"`
+	SentBody recBody     `json:"sentBody,omitempty"`
+
+	Status     int         `json:"status"`
+	Rejected   bool        `json:"rejected,omitempty"` // we answered, not the daemon
+	Hijacked   bool        `json:"hijacked,omitempty"`
+	RespHeader http.Header `json:"respHeader,omitempty"`
+	RespBody   recBody     `json:"respBody,omitempty"`
+	ClientBody recBody     `json:"clientBody,omitempty"`
+
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// A body is written as a string if it's text, otherwise as
+// { "base64": "..." }
+type recBody []byte
+
+func (b recBody) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(b) {
+		return json.Marshal(string(b))
+	}
+	return json.Marshal(map[string]string{"base64": base64.StdEncoding.EncodeToString(b)})
+}
+
+func (b *recBody) UnmarshalJSON(buf []byte) error {
+	var str string
+	if err := json.Unmarshal(buf, &str); err == nil {
+		*b = recBody(str)
+		return nil
+	}
+
+	encoded := map[string]string{}
+	if err := json.Unmarshal(buf, &encoded); err != nil {
+		return err
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded["base64"])
+	*b = recBody(data)
+	return err
+}
+
+var recordFile = ""
+var recordMaxBody = 64 << 10
+var recordLog *json.Encoder
+var recordMu sync.Mutex
+
+func openRecord(file string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	recordLog = json.NewEncoder(f)
+	return nil
+}
+
+// Keeps a copy of (the first 'recordMaxBody' bytes of) a body as it's read
+type capture struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (cp *capture) Write(data []byte) (int, error) {
+	if room := recordMaxBody - cp.buf.Len(); len(data) > room {
+		cp.buf.Write(data[:room])
+		cp.truncated = true
+	} else {
+		cp.buf.Write(data)
+	}
+	return len(data), nil
+}
+
+func (cp *capture) tee(body io.ReadCloser) io.ReadCloser {
+	if body == nil || body == http.NoBody {
+		return body
+	}
+	return &readCloser{io.TeeReader(body, cp), body}
+}
+
+// Headers that carry credentials
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "X-Registry-Auth",
+	"X-Registry-Config"}
+
+func redactHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range secretHeaders {
+		if _, ok := header[name]; ok {
+			header[name] = []string{"REDACTED"}
+		}
+	}
+	return header
+}
+
+// Requests whose bodies we don't record. Configs aren't meant to be
+// secret but people put passwords in them anyway.
+var secretPaths = []string{"/auth", "/secrets/create", "/secrets/{id}/update",
+	"/configs/create", "/configs/{id}/update"}
+
+func isSecretRequest(c *call) bool {
+	if c.req.Method != "POST" {
+		return false
+	}
+	for _, pattern := range secretPaths {
+		if _, ok := matchPath(pattern, c.path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// What we've captured so far for the request in a call
+type recording struct {
+	header   http.Header
+	noBody   bool    // it has credentials, don't record any of the bodies
+	body     capture // from the client
+	sentBody capture // to the daemon
+	respBody capture // from the daemon
+	outBody  capture // to the client
+}
+
+// Start recording a new request, before anything reads its body
+func recordRequest(c *call) {
+	if recordLog == nil {
+		return
+	}
+	c.rec = &recording{
+		header: redactHeader(c.req.Header),
+		noBody: isSecretRequest(c),
+	}
+	if !c.rec.noBody {
+		c.req.Body = c.rec.body.tee(c.req.Body)
+	}
+}
+
+// Just before the request is sent on to the daemon
+func recordSend(c *call) {
+	if c.rec != nil && !c.rec.noBody {
+		c.req.Body = c.rec.sentBody.tee(c.req.Body)
+	}
+}
+
+// Just after we get the daemon's response, and then again just before we
+// send it back to the client
+func recordResponse(c *call, resp *http.Response) {
+	if c.rec != nil && !c.rec.noBody {
+		resp.Body = c.rec.respBody.tee(resp.Body)
+	}
+}
+
+func recordReply(c *call, resp *http.Response) {
+	if c.rec != nil && !c.rec.noBody {
+		resp.Body = c.rec.outBody.tee(resp.Body)
+	}
+}
+
+// Write the record for the request in 'c'. 'resp' is nil if the daemon
+// wasn't involved, and 'status' is what was sent back to the client.
+func record(c *call, m *mapping, resp *http.Response, status int, err error) {
+	if c.rec == nil {
+		return
+	}
+	rec := c.rec
+
+	entry := recordEntry{
+		Time:     time.Now().UTC(),
+		Conn:     c.id,
+		Peer:     c.peer,
+		Remote:   c.remote,
+		Method:   c.req.Method,
+		URL:      c.req.RequestURI,
+		Header:   rec.header,
+		Body:     rec.body.buf.Bytes(),
+		Status:   status,
+		Rejected: resp == nil && status != 0,
+		Truncated: rec.body.truncated || rec.sentBody.truncated ||
+			rec.respBody.truncated || rec.outBody.truncated,
+	}
+	if m != nil {
+		entry.Mapping = m.name()
+	}
+	if sentURL := c.req.URL.RequestURI(); sentURL != c.req.RequestURI {
+		entry.SentURL = sentURL
+	}
+	if sent := rec.sentBody.buf.Bytes(); !bytes.Equal(sent, entry.Body) {
+		entry.SentBody = sent
+	}
+
+	if resp != nil {
+		entry.RespHeader = resp.Header
+		entry.Hijacked = isHijack(resp)
+		entry.RespBody = rec.respBody.buf.Bytes()
+		if out := rec.outBody.buf.Bytes(); !bytes.Equal(out, entry.RespBody) {
+			entry.ClientBody = out
+		}
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	if err := recordLog.Encode(entry); err != nil {
+		log(0, "%d: Error writing record: %s\n", c.id, err)
+	}
+}
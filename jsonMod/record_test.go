@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Record everything that goes thru a proxy with 'rules', returns a func
+// that waits for 'n' entries and returns them along with the raw file
+func startRecording(t *testing.T, rules []mapping) (string, func(n int) ([]recordEntry, string)) {
+	sock := startProxy(t, rules, "")
+
+	buf := &bytes.Buffer{}
+	recordMu.Lock()
+	recordLog = json.NewEncoder(buf)
+	recordMu.Unlock()
+	t.Cleanup(func() {
+		recordMu.Lock()
+		recordLog = nil
+		recordMu.Unlock()
+	})
+
+	wait := func(n int) ([]recordEntry, string) {
+		lines := waitForLines(t, &recordMu, buf, n)
+		entries := []recordEntry{}
+		for _, line := range lines {
+			entry := recordEntry{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("Bad entry %q: %s", line, err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries, strings.Join(lines, "\n")
+	}
+	return sock, wait
+}
+
+func TestRecord(t *testing.T) {
+	deny := ruleSpec{Verb: "POST", URL: "/containers/{id}/exec"}
+	sock, wait := startRecording(t, testRules(t, deny, labelRule))
+	tc := dialProxy(t, sock)
+
+	secret := "hunter2"
+	login := post("/auth", `{"username":"me","password":"`+secret+`"}`)
+	login = strings.Replace(login, "\r\n\r\n", "\r\nX-Registry-Auth: "+secret+"\r\n\r\n", 1)
+	tc.send(login +
+		post("/v1.41/secrets/create", `{"Name":"s","Data":"`+secret+`"}`) +
+		post("/configs/create", `{"Name":"c","Data":"`+secret+`"}`) +
+		post("/secrets/s/update?version=1", `{"Name":"s","Data":"`+secret+`"}`) +
+		post("/containers/create", `{}`) +
+		post("/containers/x/exec", `{"Cmd":["sh"]}`))
+	for i := 0; i < 5; i++ {
+		tc.readEcho()
+	}
+	tc.readError(http.StatusForbidden)
+
+	entries, raw := wait(6)
+	if strings.Contains(raw, secret) {
+		t.Errorf("The secret was recorded: %s", raw)
+	}
+	for _, entry := range entries[:4] {
+		if len(entry.Body) != 0 || len(entry.RespBody) != 0 || entry.Status != 200 {
+			t.Errorf("%s: expected a 200 without bodies, got %d %q %q", entry.URL,
+				entry.Status, entry.Body, entry.RespBody)
+		}
+	}
+	if auth := entries[0].Header.Get("X-Registry-Auth"); auth != "REDACTED" {
+		t.Errorf("Expected the header to be redacted, got %q", auth)
+	}
+
+	create := entries[4]
+	if string(create.Body) != `{}` || string(create.SentBody) != `{"Labels":{"proxied":"yes"}}` ||
+		create.Mapping != "POST /containers/create" || len(create.RespBody) == 0 {
+		t.Errorf("Expected the create and its rewrite, got %+v", create)
+	}
+
+	exec := entries[5]
+	if !exec.Rejected || exec.Status != http.StatusForbidden || exec.Error == "" {
+		t.Errorf("Expected the exec to be rejected, got %+v", exec)
+	}
+}
+
+func TestReplayEntry(t *testing.T) {
+	deny := ruleSpec{Verb: "POST", URL: "/containers/{id}/exec"}
+	rules := testRules(t, deny, labelRule)
+	sock, wait := startRecording(t, rules)
+	tc := dialProxy(t, sock)
+	tc.send(post("/containers/create", `{}`) + post("/containers/x/exec", `{}`))
+	tc.readEcho()
+	tc.readError(http.StatusForbidden)
+	entries, _ := wait(2)
+	create, exec := entries[0], entries[1]
+
+	// The same rules give the same results
+	for _, entry := range entries {
+		if diffs := replayEntry(1, entry, rules); len(diffs) != 0 {
+			t.Errorf("%s: expected no changes, got %q", entry.URL, diffs)
+		}
+	}
+
+	diffs := strings.Join(replayEntry(1, create, nil), "\n")
+	if !strings.Contains(diffs, `mapping: "POST /containers/create" -> "none"`) ||
+		!strings.Contains(diffs, "request ") {
+		t.Errorf("Expected the label to go away, got %q", diffs)
+	}
+	diffs = strings.Join(replayEntry(1, exec, nil), "\n")
+	if !strings.Contains(diffs, "no longer rejected (was 403") {
+		t.Errorf("Expected the exec to be allowed, got %q", diffs)
+	}
+
+	// Half a body isn't run thru the rules at all
+	create.Truncated = true
+	denyCreate := testRules(t, ruleSpec{Verb: "POST", URL: "/containers/create"})
+	diffs = strings.Join(replayEntry(1, create, denyCreate), "\n")
+	if diffs != "bodies were cut off when recorded, not comparing them" {
+		t.Errorf("Expected only the cut off note, got %q", diffs)
+	}
+}
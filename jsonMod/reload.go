@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The mappings can be swapped out from under us (SIGHUP or the rule file
+// changing), so all access to them needs to go thru these funcs. Each
+// connection grabs the list once so it finishes with the rules it started
+// with.
+var mappingsMu sync.RWMutex
+
+func currentMappings() []mapping {
+	mappingsMu.RLock()
+	defer mappingsMu.RUnlock()
+	return mappings
+}
+
+func setMappings(newMappings []mapping) {
+	mappingsMu.Lock()
+	defer mappingsMu.Unlock()
+	mappings = newMappings
+}
+
+// Load the rule file again. If its bad then we keep the old rules.
+func reloadRules() {
+	newMappings, err := loadRules(rulesFile)
+	if err != nil {
+		log(0, "Error reloading rules, keeping the old ones: %s\n", err)
+		return
+	}
+	setMappings(newMappings)
+	log(0, "Reloaded %d rule(s) from: %s\n", len(newMappings), rulesFile)
+}
+
+// Reload the rules on SIGHUP, and when the rule file's size/mtime changes
+// (checked every 'interval', zero means don't watch the file).
+func watchRules(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	lastInfo, _ := os.Stat(rulesFile)
+
+	for {
+		select {
+		case <-hup:
+			log(1, "Got SIGHUP\n")
+			lastInfo, _ = os.Stat(rulesFile)
+			reloadRules()
+
+		case <-tick:
+			info, err := os.Stat(rulesFile)
+			if err != nil {
+				// Probably in the middle of being replaced, try later
+				log(3, "Error checking rule file: %s\n", err)
+				continue
+			}
+			if lastInfo != nil && info.ModTime().Equal(lastInfo.ModTime()) &&
+				info.Size() == lastInfo.Size() {
+				continue
+			}
+			lastInfo = info
+			log(1, "Rule file changed\n")
+			reloadRules()
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadRules(t *testing.T) {
+	oldFile, oldMappings := rulesFile, currentMappings()
+	t.Cleanup(func() { rulesFile = oldFile; setMappings(oldMappings) })
+
+	rulesFile = filepath.Join(t.TempDir(), "rules.json")
+	write := func(str string) {
+		if err := ioutil.WriteFile(rulesFile, []byte(str), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"rules":[{"verb":"POST","url":"/containers/create"}]}`)
+	reloadRules()
+	if rules := currentMappings(); len(rules) != 1 || rules[0].url != "/containers/create" {
+		t.Fatalf("Expected the new rule, got %v", rules)
+	}
+
+	// Bad files, the rules we had stay
+	for _, str := range []string{
+		`{"rules":[`,
+		`{"rules":[{"verb":"POST"}]}`,
+		`{"rules":[{"verb":"POST","url":"/x","upstream":"nope"}]}`,
+	} {
+		write(str)
+		reloadRules()
+		if rules := currentMappings(); len(rules) != 1 || rules[0].url != "/containers/create" {
+			t.Errorf("%s: expected the old rule, got %v", str, rules)
+		}
+	}
+}
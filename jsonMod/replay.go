@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+)
+
+/*
+
+Replay:
+
+A capture made with "-record" can be used in two ways:
+
+  jsonMod replay -capture FILE [-rules FILE]
+
+Re-runs each request in the capture thru the rules (or the compiled-in
+mappings) without talking to a daemon, and shows how the result differs
+from what was recorded: requests that are now rejected (or no longer are),
+and changes to the body sent to the daemon or the response sent back. The
+exit code is 1 if anything changed, so it can be used as a regression test
+for a rule file. Rate and concurrency limits (see limit.go) are ignored.
+
+  jsonMod replay -capture FILE -serve ADDR
+
+Pretends to be the daemon, answering each request with the response that
+was recorded for the same verb and url (in the order they were recorded).
+Point a jsonMod's "-out" at it to test rules without a real daemon.
+
+*/
+
+func loadCapture(file string) ([]recordEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []recordEntry{}
+	dec := json.NewDecoder(f)
+	for {
+		entry := recordEntry{}
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Error parsing %q: %s", file, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func replayMain(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	captureFile := flags.String("capture", "", "File made with -record")
+	serveAddr := flags.String("serve", "",
+		"Answer requests on this address with the recorded responses")
+	flags.StringVar(&rulesFile, "rules", rulesFile, "Path to JSON rule file")
+	flags.IntVar(&verbose, "v", verbose, "Verbose/debugging level")
+	flags.Parse(args)
+
+	if *captureFile == "" {
+		fmt.Fprintf(os.Stderr, "Missing -capture\n")
+		return 2
+	}
+	entries, err := loadCapture(*captureFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+
+	if *serveAddr != "" {
+		if err := serveCapture(*serveAddr, entries); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 2
+		}
+		return 0
+	}
+
+	ignoreLimits = true
+
+	// Rules can refer to "-out", even though we won't connect to it
+	if err := setupUpstream(outSock); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+
+	if rulesFile != "" {
+		newMappings, err := loadRules(rulesFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading rules: %s\n", err)
+			return 2
+		}
+		setMappings(newMappings)
+	}
+
+	changed := 0
+	for i, entry := range entries {
+		diffs := replayEntry(i+1, entry, currentMappings())
+		if len(diffs) == 0 {
+			fmt.Printf("%d: %s %s: same\n", i+1, entry.Method, entry.URL)
+			continue
+		}
+		changed++
+		fmt.Printf("%d: %s %s: changed\n", i+1, entry.Method, entry.URL)
+		for _, diff := range diffs {
+			fmt.Printf("    %s\n", diff)
+		}
+	}
+
+	fmt.Printf("%d of %d request(s) changed\n", changed, len(entries))
+	if changed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Run one recorded request (and response) thru the rules and describe how
+// the results differ from what was recorded
+func replayEntry(id int, entry recordEntry, rules []mapping) []string {
+	reqURL, err := url.ParseRequestURI(entry.URL)
+	if err != nil {
+		return []string{fmt.Sprintf("Bad url: %s", err)}
+	}
+
+	req := &http.Request{
+		Method:        entry.Method,
+		URL:           reqURL,
+		RequestURI:    entry.URL,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        entry.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.Body)),
+		ContentLength: int64(len(entry.Body)),
+	}
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+
+	// Rules would see (and maybe reject) half a body
+	if entry.Truncated {
+		return []string{"bodies were cut off when recorded, not comparing them"}
+	}
+
+	c := &call{id: id, req: req, peer: entry.Peer, remote: entry.Remote}
+	c.version, c.path = splitVersion(req.URL.Path)
+	m := findMapping(rules, c)
+
+	diffs := []string{}
+	name := "none"
+	if m != nil {
+		name = m.name()
+	}
+	if name != entry.Mapping && !(m == nil && entry.Mapping == "") {
+		diffs = append(diffs, fmt.Sprintf("mapping: %q -> %q", entry.Mapping, name))
+	}
+
+	if m != nil {
+		if err := checkRequest(c, m); err != nil {
+			code := http.StatusInternalServerError
+			if he, ok := err.(*httpError); ok {
+				code = he.code
+			}
+			if !entry.Rejected || code != entry.Status || err.Error() != entry.Error {
+				diffs = append(diffs, fmt.Sprintf("now rejected (%d): %s", code, err))
+			}
+			return diffs
+		}
+	}
+	if entry.Rejected {
+		return append(diffs, fmt.Sprintf("no longer rejected (was %d: %s)",
+			entry.Status, entry.Error))
+	}
+	sentURL := entry.URL
+	if entry.SentURL != "" {
+		sentURL = entry.SentURL
+	}
+	if newURL := req.URL.RequestURI(); newURL != sentURL {
+		diffs = append(diffs, fmt.Sprintf("url: %q -> %q", sentURL, newURL))
+	}
+
+	sent, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return append(diffs, fmt.Sprintf("Error reading body: %s", err))
+	}
+	oldSent := entry.SentBody
+	if oldSent == nil {
+		oldSent = entry.Body
+	}
+	diffs = append(diffs, diffBodies("request", oldSent, sent)...)
+
+	if m == nil || m.respFn == nil || entry.RespHeader == nil || entry.Hijacked {
+		return diffs
+	}
+
+	resp := &http.Response{
+		StatusCode:    entry.Status,
+		Header:        entry.RespHeader,
+		Body:          ioutil.NopCloser(bytes.NewReader(entry.RespBody)),
+		ContentLength: int64(len(entry.RespBody)),
+		Request:       req,
+	}
+	if err := twiddleResponse(c, resp, m.respFn); err != nil {
+		return append(diffs, fmt.Sprintf("Error processing response: %s", err))
+	}
+	out, _ := ioutil.ReadAll(resp.Body)
+	oldOut := entry.ClientBody
+	if oldOut == nil {
+		oldOut = entry.RespBody
+	}
+	return append(diffs, diffBodies("response", oldOut, out)...)
+}
+
+func diffBodies(what string, old, new []byte) []string {
+	if bytes.Equal(old, new) {
+		return nil
+	}
+
+	var oldVal, newVal interface{}
+	if decodeJSON(old, &oldVal) != nil || decodeJSON(new, &newVal) != nil {
+		return []string{fmt.Sprintf("%s body: %d bytes -> %d bytes", what, len(old), len(new))}
+	}
+
+	diffs := []string{}
+	for _, d := range diffValues(oldVal, newVal) {
+		diffs = append(diffs, what+" "+d.String())
+	}
+	return diffs
+}
+
+// Answer requests with the responses from the capture
+func serveCapture(addr string, entries []recordEntry) error {
+	listener, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	defer removeSocket(addr)
+	log(0, "Serving %d recorded response(s) on: %s\n", len(entries), addr)
+
+	var mu sync.Mutex
+	used := make([]bool, len(entries))
+
+	// The first unused response recorded for the same verb and url
+	nextEntry := func(req *http.Request) *recordEntry {
+		mu.Lock()
+		defer mu.Unlock()
+		for i := range entries {
+			e := &entries[i]
+			sentURL := e.URL
+			if e.SentURL != "" {
+				sentURL = e.SentURL
+			}
+			if !used[i] && !e.Rejected && e.Status != 0 &&
+				e.Method == req.Method && sentURL == req.RequestURI {
+				used[i] = true
+				return e
+			}
+		}
+		return nil
+	}
+
+	for connID := 1; ; connID++ {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func(id int, conn net.Conn) {
+			defer conn.Close()
+			in := bufio.NewReader(conn)
+			for {
+				req, err := http.ReadRequest(in)
+				if err != nil {
+					return
+				}
+				io.Copy(ioutil.Discard, req.Body)
+
+				e := nextEntry(req)
+				if e == nil {
+					log(0, "%d: No recorded response for %s %s\n", id, req.Method, req.RequestURI)
+					if writeError(conn, http.StatusNotFound, "No recorded response for "+
+						req.Method+" "+req.RequestURI, false) != nil {
+						return
+					}
+					continue
+				}
+				log(1, "%d: %s %s -> %d\n", id, req.Method, req.RequestURI, e.Status)
+
+				resp := &http.Response{
+					Status:     strconv.Itoa(e.Status) + " " + http.StatusText(e.Status),
+					StatusCode: e.Status,
+					Proto:      "HTTP/1.1",
+					ProtoMajor: 1,
+					ProtoMinor: 1,
+					Header:     e.RespHeader,
+					Request:    req,
+				}
+				if e.Hijacked {
+					writeResponseHeader(conn, resp)
+					return
+				}
+				setResponseBody(resp, e.RespBody)
+				if resp.Write(conn) != nil || req.Close {
+					return
+				}
+			}
+		}(connID, conn)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// A response twiddler gets the parsed response (status and headers) and its
+// decoded JSON body. The body can be anything JSON allows (e.g. the list
+// from "GET /containers/json"), and the returned value is what's sent back
+// to the client.
+type rFunc func(*call, *http.Response, interface{}) interface{}
+
+// Let the twiddler modify the response's body, and then set it up as the
+// response's new body. Anything that isn't a successful JSON response is
+// left as-is.
+func twiddleResponse(c *call, resp *http.Response, twiddler rFunc) error {
+	if resp.StatusCode/100 != 2 || !isJSON(resp.Header.Get("Content-Type")) {
+		log(3, "%d: Not a JSON response, passing it thru\n", c.id)
+		return nil
+	}
+
+	// Note: this also takes care of any chunked encoding
+	buf, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	var body interface{}
+	if err := decodeJSON(buf, &body); err != nil {
+		log(0, "%d: Error parsing response body, passing it thru: %s\n", c.id, err)
+		metrics.parseErrors.inc("response_body")
+	} else {
+		body = twiddler(c, resp, body)
+
+		newBuf, err := encodeLike(buf, body)
+		if err != nil {
+			log(0, "%d: Error encoding new response body: %s\n", c.id, err)
+		} else {
+			buf = newBuf
+		}
+		log(5, "%d: Response body: %s\n", c.id, string(buf))
+	}
+
+	setResponseBody(resp, buf)
+	return nil
+}
+
+func isJSON(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	return strings.EqualFold(mediaType, "application/json")
+}
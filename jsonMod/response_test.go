@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTwiddleResponse(t *testing.T) {
+	tests := []struct {
+		raw  string
+		body string
+	}{
+		{"HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 7\r\n\r\n{\"a\":1}",
+			`{"a":1,"b":2}`},
+		{"HTTP/1.1 201 Created\r\nContent-Type: application/json; charset=utf-8\r\n" +
+			"Transfer-Encoding: chunked\r\n\r\n7\r\n{\"a\":1}\r\n0\r\nX-T: 1\r\n\r\n",
+			`{"a":1,"b":2}`},
+		{"HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 5\r\n\r\n[1,2]",
+			`[1,2]`},
+
+		// Left alone
+		{"HTTP/1.1 404 Not Found\r\nContent-Type: application/json\r\nContent-Length: 7\r\n\r\n{\"a\":1}",
+			`{"a":1}`},
+		{"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 7\r\n\r\n{\"a\":1}",
+			`{"a":1}`},
+		{"HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 4\r\n\r\n{\"a\"",
+			`{"a"`},
+	}
+
+	twiddler := func(c *call, resp *http.Response, body interface{}) interface{} {
+		if obj, ok := body.(map[string]interface{}); ok {
+			obj["b"] = 2
+		}
+		return body
+	}
+
+	for _, test := range tests {
+		resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(test.raw)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := twiddleResponse(&call{}, resp, twiddler); err != nil {
+			t.Errorf("%q: %s", test.raw, err)
+			continue
+		}
+
+		// What the client gets has to be framed right
+		buf := &bytes.Buffer{}
+		resp.Write(buf)
+		newResp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(newResp.Body)
+		if string(body) != test.body || buf.Len() != 0 {
+			t.Errorf("%q: expected %s, got %s (%d left over)", test.raw, test.body, body,
+				buf.Len())
+		}
+	}
+}
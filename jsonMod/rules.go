@@ -0,0 +1,528 @@
+package main
+
+/*
+
+Rule files:
+
+Instead of compiling a twiddler into jsonMod you can describe the mappings
+in a JSON file and point to it with "-rules". For example:
+
+{
+  "rules": [
+    { "verb": "POST",
+      "url": "/containers/create",
+      "ops": [
+        { "op": "set", "path": "Labels[\"com.example.team\"]", "value": "blue" },
+        { "op": "delete", "path": "HostConfig.CapAdd" },
+        { "op": "merge", "path": "HostConfig", "value": { "ReadonlyRootfs": true } },
+        { "op": "append", "path": "Env", "value": "TEAM=blue" }
+      ],
+      "policies": [ "no-privileged", "no-host-network" ],
+      "allowBinds": [ "/home", "/tmp" ]
+    },
+    { "verb": "DELETE",
+      "url": "/images/{name*}",
+      "deny": "Removing images is not allowed on this host"
+    },
+    { "verb": "GET",
+      "url": "/containers/json",
+      "response": {
+        "filter": [ { "path": "Labels.tenant", "equals": "blue" } ],
+        "ops": [ { "op": "delete", "path": "Labels.secret" } ]
+      }
+    }
+  ]
+}
+
+Each rule becomes one entry in the mappings list, in the same order as in
+the file, and the first one that matches a request is used. The "url" is
+a path pattern (see match.go) that's matched without the API version
+prefix. A rule can be limited to certain API versions with "minVersion"
+and "maxVersion" (e.g. "1.41"), and to requests with certain query params
+with "query" (e.g. { "force": "1" }, or "*" to match any value).
+
+A rule with a "deny" message rejects the request with a 403 and that
+message. A rule with nothing else to do (no "ops", "exprs", "patch",
+"mergePatch", "inject", "external", "build", "images", "response",
+"upstream", limits or policies) is also rejected, just like a mapping with
+no funcs. If a rule has more than one of "images" (see mirror.go), "ops",
+"exprs" (see expr.go), "patch", "mergePatch" (see patch.go), "inject" (see
+inject.go) and "external" (see external.go) they're done in that order.
+If any of the "ops" fails (e.g. an "append" to something that isn't an
+array) the request is rejected rather than sent along half changed.
+
+A rule only looks at bodies with the "contentType" it expects, which is
+"application/json" unless it says otherwise, and anything else is passed
+thru untouched (e.g. a multipart upload). A body without a Content-Type is
+assumed to be the right type. "build" rules (see build.go) look at the tar
+build context of a "POST /build" instead of JSON, and check any type unless
+"contentType" is set.
+
+"policies" is a list of built-in checks (see policy.go) that are run before
+any "ops", and if one fails the request is rejected with a 403. Setting
+"allowBinds" only allows bind mounts of host paths under those directories.
+
+When listening on a unix socket a rule can also be limited to certain
+callers with "uids" and "gids" (the caller must have one of them), and
+"exceptUids" and "exceptGids" (the caller must have none of them). Groups
+include the caller's supplementary groups. An op can take its value from
+the caller with "from" - one of "caller.uid", "caller.gid", "caller.pid"
+or "caller.user". For example, to stamp the owner on each new container
+and only let root remove containers:
+
+    { "verb": "POST", "url": "/containers/create",
+      "ops": [ { "op": "set", "path": "Labels.owner", "from": "caller.user" } ] },
+    { "verb": "DELETE", "url": "/containers/{id}", "exceptUids": [ 0 ],
+      "deny": "Only root can remove containers" }
+
+On a tcp:// or tls:// listener we don't know who the caller is, so no one
+is let off by "exceptUids" or "exceptGids", and "uids" and "gids" only
+match on a deny rule (so the rule above denies everyone).
+
+The "response" ops are applied to the JSON that comes back, or to each item
+in it if it's a list. "filter" only applies to lists and drops any item that
+doesn't match all of the conditions. A condition with no "equals" just
+checks that the path exists. If one of the "response" ops fails on an item
+then it's sent back the way the daemon sent it.
+
+A rule's "mode" can be "enforce" (the default), "shadow" or "off". A shadow
+rule only logs (and audits) what it would have changed or rejected, and the
+request and response are sent along untouched. See shadow.go.
+
+A body that a rule changed is checked against the Engine API's schema for
+that endpoint before it's sent, unless the rule has "validate": false. See
+schema.go.
+
+A rule can send its requests to another daemon with "upstream", see
+upstream.go. A "verb" of "*" matches any verb.
+
+"rateLimit" and "maxConcurrent" limit how often, and how many at once, the
+rule's requests can be made, see limit.go.
+
+The rule file is reloaded on SIGHUP or when it changes (see "-watch"). If
+the new file has an error then it's logged and the old rules stay active.
+Connections that are already open keep using the rules they started with.
+
+*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+type ruleFile struct {
+	Upstreams map[string]upstreamSpec `json:"upstreams"`
+	Rules     []ruleSpec              `json:"rules"`
+}
+
+type ruleSpec struct {
+	Verb     string        `json:"verb"`
+	URL      string        `json:"url"`
+	Ops      []opSpec      `json:"ops"`
+	Exprs    []string      `json:"exprs"`
+	Patch    []patchOp     `json:"patch"`
+	Merge    interface{}   `json:"mergePatch"`
+	TestFail string        `json:"onTestFail"`
+	Response *responseSpec `json:"response"`
+	External *externalSpec `json:"external"`
+	Inject   *injectSpec   `json:"inject"`
+	Images   *imagesSpec   `json:"images"`
+	Build    *buildSpec    `json:"build"`
+
+	ContentType string `json:"contentType"`
+	Mode        string `json:"mode"`
+	Validate    *bool  `json:"validate"`
+
+	Upstream string `json:"upstream"`
+
+	RateLimit     *rateLimitSpec   `json:"rateLimit"`
+	MaxConcurrent *concurrencySpec `json:"maxConcurrent"`
+
+	Deny       string   `json:"deny"`
+	Policies   []string `json:"policies"`
+	AllowBinds []string `json:"allowBinds"`
+
+	UIDs       []int `json:"uids"`
+	GIDs       []int `json:"gids"`
+	ExceptUIDs []int `json:"exceptUids"`
+	ExceptGIDs []int `json:"exceptGids"`
+
+	MinVersion string            `json:"minVersion"`
+	MaxVersion string            `json:"maxVersion"`
+	Query      map[string]string `json:"query"`
+}
+
+type responseSpec struct {
+	Ops    []opSpec     `json:"ops"`
+	Filter []filterSpec `json:"filter"`
+}
+
+type filterSpec struct {
+	Path   string      `json:"path"`
+	Equals interface{} `json:"equals"`
+}
+
+type opSpec struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+	From  string      `json:"from"`
+}
+
+type bodyOp struct {
+	op    string
+	path  []pathElem
+	value interface{}
+	from  string
+}
+
+type bodyFilter struct {
+	path   []pathElem
+	equals interface{}
+}
+
+func loadRules(file string) ([]mapping, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	rf := ruleFile{}
+	if err := decodeJSON(buf, &rf); err != nil {
+		return nil, fmt.Errorf("Error parsing %q: %s", file, err)
+	}
+
+	upstreams, err := compileUpstreams(rf.Upstreams)
+	if err != nil {
+		return nil, fmt.Errorf("Error in %q: %s", file, err)
+	}
+
+	newMappings := []mapping{}
+	for i, rule := range rf.Rules {
+		m, err := compileRule(rule, upstreams)
+		if err != nil {
+			return nil, fmt.Errorf("Rule #%d in %q: %s", i+1, file, err)
+		}
+		newMappings = append(newMappings, m)
+	}
+	return newMappings, nil
+}
+
+func compileRule(rule ruleSpec, upstreams map[string]*upstream) (mapping, error) {
+	if rule.Verb == "" || rule.URL == "" {
+		return mapping{}, fmt.Errorf("Missing \"verb\" or \"url\"")
+	}
+	if err := checkPattern(rule.URL); err != nil {
+		return mapping{}, err
+	}
+	for _, version := range []string{rule.MinVersion, rule.MaxVersion} {
+		if version != "" && !isVersion(version) {
+			return mapping{}, fmt.Errorf("Bad API version %q", version)
+		}
+	}
+
+	ops, err := compileOps(rule.Ops)
+	if err != nil {
+		return mapping{}, err
+	}
+
+	m := mapping{
+		verb:       rule.Verb,
+		url:        rule.URL,
+		deny:       rule.Deny,
+		uids:       rule.UIDs,
+		gids:       rule.GIDs,
+		exceptUIDs: rule.ExceptUIDs,
+		exceptGIDs: rule.ExceptGIDs,
+		minVersion: rule.MinVersion,
+		maxVersion: rule.MaxVersion,
+		query:      rule.Query,
+
+		contentType: rule.ContentType,
+		build:       rule.Build,
+		mode:        rule.Mode,
+
+		skipValidate: rule.Validate != nil && !*rule.Validate,
+	}
+	if err := checkMode(rule.Mode); err != nil {
+		return mapping{}, err
+	}
+
+	if rule.Upstream != "" {
+		var ok bool
+		if m.upstream, ok = upstreams[rule.Upstream]; !ok {
+			return mapping{}, fmt.Errorf("Unknown upstream %q", rule.Upstream)
+		}
+	}
+	if m.rateLimit, err = compileRateLimit(rule.RateLimit); err != nil {
+		return mapping{}, err
+	}
+	if m.concurrency, err = compileConcurrency(rule.MaxConcurrent); err != nil {
+		return mapping{}, err
+	}
+	for _, name := range rule.Policies {
+		policy, ok := policies[name]
+		if !ok {
+			return mapping{}, fmt.Errorf("Unknown policy %q", name)
+		}
+		m.policies = append(m.policies, policy)
+	}
+	if rule.AllowBinds != nil {
+		m.policies = append(m.policies, allowBinds(rule.AllowBinds))
+	}
+
+	fns := []tFunc{}
+	if rule.Images != nil {
+		ir, err := compileImages(rule.Images)
+		if err != nil {
+			return mapping{}, err
+		}
+		switch {
+		case rule.Verb == "POST" && rule.URL == "/images/create":
+			m.pullImages = ir
+		case rule.Verb == "POST" && rule.URL == "/containers/create":
+			fns = append(fns, createTwiddler(ir.rewriteCreate))
+		case rule.Verb == "POST" && rule.URL == "/build":
+			m.buildImages = ir
+		default:
+			return mapping{}, fmt.Errorf("\"images\" only works on \"POST /images/create\", " +
+				"\"POST /containers/create\" or \"POST /build\"")
+		}
+	}
+	if len(ops) > 0 {
+		fns = append(fns, opsTwiddler(ops))
+	}
+	if len(rule.Exprs) > 0 {
+		stmts := []exprStmt{}
+		for _, text := range rule.Exprs {
+			stmt, err := compileExpr(text)
+			if err != nil {
+				return mapping{}, err
+			}
+			stmts = append(stmts, stmt)
+		}
+		fns = append(fns, exprTwiddler(stmts))
+	}
+	if len(rule.Patch) > 0 {
+		if err := checkPatch(rule.Patch); err != nil {
+			return mapping{}, err
+		}
+		if rule.TestFail != "" && rule.TestFail != "skip" && rule.TestFail != "reject" {
+			return mapping{}, fmt.Errorf("\"onTestFail\" must be \"skip\" or \"reject\"")
+		}
+		fns = append(fns, patchTwiddler(rule.Patch, rule.TestFail == "reject"))
+	}
+	if rule.Merge != nil {
+		patch, ok := rule.Merge.(map[string]interface{})
+		if !ok {
+			return mapping{}, fmt.Errorf("\"mergePatch\" must be an object")
+		}
+		fns = append(fns, mergePatchTwiddler(patch))
+	}
+	if rule.Inject != nil {
+		if rule.Verb != "POST" || rule.URL != "/containers/create" {
+			return mapping{}, fmt.Errorf("\"inject\" only works on \"POST /containers/create\"")
+		}
+		fn, err := compileInject(rule.Inject)
+		if err != nil {
+			return mapping{}, err
+		}
+		fns = append(fns, fn)
+	}
+	if rule.External != nil {
+		fn, err := compileExternal(rule.External)
+		if err != nil {
+			return mapping{}, err
+		}
+		fns = append(fns, fn)
+	}
+	m.fn = chainTwiddlers(fns)
+
+	if m.build != nil && (m.fn != nil || len(m.policies) > 0) {
+		return mapping{}, fmt.Errorf("\"build\" can't be used with JSON body changes or policies")
+	}
+
+	if rule.Response != nil {
+		respOps, err := compileOps(rule.Response.Ops)
+		if err != nil {
+			return mapping{}, err
+		}
+
+		filters, err := compileFilters(rule.Response.Filter)
+		if err != nil {
+			return mapping{}, err
+		}
+
+		m.respFn = responseTwiddler(respOps, filters)
+	}
+	return m, nil
+}
+
+func compileFilters(specs []filterSpec) ([]bodyFilter, error) {
+	filters := []bodyFilter{}
+	for _, spec := range specs {
+		path, err := parsePath(spec.Path)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, bodyFilter{path: path, equals: spec.Equals})
+	}
+	return filters, nil
+}
+
+func compileOps(specs []opSpec) ([]bodyOp, error) {
+	ops := []bodyOp{}
+	for _, spec := range specs {
+		path, err := parsePath(spec.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		switch spec.Op {
+		case "set", "merge", "append":
+			if spec.Value == nil && spec.From == "" && spec.Op != "set" {
+				return nil, fmt.Errorf("%q needs a \"value\"", spec.Op)
+			}
+			if spec.From != "" && !isCallerValue(spec.From) {
+				return nil, fmt.Errorf("Unknown \"from\" value %q", spec.From)
+			}
+		case "delete":
+		default:
+			return nil, fmt.Errorf("Unknown op %q", spec.Op)
+		}
+
+		ops = append(ops, bodyOp{op: spec.Op, path: path, value: spec.Value,
+			from: spec.From})
+	}
+	return ops, nil
+}
+
+// Run each twiddler in order, stopping at the first error
+func chainTwiddlers(fns []tFunc) tFunc {
+	switch len(fns) {
+	case 0:
+		return nil
+	case 1:
+		return fns[0]
+	}
+
+	return func(c *call, body map[string]interface{}) (map[string]interface{}, error) {
+		var err error
+		for _, fn := range fns {
+			if body, err = fn(c, body); err != nil {
+				return nil, err
+			}
+		}
+		return body, nil
+	}
+}
+
+// Turn the list of ops into a twiddler that runs each one in order. If one
+// of them fails the request is rejected rather than sent along half done.
+func opsTwiddler(ops []bodyOp) tFunc {
+	return func(c *call, body map[string]interface{}) (map[string]interface{}, error) {
+		return runOps(c, body, ops)
+	}
+}
+
+// Drop any list items that don't match the filters, then run the ops on
+// each item that's left (or on the body itself if it's not a list)
+func responseTwiddler(ops []bodyOp, filters []bodyFilter) rFunc {
+	return func(c *call, resp *http.Response, body interface{}) interface{} {
+		list, ok := body.([]interface{})
+		if !ok {
+			return responseOps(c, body, ops)
+		}
+
+		newList := []interface{}{}
+		for _, item := range list {
+			if !matchFilters(item, filters) {
+				continue
+			}
+			newList = append(newList, responseOps(c, item, ops))
+		}
+		log(3, "%d: Filtered response list from %d to %d item(s)\n", c.id,
+			len(list), len(newList))
+		return newList
+	}
+}
+
+func matchFilters(item interface{}, filters []bodyFilter) bool {
+	for _, filter := range filters {
+		val, ok := getPath(item, filter.path)
+		if !ok {
+			return false
+		}
+		if filter.equals != nil && !equalValues(val, filter.equals) {
+			return false
+		}
+	}
+	return true
+}
+
+// Run the ops on a copy of 'body' and return it, or the error from the
+// first one that failed
+func runOps(c *call, body map[string]interface{}, ops []bodyOp) (map[string]interface{}, error) {
+	if len(ops) == 0 {
+		return body, nil
+	}
+	newBody := copyValue(body).(map[string]interface{})
+	for _, op := range ops {
+		if err := applyOp(c, newBody, op); err != nil {
+			return nil, fmt.Errorf("Error applying %q to %q: %s", op.op,
+				joinPath(op.path), err)
+		}
+		log(3, "%d: Applied %q to %q\n", c.id, op.op, joinPath(op.path))
+	}
+	return newBody, nil
+}
+
+// The ops for a response (or an item in it). If they fail it's sent back
+// the way the daemon sent it.
+func responseOps(c *call, item interface{}, ops []bodyOp) interface{} {
+	obj, ok := item.(map[string]interface{})
+	if !ok {
+		return item
+	}
+	newObj, err := runOps(c, obj, ops)
+	if err != nil {
+		log(0, "%d: %s, leaving the response alone\n", c.id, err)
+		return item
+	}
+	return newObj
+}
+
+func applyOp(c *call, body map[string]interface{}, op bodyOp) error {
+	if op.from != "" {
+		val, err := callerValue(c, op.from)
+		if err != nil {
+			return err
+		}
+		op.value = val
+	}
+
+	switch op.op {
+	case "set":
+		return setPath(body, op.path, copyValue(op.value))
+
+	case "delete":
+		return deletePath(body, op.path)
+
+	case "merge":
+		old, _ := getPath(body, op.path)
+		return setPath(body, op.path, mergeValue(old, op.value))
+
+	case "append":
+		old, ok := getPath(body, op.path)
+		if !ok || old == nil {
+			old = []interface{}{}
+		}
+		arr, ok := old.([]interface{})
+		if !ok {
+			return fmt.Errorf("Not an array")
+		}
+		return setPath(body, op.path, append(arr, copyValue(op.value)))
+	}
+	return fmt.Errorf("Unknown op %q", op.op)
+}
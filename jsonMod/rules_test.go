@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadRules(t *testing.T) {
+	tests := []struct {
+		rules string
+		err   string // part of the error, "" if it should load
+	}{
+		{`{"rules":[
+			{"verb":"POST","url":"/containers/create",
+			 "ops":[{"op":"set","path":"Labels[\"a.b\"]","value":"x"},
+			        {"op":"delete","path":"HostConfig.CapAdd"},
+			        {"op":"merge","path":"HostConfig","value":{"ReadonlyRootfs":true}},
+			        {"op":"append","path":"Env","value":"A=1"}]},
+			{"verb":"DELETE","url":"/images/{name*}","deny":"no"},
+			{"verb":"GET","url":"/containers/json",
+			 "response":{"ops":[{"op":"delete","path":"Labels.secret"}]}}]}`, ""},
+		{`{"rules":[{"verb":"POST","url":"/x","ops":[{"op":"move","path":"a"}]}]}`,
+			`Rule #1 in`},
+		{`{"rules":[{"verb":"POST","url":"/x","ops":[{"op":"append","path":"a"}]}]}`,
+			`"append" needs a "value"`},
+		{`{"rules":[{"verb":"POST","url":"/x","ops":[{"op":"set","path":"a","from":"x"}]}]}`,
+			`Unknown "from" value`},
+		{`{"rules":[{"verb":"POST","url":"/x","policies":["nope"]}]}`, `Unknown policy`},
+		{`{"rules":[{"url":"/x"}]}`, `Missing "verb" or "url"`},
+		{`rules:\n  - verb: POST`, `Error parsing`},
+	}
+
+	dir := t.TempDir()
+	for i, test := range tests {
+		file := filepath.Join(dir, "rules.json")
+		if err := ioutil.WriteFile(file, []byte(test.rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rules, err := loadRules(file)
+		if test.err == "" {
+			if err != nil || len(rules) != 3 {
+				t.Errorf("%d: expected 3 rules, got %d %v", i, len(rules), err)
+				continue
+			}
+			if !rules[1].isDeny() || rules[0].fn == nil || rules[2].respFn == nil {
+				t.Errorf("%d: rules weren't compiled right", i)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%d: expected an error with %q, got %v", i, test.err, err)
+		}
+	}
+
+	if _, err := loadRules(filepath.Join(dir, "none.json")); err == nil {
+		t.Errorf("Expected a missing file to fail")
+	}
+}
+
+func compileTestOps(t *testing.T, specs string) []bodyOp {
+	t.Helper()
+	opSpecs := []opSpec{}
+	if err := decodeJSON([]byte(specs), &opSpecs); err != nil {
+		t.Fatal(err)
+	}
+	ops, err := compileOps(opSpecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ops
+}
+
+func TestOpsTwiddler(t *testing.T) {
+	tests := []struct {
+		ops  string
+		body string
+		want string // "" if it should fail
+	}{
+		{`[{"op":"set","path":"Labels.a","value":"x"}]`, `{}`, `{"Labels":{"a":"x"}}`},
+		{`[{"op":"set","path":"Labels[\"a.b\"]","value":1}]`, `{"Labels":{"c":"d"}}`,
+			`{"Labels":{"a.b":1,"c":"d"}}`},
+		{`[{"op":"delete","path":"HostConfig.CapAdd"},{"op":"delete","path":"Nope.x"}]`,
+			`{"HostConfig":{"CapAdd":["ALL"],"Memory":1}}`, `{"HostConfig":{"Memory":1}}`},
+		{`[{"op":"merge","path":"HostConfig","value":{"ReadonlyRootfs":true}}]`,
+			`{"HostConfig":{"Memory":1}}`, `{"HostConfig":{"Memory":1,"ReadonlyRootfs":true}}`},
+		{`[{"op":"append","path":"Env","value":"A=1"}]`, `{"Env":["B=2"]}`,
+			`{"Env":["B=2","A=1"]}`},
+		{`[{"op":"append","path":"Env","value":"A=1"}]`, `{"Env":null}`, `{"Env":["A=1"]}`},
+
+		// Nothing is changed if any op fails
+		{`[{"op":"set","path":"Labels.a","value":"x"},{"op":"append","path":"Env","value":"A=1"}]`,
+			`{"Env":"B=2"}`, ""},
+		{`[{"op":"set","path":"HostConfig.Privileged","value":false}]`,
+			`{"HostConfig":"host"}`, ""},
+	}
+
+	for i, test := range tests {
+		body := map[string]interface{}{}
+		if err := decodeJSON([]byte(test.body), &body); err != nil {
+			t.Fatal(err)
+		}
+		orig := copyValue(body)
+
+		newBody, err := opsTwiddler(compileTestOps(t, test.ops))(&call{}, body)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%d: expected an error, got %v", i, newBody)
+			}
+			if !equalValues(orig, body) {
+				t.Errorf("%d: the body was changed: %v", i, body)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+		if buf, _ := json.Marshal(newBody); string(buf) != test.want {
+			t.Errorf("%d: expected %s, got %s", i, test.want, buf)
+		}
+	}
+}
+
+func TestResponseTwiddler(t *testing.T) {
+	fn := responseTwiddler(compileTestOps(t, `[{"op":"delete","path":"Labels.secret"},
+		{"op":"set","path":"Labels.seen","value":"yes"}]`),
+		[]bodyFilter{{path: mustParsePath("Labels.tenant"), equals: "blue"}})
+
+	var body interface{}
+	decodeJSON([]byte(`[
+		{"Id":"1","Labels":{"tenant":"blue","secret":"x"}},
+		{"Id":"2","Labels":{"tenant":"red"}},
+		{"Id":"3","Labels":{"tenant":"blue","seen":{"a":1}}}]`), &body)
+
+	// Items that don't match the filter are gone, and "set" replaces
+	// whatever was there
+	buf, _ := json.Marshal(fn(&call{}, &http.Response{}, body))
+	want := `[{"Id":"1","Labels":{"seen":"yes","tenant":"blue"}},` +
+		`{"Id":"3","Labels":{"seen":"yes","tenant":"blue"}}]`
+	if string(buf) != want {
+		t.Errorf("Expected %s, got %s", want, buf)
+	}
+
+	// An op that fails leaves the object the way it was
+	fn = responseTwiddler(compileTestOps(t, `[{"op":"delete","path":"Labels.secret"},
+		{"op":"append","path":"Labels","value":"x"}]`), nil)
+	decodeJSON([]byte(`{"Labels":{"secret":"x"}}`), &body)
+	if buf, _ := json.Marshal(fn(&call{}, &http.Response{}, body)); string(buf) !=
+		`{"Labels":{"secret":"x"}}` {
+		t.Errorf("Expected the response to be left alone, got %s", buf)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/*
+
+Schema validation:
+
+After a mapping changes a body it's checked against the Engine API's
+definition of that request (schema.json, a trimmed down copy of the
+swagger file) before it's sent along. A body that isn't valid, e.g. a
+twiddler that turned "Labels" into a list or the whole body into null, is
+rejected with a 500 that says what's wrong instead of being passed to the
+daemon. Only the types of the fields we know about are checked, other
+fields are allowed thru.
+
+Endpoints without a schema aren't checked, and a rule can turn it off
+with "validate": false.
+
+*/
+
+//go:embed schema.json
+var schemaJSON []byte
+
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 interface{}        `json:"type"` // a string or a list
+	Nullable             bool               `json:"nullable"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *schema            `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	AllOf                []*schema          `json:"allOf"`
+}
+
+type schemaFile struct {
+	Endpoints   map[string]*schema `json:"endpoints"`
+	Definitions map[string]*schema `json:"definitions"`
+}
+
+var schemas = loadSchemas()
+
+func loadSchemas() *schemaFile {
+	sf := &schemaFile{}
+	if err := decodeJSON(schemaJSON, sf); err != nil {
+		panic(fmt.Sprintf("Error parsing schema.json: %s", err))
+	}
+	return sf
+}
+
+// The schema for the request's endpoint, nil if there isn't one
+func findSchema(c *call) *schema {
+	for endpoint, s := range schemas.Endpoints {
+		parts := strings.SplitN(endpoint, " ", 2)
+		if parts[0] != c.req.Method {
+			continue
+		}
+		if _, ok := matchPath(parts[1], c.path); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// Check a new body (as it'll be sent) against the endpoint's schema
+func validateBody(c *call, buf []byte) error {
+	s := findSchema(c)
+	if s == nil {
+		return nil
+	}
+
+	var body interface{}
+	err := decodeJSON(buf, &body)
+	if err == nil {
+		err = s.validate(nil, body)
+	}
+	if err != nil {
+		return &httpError{http.StatusInternalServerError,
+			fmt.Sprintf("Twiddled body isn't valid for %s %s: %s", c.req.Method, c.path, err)}
+	}
+	return nil
+}
+
+func (s *schema) resolve() *schema {
+	for s.Ref != "" {
+		def, ok := schemas.Definitions[s.Ref]
+		if !ok {
+			panic(fmt.Sprintf("Unknown $ref %q in schema.json", s.Ref))
+		}
+		s = def
+	}
+	return s
+}
+
+func (s *schema) types() []string {
+	switch t := s.Type.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		list := []string{}
+		for _, name := range t {
+			list = append(list, fmt.Sprint(name))
+		}
+		return list
+	}
+	return nil
+}
+
+func (s *schema) validate(path []pathElem, val interface{}) error {
+	s = s.resolve()
+
+	if val == nil {
+		if s.Nullable || s.Type == nil {
+			return nil
+		}
+		return s.typeError(path, val)
+	}
+
+	for _, parent := range s.AllOf {
+		if err := parent.validate(path, val); err != nil {
+			return err
+		}
+	}
+
+	if types := s.types(); types != nil {
+		ok := false
+		for _, t := range types {
+			if isType(t, val) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return s.typeError(path, val)
+		}
+	}
+
+	if s.Enum != nil {
+		ok := false
+		for _, e := range s.Enum {
+			if equalValues(e, val) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: %s isn't one of %s", pathName(path),
+				jsonString(val), jsonString(s.Enum))
+		}
+	}
+
+	switch v := val.(type) {
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			prop := s.Properties[key]
+			if prop == nil {
+				prop = s.AdditionalProperties
+			}
+			if prop == nil {
+				continue
+			}
+			err := prop.validate(subPath(path, pathElem{key: key}), v[key])
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.Items == nil {
+			break
+		}
+		for i, item := range v {
+			err := s.Items.validate(subPath(path, pathElem{index: i, isIndex: true}), item)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *schema) typeError(path []pathElem, val interface{}) error {
+	types := s.types()
+	for i, t := range types {
+		types[i] = article(t)
+	}
+	if s.Nullable {
+		types = append(types, "null")
+	}
+	return fmt.Errorf("%s: expected %s, got %s", pathName(path),
+		strings.Join(types, " or "), typeName(val))
+}
+
+func isType(t string, val interface{}) bool {
+	switch t {
+	case "object":
+		_, ok := val.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := val.([]interface{})
+		return ok
+	case "string":
+		_, ok := val.(string)
+		return ok
+	case "boolean":
+		_, ok := val.(bool)
+		return ok
+	case "number":
+		_, ok := val.(json.Number)
+		return ok
+	case "integer":
+		n, ok := val.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	}
+	return false
+}
+
+func typeName(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case json.Number:
+		return "the number " + v.String()
+	}
+	return fmt.Sprintf("%T", val)
+}
+
+func article(t string) string {
+	if t == "" {
+		return t
+	}
+	if strings.ContainsRune("aeiou", rune(t[0])) {
+		return "an " + t
+	}
+	return "a " + t
+}
+
+func pathName(path []pathElem) string {
+	if len(path) == 0 {
+		return "body"
+	}
+	return joinPath(path)
+}
+
+func jsonString(val interface{}) string {
+	buf, err := marshalValue(val)
+	if err != nil {
+		return fmt.Sprint(val)
+	}
+	return string(buf)
+}
+
+func subPath(path []pathElem, elem pathElem) []pathElem {
+	return append(path[:len(path):len(path)], elem)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateBody(t *testing.T) {
+	tests := []struct {
+		method, path string
+		body         string
+		err          string // part of the error, "" if it's valid
+	}{
+		{"POST", "/containers/create", `{"Image":"alpine","Labels":{"a":"b"},"Unknown":[1]}`, ""},
+		{"POST", "/containers/create", `{"Labels":null,"HostConfig":{"Binds":["/a:/b"]}}`, ""},
+		{"POST", "/containers/create", `{"Labels":["a=b"]}`, "Labels"},
+		{"POST", "/containers/create", `{"Labels":{"a":1}}`, "Labels.a: expected a string"},
+		{"POST", "/containers/create", `null`, "body"},
+		{"POST", "/containers/create", `{"HostConfig":{"Binds":[1]}}`, "HostConfig.Binds[0]"},
+		{"POST", "/containers/create", `{"HostConfig":{"RestartPolicy":{"Name":"sometimes"}}}`,
+			"isn't one of"},
+		{"POST", "/containers/abc/update", `{"Memory":"lots"}`, "Memory"},
+		{"POST", "/volumes/create", `{"Name":"v","Labels":{"a":"b"}}`, ""},
+
+		// No schema
+		{"POST", "/containers/abc/start", `{"anything":[]}`, ""},
+		{"GET", "/containers/create", `null`, ""},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.path, nil)
+		c := &call{req: req, path: test.path}
+		err := validateBody(c, []byte(test.body))
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s %s: expected it to be valid, got %s", test.path, test.body, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) ||
+			err.(*httpError).code != http.StatusInternalServerError {
+			t.Errorf("%s %s: expected a 500 about %q, got %v", test.path, test.body, test.err, err)
+		}
+	}
+}
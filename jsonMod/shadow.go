@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// A mapping's mode is one of:
+//   enforce - the default, do what the mapping says
+//   shadow  - work out what the mapping would do (changes to the body, or
+//             rejecting the request) and log/audit it, but send along the
+//             original request and response
+//   off     - skip the mapping, as if it wasn't there
+//
+// This lets a new rule be tried out on a live host before it's turned on.
+
+func checkMode(mode string) error {
+	switch mode {
+	case "", "enforce", "shadow", "off":
+		return nil
+	}
+	return fmt.Errorf("\"mode\" must be \"enforce\", \"shadow\" or \"off\"")
+}
+
+func (m *mapping) isShadow() bool {
+	return m.mode == "shadow"
+}
+
+// Whatever was read from 'body' (and copied into 'read') followed by the
+// rest of it
+func putBack(read *bytes.Buffer, body io.ReadCloser) io.ReadCloser {
+	return &readCloser{io.MultiReader(read, body), body}
+}
+
+// Run the mapping against a copy of the request, and then put things back
+// the way they were. The request is never rejected.
+func shadowRequest(c *call, m *mapping) error {
+	req := c.req
+	shadowURL := *req.URL
+	shadowReq := *req
+	shadowReq.URL = &shadowURL
+	shadowReq.Header = req.Header.Clone()
+
+	// Whatever the mapping reads (a whole build context even) has to be
+	// sent along, so anything big goes to a temp file
+	read := &spool{}
+	shadowReq.Body = ioutil.NopCloser(io.TeeReader(req.Body, read))
+	defer func() {
+		req.Body = read.putBack(req.Body)
+	}()
+
+	sc := *c
+	sc.req = &shadowReq
+	sc.diff = nil
+	sc.shadow = true
+	err := enforceRequest(&sc, m)
+
+	c.diff = sc.diff
+	for _, d := range c.diff {
+		log(1, "%d: Shadow: would change %s\n", c.id, d)
+	}
+	if sc.upstream != c.upstream && sc.upstream != nil {
+		log(1, "%d: Shadow: would send it to upstream %q\n", c.id, sc.upstream.name)
+	}
+	if shadowURL.RawQuery != req.URL.RawQuery {
+		log(1, "%d: Shadow: would change the query to: %s\n", c.id, shadowURL.RawQuery)
+	}
+
+	if err != nil {
+		code := http.StatusInternalServerError
+		if he, ok := err.(*httpError); ok {
+			code = he.code
+		}
+		log(0, "%d: Shadow: would reject request(%d): %s\n", c.id, code, err)
+		metrics.shadowRejections.inc(m.name())
+		c.shadowErr = err
+	}
+	return nil
+}
+
+// Run the response twiddler against a copy of the response, log what it
+// would change, and put the original response back
+func shadowResponse(c *call, resp *http.Response, fn rFunc) error {
+	shadowResp := *resp
+	shadowResp.Header = resp.Header.Clone()
+
+	read := &bytes.Buffer{}
+	shadowResp.Body = ioutil.NopCloser(io.TeeReader(resp.Body, read))
+	defer func() {
+		resp.Body = putBack(read, resp.Body)
+	}()
+
+	if err := twiddleResponse(c, &shadowResp, fn); err != nil {
+		return err
+	}
+	if read.Len() == 0 {
+		return nil
+	}
+
+	newBuf, err := ioutil.ReadAll(shadowResp.Body)
+	if err != nil {
+		return err
+	}
+
+	var oldVal, newVal interface{}
+	if decodeJSON(read.Bytes(), &oldVal) != nil || decodeJSON(newBuf, &newVal) != nil {
+		return nil
+	}
+	for _, d := range diffValues(oldVal, newVal) {
+		log(1, "%d: Shadow: would change response %s\n", c.id, d)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestShadowMode(t *testing.T) {
+	shadow := labelRule
+	shadow.Mode = "shadow"
+	shadowDeny := ruleSpec{Verb: "POST", URL: "/containers/{id}/exec", Mode: "shadow",
+		Deny: "No exec"}
+	off := ruleSpec{Verb: "POST", URL: "/containers/{id}/start", Mode: "off"}
+	shadowResp := ruleSpec{Verb: "GET", URL: "/containers/json", Mode: "shadow",
+		Response: &responseSpec{Ops: []opSpec{{Op: "delete", Path: "Header"}}}}
+	sock := startProxy(t, testRules(t, shadow, shadowDeny, off, shadowResp), "")
+
+	if _, err := compileRule(ruleSpec{Verb: "GET", URL: "/x", Mode: "dry-run",
+		Deny: "x"}, nil); err == nil {
+		t.Errorf("Expected a bad mode to fail")
+	}
+
+	buf := &bytes.Buffer{}
+	auditMu.Lock()
+	auditLog = json.NewEncoder(buf)
+	auditMu.Unlock()
+	t.Cleanup(func() {
+		auditMu.Lock()
+		auditLog = nil
+		auditMu.Unlock()
+	})
+	rejections := metricValue(metrics.shadowRejections, "POST /containers/{id}/exec")
+
+	// Everything gets to the daemon untouched
+	tc := dialProxy(t, sock)
+	tc.send(post("/containers/create", `{"Image":"alpine"}`) +
+		post("/containers/x/exec", `{"Cmd":["sh"]}`) +
+		post("/containers/x/start", `{}`) +
+		"GET /containers/json HTTP/1.1\r\nHost: docker\r\n\r\n")
+	for _, want := range []string{`{"Image":"alpine"}`, `{"Cmd":["sh"]}`, `{}`, ``} {
+		if echo := tc.readEcho(); echo.Body != want || echo.Header == nil {
+			t.Errorf("Expected %s to be sent along as is, got %+v", want, echo)
+		}
+	}
+
+	if got := metricValue(metrics.shadowRejections, "POST /containers/{id}/exec"); got !=
+		rejections+1 {
+		t.Errorf("Expected the shadow rejection to be counted, got %g -> %g", rejections, got)
+	}
+
+	recs := []auditRecord{}
+	for _, line := range waitForLines(t, &auditMu, buf, 4) {
+		rec := auditRecord{}
+		json.Unmarshal([]byte(line), &rec)
+		recs = append(recs, rec)
+	}
+	create, exec, start := recs[0], recs[1], recs[2]
+	if !create.Shadow || create.Modified || len(create.Diff) != 1 ||
+		create.Diff[0].Path != "Labels" {
+		t.Errorf("Expected what the create would change, got %+v", create)
+	}
+	if !exec.Shadow || exec.WouldReject != "No exec" || exec.Status != 200 {
+		t.Errorf("Expected the exec to say it would be rejected, got %+v", exec)
+	}
+	if start.Mapping != "" {
+		t.Errorf("Expected the \"off\" rule to be skipped, got %+v", start)
+	}
+}
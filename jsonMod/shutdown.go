@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// On SIGTERM/SIGINT we stop accepting new connections, close any that are
+// idle (between requests), and then wait up to 'gracePeriod' for the rest
+// (e.g. a "docker pull" or an attached container) to finish before exiting.
+// A second signal skips the wait.
+
+var gracePeriod = 30 * time.Second
+
+type activeConn struct {
+	conn net.Conn
+	busy bool
+}
+
+var connsMu sync.Mutex
+var conns = map[int]*activeConn{}
+var connsWG sync.WaitGroup
+var draining = false
+var stopping = make(chan struct{}) // closed when we start draining
+var drained = make(chan struct{})
+
+// Returns false if we're shutting down and the connection should be dropped
+func trackConn(id int, conn net.Conn) bool {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	if draining {
+		return false
+	}
+	conns[id] = &activeConn{conn: conn}
+	connsWG.Add(1)
+	return true
+}
+
+func untrackConn(id int) {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	if _, ok := conns[id]; ok {
+		delete(conns, id)
+		connsWG.Done()
+	}
+}
+
+// Mark the connection as being in the middle of a request (or not).
+// Returns false if we're shutting down and the connection should stop.
+func setConnBusy(id int, busy bool) bool {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	if draining {
+		return false
+	}
+	if ac, ok := conns[id]; ok {
+		ac.busy = busy
+	}
+	return true
+}
+
+func isDraining() bool {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	return draining
+}
+
+// Stop taking new requests and close the idle connections. The busy ones
+// will stop on their own after their current request.
+func startDraining() int {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	draining = true
+	close(stopping)
+	for _, ac := range conns {
+		if !ac.busy {
+			ac.conn.Close()
+		}
+	}
+	return len(conns)
+}
+
+// Wait for SIGTERM/SIGINT and then shut things down. Once we're done
+// 'drained' is closed so main() can clean up and exit.
+func handleShutdown(listener net.Listener) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	sig := <-sigs
+	log(0, "Got %s, shutting down\n", sig)
+
+	count := startDraining()
+	listener.Close()
+
+	if count > 0 {
+		log(0, "Waiting up to %s for %d connection(s) to finish\n", gracePeriod, count)
+
+		done := make(chan struct{})
+		go func() {
+			connsWG.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(gracePeriod):
+			log(0, "Grace period is over, dropping the remaining connections\n")
+		case sig = <-sigs:
+			log(0, "Got %s again, not waiting any longer\n", sig)
+		}
+	}
+	close(drained)
+}
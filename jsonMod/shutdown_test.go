@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Wait until there are 'busy' connections in the middle of a request and
+// 'idle' ones between them
+func waitForConns(t *testing.T, busy, idle int) {
+	t.Helper()
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); {
+		connsMu.Lock()
+		b, i := 0, 0
+		for _, ac := range conns {
+			if ac.busy {
+				b++
+			} else {
+				i++
+			}
+		}
+		connsMu.Unlock()
+		if b == busy && i == idle {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d busy and %d idle connection(s)", busy, idle)
+}
+
+func TestDraining(t *testing.T) {
+	sock := startProxy(t, testRules(t, labelRule), "")
+	t.Cleanup(func() {
+		connsMu.Lock()
+		draining = false
+		stopping = make(chan struct{})
+		connsMu.Unlock()
+	})
+
+	idle := dialProxy(t, sock)
+	idle.send("GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n")
+	idle.readEcho()
+
+	// In the middle of sending its body
+	body := `{"Image":"alpine"}`
+	busy := dialProxy(t, sock)
+	busy.send(post("/containers/create", body)[:len(post("/containers/create", body))-5])
+	waitForConns(t, 1, 1)
+
+	startDraining()
+
+	// The idle one is closed right away
+	if _, err := idle.in.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the idle connection to be closed, got %v", err)
+	}
+
+	// The busy one gets to finish, and is told not to send anything else
+	busy.send(body[len(body)-5:] + "GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n")
+	resp := busy.read()
+	if resp.StatusCode != http.StatusOK || !resp.Close {
+		t.Errorf("Expected a 200 with \"Connection: close\", got %s %v", resp.Status, resp.Close)
+	}
+	ioutil.ReadAll(resp.Body)
+	if _, err := busy.in.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the busy connection to be closed after it, got %v", err)
+	}
+
+	// New connections aren't served
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n")
+	if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+		t.Errorf("Expected a new connection to be dropped")
+	}
+	waitForConns(t, 0, 0)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+
+Upstreams:
+
+By default everything is sent to "-out", but a rule file can list other
+daemons (e.g. a rootless one) and a rule can send its requests to one of
+them. Usually that's done by caller, so that everything a user does (the
+create, and then the start, attach, wait, ... of that container) goes to
+the same daemon:
+
+  "upstreams": {
+    "rootless": { "address": "unix:///run/user/1000/docker.sock",
+                  "fallback": "default" }
+  },
+  "rules": [
+    { "verb": "*", "url": "/{path*}", "uids": [ 1000 ],
+      "upstream": "rootless" }
+  ]
+
+There's no way to pick an upstream by what's in a body (e.g. a label on a
+new container) since the requests that come after it for that container
+don't have it, and would end up on the wrong daemon.
+
+Note that the first rule that matches a request is the only one used, so
+a rule like this one has to come after any other rules for uid 1000 (and
+they need their own "upstream"). A "tls://" upstream uses the "-out-tls*"
+files unless it has its own "tlscacert", "tlscert" and "tlskey".
+
+"-out" is called "default". Each upstream is checked with a "GET /_ping"
+every "-health-interval", and while one is down (or if we can't connect to
+it) its requests go to its "fallback", if it has one.
+
+*/
+
+type upstreamSpec struct {
+	Address  string `json:"address"`
+	Fallback string `json:"fallback"`
+	CACert   string `json:"tlscacert"`
+	Cert     string `json:"tlscert"`
+	Key      string `json:"tlskey"`
+}
+
+type upstream struct {
+	name     string
+	addr     string
+	tls      *tls.Config // nil if not TLS
+	fallback *upstream
+
+	mu      sync.Mutex
+	healthy bool
+}
+
+// This is "-out"
+var defaultUpstream *upstream
+
+var healthInterval = 10 * time.Second
+
+func newUpstream(name, addr string, files tlsFiles) (*upstream, error) {
+	_, address, useTLS, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upstream{name: name, addr: addr, healthy: true}
+	if useTLS {
+		if u.tls, err = upstreamTLSConfig(files, address); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// Check the "-out" address and set up its TLS config, if it needs one
+func setupUpstream(addr string) error {
+	u, err := newUpstream("default", addr, outTLS)
+	if err != nil {
+		return err
+	}
+	defaultUpstream = u
+	return nil
+}
+
+func compileUpstreams(specs map[string]upstreamSpec) (map[string]*upstream, error) {
+	upstreams := map[string]*upstream{}
+	if defaultUpstream != nil {
+		upstreams["default"] = defaultUpstream
+	}
+
+	for name, spec := range specs {
+		if name == "default" {
+			return nil, fmt.Errorf("Upstream %q is \"-out\", it can't be redefined", name)
+		}
+		if spec.Address == "" {
+			return nil, fmt.Errorf("Upstream %q is missing an \"address\"", name)
+		}
+
+		files := outTLS
+		if spec.CACert != "" || spec.Cert != "" || spec.Key != "" {
+			files = tlsFiles{caCert: spec.CACert, cert: spec.Cert, key: spec.Key}
+		}
+		u, err := newUpstream(name, spec.Address, files)
+		if err != nil {
+			return nil, fmt.Errorf("Upstream %q: %s", name, err)
+		}
+		upstreams[name] = u
+	}
+
+	for name, spec := range specs {
+		if spec.Fallback == "" {
+			continue
+		}
+		fallback, ok := upstreams[spec.Fallback]
+		if !ok {
+			return nil, fmt.Errorf("Upstream %q has an unknown fallback %q", name, spec.Fallback)
+		}
+		upstreams[name].fallback = fallback
+	}
+
+	// Make sure the fallbacks don't go around in circles
+	for name, u := range upstreams {
+		seen := map[*upstream]bool{}
+		for cur := u; cur != nil; cur = cur.fallback {
+			if seen[cur] {
+				return nil, fmt.Errorf("Upstream %q's fallbacks loop", name)
+			}
+			seen[cur] = true
+		}
+	}
+	return upstreams, nil
+}
+
+func (u *upstream) dial() (net.Conn, error) {
+	network, address, _, err := parseAddr(u.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.tls != nil {
+		return tls.Dial(network, address, u.tls)
+	}
+	return net.Dial(network, address)
+}
+
+func (u *upstream) isHealthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy
+}
+
+func (u *upstream) setHealthy(healthy bool, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if healthy && !u.healthy {
+		log(0, "Upstream %q (%s) is back up\n", u.name, u.addr)
+	} else if !healthy && u.healthy {
+		log(0, "Upstream %q (%s) is down: %s\n", u.name, u.addr, err)
+	}
+	u.healthy = healthy
+
+	up := 0.0
+	if healthy {
+		up = 1
+	}
+	metrics.upstreamUp.set(up, u.name)
+}
+
+// The first upstream that's up, following the fallbacks. If they're all
+// down we stick with the first one.
+func (u *upstream) pick() *upstream {
+	for cur := u; cur != nil; cur = cur.fallback {
+		if cur.isHealthy() {
+			return cur
+		}
+	}
+	return u
+}
+
+// Connect to the upstream, or one of its fallbacks if we can't
+func dialUpstream(c *call, u *upstream) (*upstream, net.Conn, error) {
+	for cur := u.pick(); ; cur = cur.fallback {
+		conn, err := cur.dial()
+		if err == nil {
+			return cur, conn, nil
+		}
+
+		log(0, "%d: Error connecting to upstream %q: %v\n", c.id, cur.name, err)
+		metrics.dialFailures.inc(cur.name)
+		cur.setHealthy(false, err)
+		if cur.fallback == nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (u *upstream) ping() error {
+	conn, err := u.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	timeout := healthInterval
+	if timeout > 5*time.Second {
+		timeout = 5 * time.Second
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req, _ := http.NewRequest("GET", "http://docker/_ping", nil)
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("/_ping returned %s", resp.Status)
+	}
+	return nil
+}
+
+// "-out" and everything the current mappings (and their fallbacks) use
+func allUpstreams() []*upstream {
+	seen := map[*upstream]bool{}
+	list := []*upstream{}
+
+	add := func(u *upstream) {
+		for ; u != nil && !seen[u]; u = u.fallback {
+			seen[u] = true
+			list = append(list, u)
+		}
+	}
+
+	add(defaultUpstream)
+	for _, m := range currentMappings() {
+		add(m.upstream)
+	}
+	return list
+}
+
+func watchUpstreams(interval time.Duration) {
+	for range time.NewTicker(interval).C {
+		for _, u := range allUpstreams() {
+			go func(u *upstream) {
+				err := u.ping()
+				u.setHealthy(err == nil, err)
+			}(u)
+		}
+	}
+}
+
+// One client connection's connections to the upstreams, each one is
+// opened the first time it's needed and then reused
+type upstreamConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
@@ -69,18 +69,65 @@ func StructGet(obj interface{}, key string) (interface{}, error) {
 	return nil, fmt.Errorf("Not found")
 }
 
-/* Note will not work for cases where the ext is in a struct that is in a
-   non-struct top level thing - e.g. a struct in a map */
+// Marshal is like json.Marshal except that the entries in a struct's
+// "extension" map are written out as properties of the struct. Structs
+// inside of pointers, slices and maps are handled too.
 func Marshal(obj interface{}) ([]byte, error) {
+	if obj == nil {
+		return []byte("null"), nil
+	}
 	objValue := reflect.ValueOf(obj)
 
 	// If its a pointer, dereference it so we can check its real type
 	if objValue.Type().Kind() == reflect.Ptr {
+		if objValue.IsNil() {
+			return []byte("null"), nil
+		}
 		objValue = objValue.Elem()
 	}
 
-	// If its not a struct then just do normal JSON parsing
-	if objValue.Type().Kind() != reflect.Struct {
+	// Let types that know how to do it themselves (e.g. time.Time) do it
+	if objValue.Type().Implements(marshalerType) ||
+		reflect.PtrTo(objValue.Type()).Implements(marshalerType) {
+		return json.Marshal(obj)
+	}
+
+	switch objValue.Type().Kind() {
+	case reflect.Slice:
+		// []byte is base64'd by the json package
+		if objValue.IsNil() || objValue.Type().Elem().Kind() == reflect.Uint8 {
+			return json.Marshal(obj)
+		}
+		list := make([]json.RawMessage, objValue.Len())
+		for i := range list {
+			b, err := Marshal(objValue.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			list[i] = b
+		}
+		return json.Marshal(list)
+
+	case reflect.Map:
+		if objValue.IsNil() || objValue.Type().Key().Kind() != reflect.String {
+			return json.Marshal(obj)
+		}
+		rawMap := map[string]json.RawMessage{}
+		iter := objValue.MapRange()
+		for iter.Next() {
+			b, err := Marshal(iter.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+			rawMap[iter.Key().String()] = b
+		}
+		return json.Marshal(rawMap)
+
+	case reflect.Struct:
+		// Handled below
+
+	default:
+		// If its not a struct then just do normal JSON parsing
 		return json.Marshal(obj)
 	}
 
@@ -95,12 +142,21 @@ func Marshal(obj interface{}) ([]byte, error) {
 			continue
 		}
 
-		jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		jsonName := strings.Split(tag, ",")[0]
 		// If no custom name, then just use the property name itself
 		if jsonName == "" {
 			jsonName = field.Name
 		}
 
+		// Skip empty values if asked to, just like the json package
+		if hasOption(tag, "omitempty") && isEmptyValue(objValue.Field(i)) {
+			continue
+		}
+
 		// For each extension in the map, make it a top-level property
 		// in the map we're constructing
 		if strings.Contains(field.Tag.Get("json"), ",exts") {
@@ -149,7 +205,23 @@ func MarshalIndent(obj interface{}, prefix, indent string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// Unmarshal is like json.Unmarshal except that any unknown properties of
+// a struct are saved in its "extension" map (the field with the `exts`
+// json tag), if it has one. Structs inside of pointers, slices and maps are
+// handled too.
 func Unmarshal(jsonStr []byte, obj interface{}) error {
+	return unmarshal(jsonStr, obj, false)
+}
+
+// UnmarshalUseNumber is like Unmarshal except that numbers that end up in an
+// interface{} (e.g. in an extension map) are json.Numbers instead of
+// float64s, just like json.Decoder's UseNumber(). Use it when large numbers
+// need to survive the round-trip.
+func UnmarshalUseNumber(jsonStr []byte, obj interface{}) error {
+	return unmarshal(jsonStr, obj, true)
+}
+
+func unmarshal(jsonStr []byte, obj interface{}, useNumber bool) error {
 	objValue := reflect.ValueOf(obj)
 
 	// If its a pointer, dereference it so we can check its real type
@@ -157,9 +229,77 @@ func Unmarshal(jsonStr []byte, obj interface{}) error {
 		objValue = objValue.Elem()
 	}
 
-	// If its not a struct then just do normal JSON parsing
-	if objValue.Type().Kind() != reflect.Struct {
-		return json.Unmarshal(jsonStr, obj)
+	// Let types that know how to do it themselves (e.g. time.Time) do it
+	if reflect.PtrTo(objValue.Type()).Implements(unmarshalerType) {
+		return decode(jsonStr, obj, useNumber)
+	}
+
+	switch objValue.Type().Kind() {
+	case reflect.Ptr:
+		// e.g. a *struct field. null means nil, otherwise fill in
+		// whatever it points to
+		if bytes.Equal(bytes.TrimSpace(jsonStr), []byte("null")) {
+			objValue.Set(reflect.Zero(objValue.Type()))
+			return nil
+		}
+		if objValue.IsNil() {
+			objValue.Set(reflect.New(objValue.Type().Elem()))
+		}
+		return unmarshal(jsonStr, objValue.Interface(), useNumber)
+
+	case reflect.Slice:
+		if !hasStructs(objValue.Type().Elem()) {
+			return decode(jsonStr, obj, useNumber)
+		}
+		var list []json.RawMessage
+		if err := json.Unmarshal(jsonStr, &list); err != nil {
+			return err
+		}
+		if list == nil {
+			objValue.Set(reflect.Zero(objValue.Type()))
+			return nil
+		}
+		newList := reflect.MakeSlice(objValue.Type(), len(list), len(list))
+		for i, item := range list {
+			err := unmarshal(item, newList.Index(i).Addr().Interface(), useNumber)
+			if err != nil {
+				return err
+			}
+		}
+		objValue.Set(newList)
+		return nil
+
+	case reflect.Map:
+		if objValue.Type().Key().Kind() != reflect.String ||
+			!hasStructs(objValue.Type().Elem()) {
+			return decode(jsonStr, obj, useNumber)
+		}
+		var rawMap map[string]json.RawMessage
+		if err := json.Unmarshal(jsonStr, &rawMap); err != nil {
+			return err
+		}
+		if rawMap == nil {
+			objValue.Set(reflect.Zero(objValue.Type()))
+			return nil
+		}
+		newMap := reflect.MakeMap(objValue.Type())
+		for key, val := range rawMap {
+			elem := reflect.New(objValue.Type().Elem())
+			if err := unmarshal(val, elem.Interface(), useNumber); err != nil {
+				return err
+			}
+			newMap.SetMapIndex(reflect.ValueOf(key).Convert(objValue.Type().Key()),
+				elem.Elem())
+		}
+		objValue.Set(newMap)
+		return nil
+
+	case reflect.Struct:
+		// Handled below
+
+	default:
+		// If its not a struct then just do normal JSON parsing
+		return decode(jsonStr, obj, useNumber)
 	}
 
 	rawMap := map[string]json.RawMessage{}
@@ -175,6 +315,10 @@ func Unmarshal(jsonStr []byte, obj interface{}) error {
 			continue
 		}
 
+		if field.Tag.Get("json") == "-" {
+			continue
+		}
+
 		jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
 		// If not custom name, then just use the property name itself
 		if jsonName == "" {
@@ -218,14 +362,14 @@ func Unmarshal(jsonStr []byte, obj interface{}) error {
 	for key, val := range rawMap {
 		if field, found := knownFields[strings.ToLower(key)]; found {
 			// Found a normal property, so parse it
-			err := Unmarshal(val, field.Addr().Interface())
+			err := unmarshal(val, field.Addr().Interface(), useNumber)
 			if err != nil {
 				return err
 			}
 		} else if extensions != nil {
 			// Unknown, save it in our extension property, if we have one
 			var v interface{}
-			if err := Unmarshal(val, &v); err != nil {
+			if err := decode(val, &v, useNumber); err != nil {
 				return err
 			}
 			extensions[key] = v
@@ -233,3 +377,69 @@ func Unmarshal(jsonStr []byte, obj interface{}) error {
 	}
 	return nil
 }
+
+var (
+	marshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// Parse non-struct things with the json package
+func decode(jsonStr []byte, obj interface{}, useNumber bool) error {
+	if !useNumber {
+		return json.Unmarshal(jsonStr, obj)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(jsonStr))
+	dec.UseNumber()
+	if err := dec.Decode(obj); err != nil {
+		return err
+	}
+	if dec.More() {
+		return fmt.Errorf("Unexpected data after the JSON value")
+	}
+	return nil
+}
+
+// Does this type have structs in it (that might have extensions) that
+// the json package won't know what to do with
+func hasStructs(typ reflect.Type) bool {
+	for {
+		switch typ.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+			typ = typ.Elem()
+		case reflect.Struct:
+			return !reflect.PtrTo(typ).Implements(unmarshalerType)
+		default:
+			return false
+		}
+	}
+}
+
+func hasOption(tag string, option string) bool {
+	for _, opt := range strings.Split(tag, ",")[1:] {
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+// Same as the json package's idea of "empty"
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"strings"
 
 	".."
 )
@@ -99,11 +100,154 @@ func main() {
 	r2, e2 := jsonext.StructGet(t3v1, "f1")
 
 	if r1 == nil || r1 != r2 {
-		fmt.Printf("Values don't match: r1(%v, e1) r2(%v,e2)\n", r1, e1, r2, e2)
+		fmt.Printf("Values don't match: r1(%v, %v) r2(%v, %v)\n", r1, e1, r2, e2)
 		rc = 1
 	} else {
 		fmt.Printf("Test3: PASS\n")
 	}
 
+	// Test 4 - structs inside of pointers, slices and maps get their
+	// extensions too
+	type t4Item struct {
+		Name   string                 `json:"name"`
+		Extras map[string]interface{} `json:",exts"`
+	}
+	t4json := `{
+	  "ptr": { "name": "p", "px": 1 },
+	  "list": [ { "name": "l0", "lx": "a" }, { "name": "l1" } ],
+	  "byName": { "k": { "name": "m", "mx": [ 1, 2 ] } },
+	  "top": true
+	}`
+	t4v := struct {
+		Ptr    *t4Item                `json:"ptr"`
+		List   []t4Item               `json:"list"`
+		ByName map[string]t4Item      `json:"byName"`
+		Extras map[string]interface{} `json:",exts"`
+	}{}
+
+	err = jsonext.Unmarshal([]byte(t4json), &t4v)
+	b4, err4 := jsonext.Marshal(t4v)
+	t4After := map[string]interface{}{}
+	json.Unmarshal(b4, &t4After)
+	t4Orig := map[string]interface{}{}
+	json.Unmarshal([]byte(t4json), &t4Orig)
+
+	if err != nil || err4 != nil || t4v.Ptr == nil || t4v.Ptr.Extras["px"] != 1.0 ||
+		len(t4v.List) != 2 || t4v.List[0].Extras["lx"] != "a" ||
+		t4v.ByName["k"].Name != "m" || t4v.ByName["k"].Extras["mx"] == nil ||
+		t4v.Extras["top"] != true || !reflect.DeepEqual(t4Orig, t4After) {
+		fmt.Printf("Nested structs don't round-trip (%v, %v):\n%#v\n%s\n", err, err4,
+			t4v, b4)
+		rc = 1
+	} else {
+		fmt.Printf("Test4: PASS\n")
+	}
+
+	// Test 5 - "omitempty" is the same as the json package's
+	type t5Inner struct {
+		A string `json:"a,omitempty"`
+	}
+	type t5Struct struct {
+		Str    string            `json:"str,omitempty"`
+		Num    int               `json:"num,omitempty"`
+		Bool   bool              `json:"bool,omitempty"`
+		List   []string          `json:"list,omitempty"`
+		Map    map[string]string `json:"map,omitempty"`
+		Ptr    *t5Inner          `json:"ptr,omitempty"`
+		Inner  t5Inner           `json:"inner,omitempty"` // never empty
+		Always string            `json:"always"`
+	}
+	t5Empty := t5Struct{List: []string{}, Map: map[string]string{}}
+	t5Full := t5Struct{Str: "s", Num: 1, Bool: true, List: []string{"x"},
+		Map: map[string]string{"k": "v"}, Ptr: &t5Inner{}, Always: "a"}
+
+	rc5 := 0
+	for _, v := range []t5Struct{t5Empty, t5Full} {
+		got, err1 := jsonext.Marshal(v)
+		want, err2 := json.Marshal(v)
+		gotMap := map[string]interface{}{}
+		wantMap := map[string]interface{}{}
+		json.Unmarshal(got, &gotMap)
+		json.Unmarshal(want, &wantMap)
+		if err1 != nil || err2 != nil || !reflect.DeepEqual(gotMap, wantMap) {
+			fmt.Printf("omitempty doesn't match the json package:\n%s\n%s\n", got, want)
+			rc5 = 1
+		}
+	}
+	if rc5 != 0 {
+		rc = 1
+	} else {
+		fmt.Printf("Test5: PASS\n")
+	}
+
+	// Test 6 - "-" fields are never read or written, and don't end up in
+	// the extensions either
+	t6v := struct {
+		Name   string                 `json:"name"`
+		Secret string                 `json:"-"`
+		Extras map[string]interface{} `json:",exts"`
+	}{}
+	err = jsonext.Unmarshal([]byte(`{ "name": "n", "Secret": "s", "-": "d" }`), &t6v)
+	t6v.Secret = "hidden"
+	b6, err6 := jsonext.Marshal(t6v)
+	t6After := map[string]interface{}{}
+	json.Unmarshal(b6, &t6After)
+
+	if err != nil || err6 != nil || t6v.Name != "n" || t6v.Extras["Secret"] != "s" ||
+		t6v.Extras["-"] != "d" || t6After["Secret"] != "s" || len(t6After) != 3 {
+		fmt.Printf("\"-\" fields were used (%v, %v): %#v %s\n", err, err6, t6v, b6)
+		rc = 1
+	} else {
+		fmt.Printf("Test6: PASS\n")
+	}
+
+	// Test 7 - UnmarshalUseNumber keeps numbers exactly as they were
+	t7json := `{ "big": 12345678901234567890, "list": [ 1.50 ], "n": 7 }`
+	t7v := struct {
+		N      int                    `json:"n"`
+		Extras map[string]interface{} `json:",exts"`
+	}{}
+	t7f := t7v
+
+	err = jsonext.UnmarshalUseNumber([]byte(t7json), &t7v)
+	err7 := jsonext.Unmarshal([]byte(t7json), &t7f)
+	b7, _ := jsonext.Marshal(t7v)
+	list, _ := t7v.Extras["list"].([]interface{})
+
+	if err != nil || err7 != nil || t7v.N != 7 ||
+		t7v.Extras["big"] != json.Number("12345678901234567890") ||
+		len(list) != 1 || list[0] != json.Number("1.50") ||
+		!strings.Contains(string(b7), `"big":12345678901234567890`) ||
+		!strings.Contains(string(b7), `[1.50]`) {
+		fmt.Printf("UnmarshalUseNumber lost precision (%v): %#v %s\n", err, t7v, b7)
+		rc = 1
+	} else if _, ok := t7f.Extras["big"].(float64); !ok {
+		fmt.Printf("Unmarshal should use float64s: %#v\n", t7f)
+		rc = 1
+	} else {
+		fmt.Printf("Test7: PASS\n")
+	}
+
+	// Test 8 - null pointers, and non-struct values at the top
+	t8v := struct {
+		Ptr  *t4Item `json:"ptr"`
+		Ptr2 *t4Item `json:"ptr2"`
+	}{Ptr: &t4Item{Name: "old"}}
+	err = jsonext.Unmarshal([]byte(`{ "ptr": null }`), &t8v)
+	b8, err8 := jsonext.Marshal(t8v)
+	bNil, _ := jsonext.Marshal(nil)
+	bList, _ := jsonext.Marshal([]int{1, 2})
+	bBytes, _ := jsonext.Marshal([]byte("hi"))
+
+	if err != nil || err8 != nil || t8v.Ptr != nil ||
+		string(b8) != `{"ptr":null,"ptr2":null}` || string(bNil) != "null" ||
+		string(bList) != "[1,2]" || string(bBytes) != `"aGk="` {
+		fmt.Printf("Null pointers (%v, %v): %#v %s %s %s %s\n", err, err8, t8v, b8, bNil,
+			bList, bBytes)
+		rc = 1
+	} else {
+		fmt.Printf("Test8: PASS\n")
+	}
+
 	os.Exit(rc)
 }